@@ -0,0 +1,373 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Políticas de descarte cuando la cola de un batcher está llena.
+const (
+	dropOldest = "oldest"
+	dropNewest = "newest"
+)
+
+// Valores por defecto del envío en lotes de todos los sinks remotos.
+const (
+	defaultSinkBatchSize  = 500
+	defaultSinkBatchWait  = time.Second
+	defaultSinkQueueSize  = 10000
+	defaultSinkBackoff    = 500 * time.Millisecond
+	defaultSinkBackoffMax = 30 * time.Second
+	defaultSinkRetryFor   = 5 * time.Minute
+)
+
+// batchCloseTimeout es lo que Close espera, como mucho, a que se envíe lo
+// pendiente cuando el servidor no responde.
+const batchCloseTimeout = 5 * time.Second
+
+// batchConfig agrupa los parámetros de envío en lotes de un sink remoto.
+type batchConfig struct {
+	Size       int           // líneas por lote
+	Interval   time.Duration // espera máxima antes de enviar un lote incompleto
+	QueueSize  int           // líneas que caben en memoria a la espera
+	Drop       string        // dropOldest o dropNewest
+	Backoff    time.Duration // primera espera entre reintentos
+	BackoffMax time.Duration // espera máxima entre reintentos
+	RetryFor   time.Duration // tiempo tras el que se abandona un lote
+
+	// Spool, si no es nil, guarda en disco los lotes que no se han podido
+	// enviar; se reenvían en orden cuando Ready dice que el servidor vuelve
+	// a estar disponible.
+	Spool *spool
+	Ready func() bool
+}
+
+func parseDropPolicy(value string) (string, error) {
+	switch value {
+	case dropOldest, dropNewest:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid drop policy %q (want oldest or newest)", value)
+}
+
+// pushError es un error al enviar un lote; retry dice si merece la pena
+// reintentarlo y after cuánto pidió esperar el servidor. Si el servidor
+// aceptó parte del lote, rest son los registros que quedan por enviar.
+type pushError struct {
+	err   error
+	retry bool
+	after time.Duration
+	rest  []LogRecord
+}
+
+func (e *pushError) Error() string {
+	return e.err.Error()
+}
+
+// responseError convierte una respuesta HTTP no satisfactoria en un
+// pushError: 429 y 5xx son temporales, y Retry-After se respeta.
+func responseError(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err := &pushError{
+		err:   fmt.Errorf("unexpected status %s", resp.Status),
+		retry: resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500,
+	}
+	if value := resp.Header.Get("Retry-After"); value != "" {
+		if secs, perr := strconv.Atoi(value); perr == nil {
+			err.after = time.Duration(secs) * time.Second
+		} else if when, perr := http.ParseTime(value); perr == nil {
+			err.after = time.Until(when)
+		}
+	}
+	return err
+}
+
+// retryable dice si err merece un reintento: los errores de red lo merecen
+// siempre, y los de respuesta según su código.
+func retryable(err error) (bool, time.Duration) {
+	var perr *pushError
+	if errors.As(err, &perr) {
+		return perr.retry, perr.after
+	}
+	return true, 0
+}
+
+// batcher acumula registros en una cola acotada y los envía en lotes con
+// send desde una goroutine propia, reintentando los errores temporales con
+// backoff exponencial y jitter. Add nunca espera a la red.
+type batcher struct {
+	name string
+	cfg  batchConfig
+	send func(batch []LogRecord) error
+	logf func(msg string)
+
+	mu    sync.Mutex
+	queue []LogRecord
+
+	ready chan struct{} // avisa de que hay un lote completo
+	stop  chan struct{}
+	abort chan struct{} // corta los reintentos al cerrar
+	done  chan struct{}
+
+	droppedQueue  int64
+	droppedFailed int64
+
+	// nextReplay es cuándo volver a intentar vaciar el spool, y replayDelay
+	// la espera tras el siguiente fallo.
+	nextReplay  time.Time
+	replayDelay time.Duration
+}
+
+func newBatcher(name string, cfg batchConfig, send func(batch []LogRecord) error, logf func(msg string)) *batcher {
+	b := &batcher{
+		name:  name,
+		cfg:   cfg,
+		send:  send,
+		logf:  logf,
+		ready: make(chan struct{}, 1),
+		stop:  make(chan struct{}),
+		abort: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// Add encola rec, descartando según la política si la cola está llena.
+func (b *batcher) Add(rec LogRecord) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.cfg.QueueSize > 0 && len(b.queue) >= b.cfg.QueueSize {
+		atomic.AddInt64(&b.droppedQueue, 1)
+		if b.cfg.Drop == dropNewest {
+			return
+		}
+		b.queue = b.queue[1:]
+	}
+	b.queue = append(b.queue, rec)
+	if len(b.queue) >= b.cfg.Size {
+		select {
+		case b.ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close envía lo pendiente, esperando como mucho batchCloseTimeout si el
+// servidor falla, e informa de las líneas perdidas.
+func (b *batcher) Close() {
+	timer := time.AfterFunc(batchCloseTimeout, func() { close(b.abort) })
+	close(b.stop)
+	<-b.done
+	timer.Stop()
+
+	if n := atomic.LoadInt64(&b.droppedQueue); n > 0 {
+		b.logf(fmt.Sprintf("%s: dropped %d lines because the queue was full", b.name, n))
+	}
+	if n := atomic.LoadInt64(&b.droppedFailed); n > 0 {
+		b.logf(fmt.Sprintf("%s: dropped %d lines that could not be sent", b.name, n))
+	}
+	if b.cfg.Spool != nil {
+		if n := b.cfg.Spool.Pending(); n > 0 {
+			b.logf(fmt.Sprintf("%s: %d lines left in the spool, to be sent on the next start", b.name, n))
+		}
+	}
+}
+
+func (b *batcher) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.cfg.Interval)
+	defer ticker.Stop()
+
+	// Lo que quedara en el spool de una ejecución anterior se envía primero.
+	b.replay()
+	for {
+		select {
+		case <-ticker.C:
+			b.replay()
+			b.flush(false)
+		case <-b.ready:
+			b.flush(true)
+		case <-b.stop:
+			// Al detenerse, se envía todo lo pendiente.
+			b.nextReplay = time.Time{}
+			b.replay()
+			b.flush(false)
+			return
+		}
+	}
+}
+
+// flush envía la cola en lotes; con onlyFull, sólo los lotes completos.
+func (b *batcher) flush(onlyFull bool) {
+	for {
+		b.mu.Lock()
+		n := len(b.queue)
+		if n == 0 || (onlyFull && n < b.cfg.Size) {
+			b.mu.Unlock()
+			return
+		}
+		if n > b.cfg.Size {
+			n = b.cfg.Size
+		}
+		batch := b.queue[:n:n]
+		b.queue = b.queue[n:]
+		b.mu.Unlock()
+
+		select {
+		case <-b.abort:
+			b.fail(batch, errors.New("timed out while closing"))
+			continue
+		default:
+		}
+		if b.cfg.Spool != nil && b.cfg.Spool.Pending() > 0 {
+			// Para conservar el orden, mientras haya algo en el spool lo
+			// nuevo va detrás.
+			b.spool(batch)
+			continue
+		}
+		b.deliver(batch)
+	}
+}
+
+// deliver envía batch reintentando mientras el error sea temporal y no se
+// agote cfg.RetryFor.
+func (b *batcher) deliver(batch []LogRecord) {
+	start := time.Now()
+	delay := b.cfg.Backoff
+	for {
+		err := b.send(batch)
+		if err == nil {
+			return
+		}
+		countPushError(b.name)
+		var perr *pushError
+		if errors.As(err, &perr) && perr.rest != nil {
+			batch = perr.rest
+		}
+		retry, wait := retryable(err)
+		if wait <= 0 {
+			wait = jitter(delay)
+		}
+		if !retry || time.Since(start)+wait > b.cfg.RetryFor {
+			b.fail(batch, err)
+			return
+		}
+		b.logf(fmt.Sprintf("%s: push failed: %v; retrying in %s", b.name, err, wait.Round(time.Millisecond)))
+
+		select {
+		case <-time.After(wait):
+		case <-b.abort:
+			b.fail(batch, err)
+			return
+		}
+		if delay *= 2; delay > b.cfg.BackoffMax {
+			delay = b.cfg.BackoffMax
+		}
+	}
+}
+
+// fail guarda batch en el spool si lo hay y el error es temporal, o lo
+// descarta.
+func (b *batcher) fail(batch []LogRecord, err error) {
+	if retry, _ := retryable(err); retry && b.cfg.Spool != nil {
+		b.logf(fmt.Sprintf("%s: push failed: %v; spooling %d lines", b.name, err, len(batch)))
+		b.spool(batch)
+		return
+	}
+	atomic.AddInt64(&b.droppedFailed, int64(len(batch)))
+	b.logf(fmt.Sprintf("%s: dropping %d lines: %v", b.name, len(batch), err))
+}
+
+// addDropped suma n a las líneas perdidas, para los sinks que descartan
+// por su cuenta parte de un lote, como los documentos que rechaza
+// Elasticsearch.
+func (b *batcher) addDropped(n int) {
+	atomic.AddInt64(&b.droppedFailed, int64(n))
+}
+
+func (b *batcher) spool(batch []LogRecord) {
+	dropped, err := b.cfg.Spool.Write(batch, b.cfg.Drop)
+	if err != nil {
+		dropped = len(batch)
+		b.logf(fmt.Sprintf("%s: could not spool %d lines: %v", b.name, len(batch), err))
+	} else if dropped > 0 {
+		b.logf(fmt.Sprintf("%s: spool is full; dropping %d lines", b.name, dropped))
+	}
+	atomic.AddInt64(&b.droppedFailed, int64(dropped))
+}
+
+// replay reenvía en orden los lotes del spool si el servidor está
+// disponible, hasta que se vacía o falla un envío.
+func (b *batcher) replay() {
+	if b.cfg.Spool == nil || b.cfg.Spool.Pending() == 0 || time.Now().Before(b.nextReplay) {
+		return
+	}
+	if b.cfg.Ready != nil && !b.cfg.Ready() {
+		b.replayFailed()
+		return
+	}
+
+	pending := b.cfg.Spool.Pending()
+	b.logf(fmt.Sprintf("%s: replaying %d spooled lines", b.name, pending))
+	for {
+		select {
+		case <-b.abort:
+			return
+		default:
+		}
+
+		batch, ok, err := b.cfg.Spool.Oldest()
+		if !ok {
+			b.replayDelay = 0
+			return
+		}
+		if err != nil {
+			// Un segmento que no se puede leer, como uno truncado por una
+			// caída, no se arregla reintentando; se descarta para no
+			// bloquear los demás.
+			lost := b.cfg.Spool.RemoveOldest()
+			atomic.AddInt64(&b.droppedFailed, int64(lost))
+			b.logf(fmt.Sprintf("%s: dropping %d unreadable spooled lines: %v", b.name, lost, err))
+			continue
+		}
+		if err := b.send(batch); err != nil {
+			countPushError(b.name)
+			if retry, _ := retryable(err); retry {
+				b.logf(fmt.Sprintf("%s: replay failed: %v", b.name, err))
+				b.replayFailed()
+				return
+			}
+			atomic.AddInt64(&b.droppedFailed, int64(len(batch)))
+			b.logf(fmt.Sprintf("%s: dropping %d spooled lines: %v", b.name, len(batch), err))
+		}
+		b.cfg.Spool.RemoveOldest()
+	}
+}
+
+// replayFailed aplaza el siguiente intento de vaciar el spool.
+func (b *batcher) replayFailed() {
+	if b.replayDelay < b.cfg.Backoff {
+		b.replayDelay = b.cfg.Backoff
+	} else if b.replayDelay *= 2; b.replayDelay > b.cfg.BackoffMax {
+		b.replayDelay = b.cfg.BackoffMax
+	}
+	b.nextReplay = time.Now().Add(jitter(b.replayDelay))
+}
+
+// jitter devuelve una espera al azar entre d/2 y d.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testBatchConfig() batchConfig {
+	return batchConfig{
+		Size:       2,
+		Interval:   10 * time.Millisecond,
+		QueueSize:  100,
+		Drop:       dropOldest,
+		Backoff:    time.Millisecond,
+		BackoffMax: 5 * time.Millisecond,
+		RetryFor:   time.Second,
+	}
+}
+
+func TestBatcherRetries(t *testing.T) {
+	var calls int32
+	var mu sync.Mutex
+	var sent []string
+	send := func(batch []LogRecord) error {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			return errors.New("connection refused")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rec := range batch {
+			sent = append(sent, rec.Line)
+		}
+		return nil
+	}
+	var logs []string
+	b := newBatcher("test", testBatchConfig(), send, func(msg string) { logs = append(logs, msg) })
+	for i := 0; i < 3; i++ {
+		b.Add(LogRecord{Line: fmt.Sprint(i)})
+	}
+	b.Close()
+
+	if strings.Join(sent, ",") != "0,1,2" {
+		t.Fatalf("esperaba enviar 0,1,2 en orden, obtuve %v", sent)
+	}
+	if len(logs) != 2 || !strings.Contains(logs[0], "retrying") {
+		t.Fatalf("esperaba dos avisos de reintento, obtuve %q", logs)
+	}
+}
+
+func TestBatcherDropsPermanentErrors(t *testing.T) {
+	var calls int32
+	send := func(batch []LogRecord) error {
+		atomic.AddInt32(&calls, 1)
+		return &pushError{err: errors.New("400 Bad Request")}
+	}
+	var logs []string
+	b := newBatcher("test", testBatchConfig(), send, func(msg string) { logs = append(logs, msg) })
+	b.Add(LogRecord{Line: "a"})
+	b.Close()
+
+	if calls != 1 {
+		t.Fatalf("un error permanente no debería reintentarse, hubo %d envíos", calls)
+	}
+	if len(logs) != 2 || !strings.Contains(logs[1], "dropped 1 lines that could not be sent") {
+		t.Fatalf("esperaba el recuento de descartes, obtuve %q", logs)
+	}
+}
+
+func TestBatcherQueueDropPolicy(t *testing.T) {
+	for policy, want := range map[string]string{dropOldest: "2,3", dropNewest: "0,1"} {
+		cfg := testBatchConfig()
+		cfg.QueueSize, cfg.Drop, cfg.Interval = 2, policy, time.Hour
+		cfg.Size = 10
+		var sent []string
+		send := func(batch []LogRecord) error {
+			for _, rec := range batch {
+				sent = append(sent, rec.Line)
+			}
+			return nil
+		}
+		var logs []string
+		b := newBatcher("test", cfg, send, func(msg string) { logs = append(logs, msg) })
+		for i := 0; i < 4; i++ {
+			b.Add(LogRecord{Line: fmt.Sprint(i)})
+		}
+		b.Close()
+
+		if strings.Join(sent, ",") != want {
+			t.Fatalf("%s: esperaba %s, obtuve %v", policy, want, sent)
+		}
+		if len(logs) != 1 || !strings.Contains(logs[0], "dropped 2 lines because the queue was full") {
+			t.Fatalf("%s: esperaba el recuento de descartes, obtuve %q", policy, logs)
+		}
+	}
+}
+
+func TestResponseError(t *testing.T) {
+	cases := []struct {
+		status     int
+		retryAfter string
+		retry      bool
+		after      time.Duration
+	}{
+		{http.StatusNoContent, "", false, 0},
+		{http.StatusBadRequest, "", false, 0},
+		{http.StatusTooManyRequests, "3", true, 3 * time.Second},
+		{http.StatusServiceUnavailable, "", true, 0},
+	}
+	for _, c := range cases {
+		resp := &http.Response{StatusCode: c.status, Status: http.StatusText(c.status), Header: http.Header{}}
+		if c.retryAfter != "" {
+			resp.Header.Set("Retry-After", c.retryAfter)
+		}
+		err := responseError(resp)
+		if c.status < 300 {
+			if err != nil {
+				t.Fatalf("%d no debería ser un error: %s", c.status, err)
+			}
+			continue
+		}
+		retry, after := retryable(err)
+		if retry != c.retry || after != c.after {
+			t.Fatalf("%d: esperaba retry=%v after=%s, obtuve %v %s", c.status, c.retry, c.after, retry, after)
+		}
+	}
+}
+
+func TestLokiClientRetryAfter(t *testing.T) {
+	var calls int32
+	var first, second time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			first = time.Now()
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		second = time.Now()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	cfg := testBatchConfig()
+	cfg.RetryFor = 5 * time.Second
+	c := NewLokiClient(LokiOptions{URL: srv.URL, Job: "test", Timeout: time.Second}, cfg, func(string) {})
+	c.Send(LogRecord{Time: time.Now(), Name: "web", Line: "hola"})
+	c.Close()
+
+	if calls != 2 {
+		t.Fatalf("esperaba 2 envíos, hubo %d", calls)
+	}
+	if second.Sub(first) < time.Second {
+		t.Fatalf("el reintento debería respetar Retry-After, llegó a los %s", second.Sub(first))
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/subosito/gotenv"
+)
+
+var flagStrict bool
+var checkEnvs envFiles
+
+var cmdCheck = &Command{
+	Run:   runCheck,
+	Usage: "check [-f procfile] [-e env] [-c concurrency]",
+	Short: "Validate the Procfile, env files and .mango",
+	Long: `
+Validate the Procfile, the environment files and the .mango file, reporting:
+
+  * Procfile lines that are not a process, an option, a comment or blank
+  * duplicate process names
+  * invalid concurrency values, or concurrency for processes that do not exist
+  * environment files that cannot be parsed
+  * unknown keys in .mango, and values in it that cannot be parsed
+
+The -f, -e and -c options work as for 'mango start'. The command exits with a
+non-zero status if any problem is found, so it can be used in a pre-commit
+hook. 'mango start -strict' runs the same checks before starting.
+
+Examples:
+
+  mango check
+  mango check -f Procfile.test -e .env.test
+`,
+}
+
+func init() {
+	cmdCheck.Flag.StringVar(&flagProcfile, "f", "Procfile", "procfile")
+	cmdCheck.Flag.Var(&checkEnvs, "e", "env")
+	cmdCheck.Flag.StringVar(&flagConcurrency, "c", "", "concurrency")
+}
+
+func readCheckConfig(config Config) error {
+	var errs configErrors
+	errs.parseBool("strict", config["strict"], &flagStrict)
+	return errs.err()
+}
+
+func runCheck(cmd *Command, args []string) {
+	problems := checkSetup(flagProcfile, checkEnvs, flagConcurrency, ".mango", configErr)
+	for _, problem := range problems {
+		Println(problem)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+	Println("ok")
+}
+
+// checkSetup valida el Procfile, la concurrencia, los ficheros de entorno y
+// el fichero de configuración, y devuelve los problemas encontrados.
+// invalid son los valores de configPath que readConfigFile no pudo leer: se
+// reciben ya leídos porque volver a leer el fichero aquí pisaría los flags de
+// la línea de comandos.
+func checkSetup(procfile string, envFiles []string, concurrency, configPath string, invalid error) []string {
+	var problems []string
+
+	pf, err := ReadProcfile(procfile)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("%s: %v", procfile, err))
+	} else {
+		for _, line := range pf.Skipped {
+			problems = append(problems, fmt.Sprintf("%s:%d: unparseable line %q", procfile, line.Number, line.Text))
+		}
+		seen := make(map[string]int)
+		for _, entry := range pf.Entries {
+			if first, ok := seen[entry.Name]; ok {
+				problems = append(problems, fmt.Sprintf("%s:%d: duplicate process %q (first defined on line %d)", procfile, entry.Line, entry.Name, first))
+				continue
+			}
+			seen[entry.Name] = entry.Line
+		}
+	}
+
+	counts, err := parseConcurrency(concurrency)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("concurrency: %v", err))
+	}
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if counts[name] < 0 {
+			problems = append(problems, fmt.Sprintf("concurrency: invalid count for %s: %d", name, counts[name]))
+		}
+		if name != "all" && pf != nil && !pf.HasProcess(name) {
+			problems = append(problems, fmt.Sprintf("concurrency: no such process: %s", name))
+		}
+	}
+
+	files := envFiles
+	if len(files) == 0 {
+		files = []string{".env"}
+	}
+	for _, file := range files {
+		if err := checkEnvFile(file); err != nil {
+			if os.IsNotExist(err) && len(envFiles) == 0 {
+				continue
+			}
+			problems = append(problems, fmt.Sprintf("%s: %v", file, err))
+		}
+	}
+
+	config, err := ReadConfig(configPath)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("%s: %v", configPath, err))
+	} else if errs, ok := invalid.(configErrors); ok {
+		var values []string
+		for _, err := range errs {
+			values = append(values, fmt.Sprintf("%s: invalid value for %v", configPath, err))
+		}
+		sort.Strings(values)
+		problems = append(problems, values...)
+	}
+	known := make(map[string]bool, len(configKeys))
+	for _, key := range configKeys {
+		known[key] = true
+	}
+	var unknown []string
+	for key := range config {
+		if !known[key] && !hasConfigKeyPrefix(key) {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		problems = append(problems, fmt.Sprintf("%s: unknown key %q", configPath, key))
+	}
+
+	return problems
+}
+
+func checkEnvFile(filename string) error {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	_, err = gotenv.StrictParse(fd)
+	return err
+}
+
+// hasConfigKeyPrefix dice si key es una de las claves con nombre de proceso,
+// como loki.regex.web.
+func hasConfigKeyPrefix(key string) bool {
+	for _, prefix := range configKeyPrefixes {
+		if strings.HasPrefix(key, prefix) && len(key) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
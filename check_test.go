@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckSetup(t *testing.T) {
+	dir := t.TempDir()
+	procfile := filepath.Join(dir, "Procfile")
+	envFile := filepath.Join(dir, ".env")
+	config := filepath.Join(dir, ".mango")
+	os.WriteFile(procfile, []byte("web: bin/web\n\n# comentario\nweb bin/web\nworker: bin/worker\nweb: bin/other\n"), 0644)
+	os.WriteFile(envFile, []byte("FOO=\"sin cerrar\n"), 0644)
+	os.WriteFile(config, []byte("port=5000\nrestart.max=tres\nlog.compress=quizá\nloki.regex.web='^(?P<level>\\w+)'\nbogus=1\n"), 0644)
+	defer delete(lokiRegexRules, "web")
+
+	var pf, concurrency string
+	var port, grace int
+	invalid := readConfigFile(config, &pf, &port, &concurrency, &grace, &flagLokiURL, &flagLokiJob)
+	problems := checkSetup(procfile, []string{envFile}, "web=2,db=1", config, invalid)
+	want := []string{
+		procfile + `:4: unparseable line "web bin/web"`,
+		procfile + `:6: duplicate process "web" (first defined on line 1)`,
+		"concurrency: no such process: db",
+		envFile + ": ",
+		config + `: invalid value for log.compress: `,
+		config + `: invalid value for restart.max: `,
+		config + `: unknown key "bogus"`,
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("esperaba %d problemas, obtuve %d: %q", len(want), len(problems), problems)
+	}
+	for i := range want {
+		if !strings.HasPrefix(problems[i], want[i]) {
+			t.Fatalf("problema %d: esperaba %q, obtuve %q", i, want[i], problems[i])
+		}
+	}
+}
+
+func TestCheckSetupClean(t *testing.T) {
+	dir := t.TempDir()
+	procfile := filepath.Join(dir, "Procfile")
+	os.WriteFile(procfile, []byte("# mango: restart=once\nweb: bin/web\nworker: bin/worker\n"), 0644)
+
+	// Sin -e, un .env inexistente no es un problema; uno pedido explícitamente sí.
+	if problems := checkSetup(procfile, nil, "all=2,worker=0", filepath.Join(dir, ".mango"), nil); len(problems) != 0 {
+		t.Fatalf("no esperaba problemas, obtuve %q", problems)
+	}
+	if problems := checkSetup(procfile, []string{filepath.Join(dir, "missing.env")}, "", filepath.Join(dir, ".mango"), nil); len(problems) != 1 {
+		t.Fatalf("esperaba 1 problema, obtuve %q", problems)
+	}
+}
+
+// Con -strict, validar .mango no debe pisar los flags de la línea de comandos.
+func TestCheckSetupKeepsFlags(t *testing.T) {
+	dir := t.TempDir()
+	procfile := filepath.Join(dir, "Procfile")
+	config := filepath.Join(dir, ".mango")
+	os.WriteFile(procfile, []byte("web: bin/web\n"), 0644)
+	os.WriteFile(config, []byte("output=json\n"), 0644)
+	defer func(output string, strict bool) { flagOutput, flagStrict = output, strict }(flagOutput, flagStrict)
+
+	var pf, concurrency string
+	var port, grace int
+	invalid := readConfigFile(config, &pf, &port, &concurrency, &grace, &flagLokiURL, &flagLokiJob)
+	if err := cmdStart.Flag.Parse([]string{"-strict", "-output", "text"}); err != nil {
+		t.Fatal(err)
+	}
+	if problems := checkSetup(procfile, nil, "", config, invalid); len(problems) != 0 {
+		t.Fatalf("no esperaba problemas, obtuve %q", problems)
+	}
+	if flagOutput != "text" {
+		t.Fatalf("output = %q tras validar, se esperaba el valor de la línea de comandos", flagOutput)
+	}
+}
@@ -1,13 +1,129 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/subosito/gotenv"
 )
 
 type Config map[string]string
 
+// configKeys son las claves que entiende .mango.
+var configKeys = []string{
+	"procfile",
+	"port",
+	"concurrency",
+	"shutdown_grace_time",
+	"strict",
+	"output",
+	"color",
+	"timestamp",
+	"timestamp.format",
+	"timestamp.utc",
+	"timestamp.elapsed",
+	"prefix",
+	"log.dir",
+	"log.combined",
+	"log.max_size",
+	"log.max_age",
+	"log.max_files",
+	"log.compress",
+	"control_socket",
+	"restart.backoff",
+	"restart.backoff_max",
+	"restart.backoff_multiplier",
+	"restart.max",
+	"restart.window",
+	"loki.url",
+	"loki.job",
+	"loki.batch_size",
+	"loki.batch_wait",
+	"loki.queue_size",
+	"loki.drop",
+	"loki.backoff",
+	"loki.backoff_max",
+	"loki.retry_timeout",
+	"loki.spool_dir",
+	"loki.spool_max_size",
+	"loki.tenant",
+	"loki.username",
+	"loki.password",
+	"loki.bearer_token",
+	"loki.bearer_token_file",
+	"loki.ca_file",
+	"loki.cert_file",
+	"loki.key_file",
+	"loki.insecure_skip_verify",
+	"loki.labels",
+	"loki.dynamic_labels",
+	"loki.format",
+	"loki.parse",
+	"loki.level_field",
+	"loki.time_field",
+	"loki.time_format",
+	"loki.use_timestamp",
+	"loki.level_as",
+	"otlp.endpoint",
+	"otlp.protocol",
+	"otlp.headers",
+	"otlp.service_name",
+	"otlp.batch_size",
+	"otlp.batch_wait",
+	"otlp.queue_size",
+	"otlp.retry_timeout",
+	"otlp.ca_file",
+	"otlp.cert_file",
+	"otlp.key_file",
+	"otlp.insecure_skip_verify",
+	"syslog.address",
+	"syslog.format",
+	"syslog.facility",
+	"syslog.hostname",
+	"syslog.ca_file",
+	"syslog.cert_file",
+	"syslog.key_file",
+	"syslog.insecure_skip_verify",
+	"webhook.url",
+	"webhook.headers",
+	"webhook.template",
+	"webhook.template_file",
+	"webhook.content_type",
+	"webhook.batch_size",
+	"webhook.batch_wait",
+	"webhook.queue_size",
+	"webhook.retry_timeout",
+	"elasticsearch.url",
+	"elasticsearch.index",
+	"elasticsearch.username",
+	"elasticsearch.password",
+	"elasticsearch.api_key",
+	"elasticsearch.ca_file",
+	"elasticsearch.insecure_skip_verify",
+	"elasticsearch.batch_size",
+	"elasticsearch.batch_wait",
+	"elasticsearch.queue_size",
+	"elasticsearch.retry_timeout",
+	"forward.address",
+	"forward.tag",
+	"forward.require_ack",
+	"forward.ack_timeout",
+	"forward.batch_size",
+	"forward.batch_wait",
+	"forward.queue_size",
+	"forward.retry_timeout",
+	"metrics.address",
+}
+
+// configKeyPrefixes son los prefijos de las claves de .mango que llevan un
+// nombre de proceso, como loki.regex.web.
+var configKeyPrefixes = []string{
+	lokiRegexPrefix,
+}
+
 func ReadConfig(filename string) (Config, error) {
 	if _, err := os.Stat(filename); os.IsNotExist(err) {
 		return make(Config), nil
@@ -23,3 +139,88 @@ func ReadConfig(filename string) (Config, error) {
 	}
 	return config, nil
 }
+
+// configErrors junta los valores de .mango que no se pueden interpretar, cada
+// uno con su clave, para informar de todos a la vez.
+type configErrors []error
+
+func (e configErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// err devuelve los errores juntados, o nil si no hay ninguno.
+func (e configErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// add anota err, si lo hay, como error del valor de key.
+func (e *configErrors) add(key string, err error) {
+	if err != nil {
+		*e = append(*e, fmt.Errorf("%s: %v", key, err))
+	}
+}
+
+// merge anota los errores que devuelve otro lector de la configuración.
+func (e *configErrors) merge(err error) {
+	switch err := err.(type) {
+	case nil:
+	case configErrors:
+		*e = append(*e, err...)
+	default:
+		*e = append(*e, err)
+	}
+}
+
+// parseBool, parseInt, parseFloat y parseDuration guardan en dst el valor
+// de key si no está vacío; si no se puede interpretar, lo anotan y dejan dst
+// como estaba.
+func (e *configErrors) parseBool(key, value string, dst *bool) {
+	if value == "" {
+		return
+	}
+	v, err := strconv.ParseBool(value)
+	if err == nil {
+		*dst = v
+	}
+	e.add(key, err)
+}
+
+func (e *configErrors) parseInt(key, value string, dst *int) {
+	if value == "" {
+		return
+	}
+	v, err := strconv.Atoi(value)
+	if err == nil {
+		*dst = v
+	}
+	e.add(key, err)
+}
+
+func (e *configErrors) parseFloat(key, value string, dst *float64) {
+	if value == "" {
+		return
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err == nil {
+		*dst = v
+	}
+	e.add(key, err)
+}
+
+func (e *configErrors) parseDuration(key, value string, dst *time.Duration) {
+	if value == "" {
+		return
+	}
+	v, err := time.ParseDuration(value)
+	if err == nil {
+		*dst = v
+	}
+	e.add(key, err)
+}
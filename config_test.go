@@ -1,6 +1,10 @@
 package main
 
-import "testing"
+import (
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestReadOptionFile(t *testing.T) {
 	config_file := "./fixtures/options/.mango"
@@ -9,3 +13,25 @@ func TestReadOptionFile(t *testing.T) {
 		t.Fatalf("Could not read config file: %s", err)
 	}
 }
+
+func TestConfigErrors(t *testing.T) {
+	n, d := 7, time.Second
+	var errs configErrors
+	errs.parseInt("a.size", "", &n)
+	errs.parseInt("a.size", "x", &n)
+	errs.parseDuration("a.wait", "soon", &d)
+	errs.merge(nil)
+	if n != 7 || d != time.Second {
+		t.Errorf("un valor no válido no debería cambiar el destino: %d, %s", n, d)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("esperaba 2 errores, obtuve %q", errs)
+	}
+	msg := errs.err().Error()
+	if !strings.HasPrefix(msg, "a.size: ") || !strings.Contains(msg, "; a.wait: ") {
+		t.Errorf("mensaje inesperado: %q", msg)
+	}
+	if (configErrors{}).err() != nil {
+		t.Error("sin errores err() debería devolver nil")
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultControlSocket = ".mango.sock"
+
+var flagControlSocket string
+
+var cmdRestart = &Command{
+	Run:   runControlAction(requestRestart),
+	Usage: "restart <name> [-s socket]",
+	Short: "Restart a running process",
+	Long: `
+Restart one instance (e.g. web.2) or every instance of a process (e.g. web)
+of a running 'mango start'.
+
+  -s socket    Control socket of the running mango. Defaults to the value of
+               control_socket in .mango, or '.mango.sock'.
+
+Examples:
+
+  mango restart web.2
+  mango restart worker
+`,
+}
+
+var cmdStop = &Command{
+	Run:   runControlAction(requestStop),
+	Usage: "stop <name> [-s socket]",
+	Short: "Stop a running process",
+	Long: `
+Stop one instance (e.g. web.2) or every instance of a process (e.g. worker) of
+a running 'mango start', without stopping the rest. Stopped processes can be
+started again with 'mango start-proc'.
+
+  -s socket    Control socket of the running mango. Defaults to the value of
+               control_socket in .mango, or '.mango.sock'.
+
+Examples:
+
+  mango stop worker
+`,
+}
+
+var cmdStartProc = &Command{
+	Run:   runControlAction(requestStart),
+	Usage: "start-proc <name> [-s socket]",
+	Short: "Start a stopped process",
+	Long: `
+Start again one instance (e.g. web.2) or every instance of a process (e.g.
+worker) that was stopped with 'mango stop' or has completed.
+
+  -s socket    Control socket of the running mango. Defaults to the value of
+               control_socket in .mango, or '.mango.sock'.
+
+Examples:
+
+  mango start-proc worker
+`,
+}
+
+func init() {
+	for _, cmd := range []*Command{cmdRestart, cmdStop, cmdStartProc} {
+		cmd.Flag.StringVar(&flagControlSocket, "s", defaultControlSocket, "control socket")
+	}
+}
+
+func readControlConfig(config Config) error {
+	if config["control_socket"] != "" {
+		flagControlSocket = config["control_socket"]
+	}
+	return nil
+}
+
+type controlRequest struct {
+	Command string `json:"command"`
+	Target  string `json:"target,omitempty"`
+}
+
+type controlResponse struct {
+	Error     string           `json:"error,omitempty"`
+	Message   string           `json:"message,omitempty"`
+	Instances []instanceStatus `json:"instances,omitempty"`
+}
+
+// runControlAction devuelve el Run de un comando que aplica command a las
+// instancias nombradas en el primer argumento.
+func runControlAction(command string) func(cmd *Command, args []string) {
+	return func(cmd *Command, args []string) {
+		if len(args) != 1 {
+			cmd.printUsage()
+			os.Exit(1)
+		}
+		resp, err := controlCall(controlRequest{Command: command, Target: args[0]})
+		handleError(err)
+		if resp.Message != "" {
+			Println(resp.Message)
+		}
+		if resp.Error != "" {
+			handleError(fmt.Errorf("%s", resp.Error))
+		}
+	}
+}
+
+// controlCall envía req al mango que escucha en el socket de control.
+func controlCall(req controlRequest) (controlResponse, error) {
+	var resp controlResponse
+	conn, err := net.DialTimeout("unix", flagControlSocket, 2*time.Second)
+	if err != nil {
+		return resp, fmt.Errorf("could not reach mango at %s: %v", flagControlSocket, err)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return resp, err
+	}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return resp, fmt.Errorf("reading control response: %v", err)
+	}
+	return resp, nil
+}
+
+// listenControl abre el socket de control en path, borrando antes el de una
+// ejecución anterior que ya no responde.
+func listenControl(path string) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s is in use; is another mango running?", path)
+	}
+	os.Remove(path)
+	return net.Listen("unix", path)
+}
+
+func (f *mango) serveControl(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var req controlRequest
+			if err := json.NewDecoder(conn).Decode(&req); err != nil {
+				json.NewEncoder(conn).Encode(controlResponse{Error: err.Error()})
+				return
+			}
+			json.NewEncoder(conn).Encode(f.handleControl(req))
+		}()
+	}
+}
+
+func (f *mango) handleControl(req controlRequest) controlResponse {
+	select {
+	case <-f.teardown.Barrier():
+		return controlResponse{Error: "mango is shutting down"}
+	default:
+	}
+
+	switch req.Command {
+	case "ps":
+		return controlResponse{Instances: f.statuses()}
+	case "scale":
+		return f.handleScale(req.Target)
+	}
+
+	instances, err := f.findInstances(req.Target)
+	if err != nil {
+		return controlResponse{Error: err.Error()}
+	}
+
+	var done, errs []string
+	for _, inst := range instances {
+		var err error
+		switch req.Command {
+		case requestStop, requestRestart:
+			err = f.stopInstance(inst, req.Command)
+		case requestStart:
+			err = f.resumeInstance(inst)
+		default:
+			return controlResponse{Error: fmt.Sprintf("unknown command %q", req.Command)}
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			done = append(done, inst.Name)
+		}
+	}
+
+	var resp controlResponse
+	if len(done) > 0 {
+		f.outletFactory.SystemOutput(fmt.Sprintf("control: %s %s", req.Command, strings.Join(done, ", ")))
+		resp.Message = fmt.Sprintf("%s: %s", req.Command, strings.Join(done, ", "))
+	}
+	resp.Error = strings.Join(errs, "; ")
+	return resp
+}
+
+// statuses devuelve el estado de todas las instancias en el orden del
+// Procfile.
+func (f *mango) statuses() []instanceStatus {
+	var statuses []instanceStatus
+	for _, entry := range f.procfile.Entries {
+		for _, inst := range f.states[entry.Name].snapshot() {
+			statuses = append(statuses, inst.status())
+		}
+	}
+	return statuses
+}
+
+// findInstances resuelve target: el nombre de una entrada ("web") nombra
+// todas sus instancias, y "web.2" sólo la segunda.
+func (f *mango) findInstances(target string) ([]*instance, error) {
+	if target == "" {
+		return nil, fmt.Errorf("missing process name")
+	}
+	if st, ok := f.states[target]; ok {
+		instances := st.snapshot()
+		if len(instances) == 0 {
+			return nil, fmt.Errorf("%s has no instances", target)
+		}
+		return instances, nil
+	}
+	if i := strings.LastIndex(target, "."); i > 0 {
+		if st, ok := f.states[target[:i]]; ok {
+			if n, err := strconv.Atoi(target[i+1:]); err == nil {
+				for _, inst := range st.snapshot() {
+					if inst.Num == n-1 {
+						return []*instance{inst}, nil
+					}
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("no such process: %s", target)
+}
+
+// stopInstance detiene la instancia a petición de un usuario; con
+// requestRestart la vuelve a arrancar en cuanto termina, y con requestRemove
+// la quita.
+func (f *mango) stopInstance(inst *instance, request string) error {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+
+	switch inst.state {
+	case stateRunning:
+		inst.request = request
+		inst.state = stateStopping
+		go f.terminate(inst.Name, inst.ps, inst.finished)
+	case stateBackoff:
+		inst.notify(request)
+	case stateStopped, stateCompleted:
+		switch request {
+		case requestStop:
+			return fmt.Errorf("%s is already %s", inst.Name, inst.state)
+		case requestRestart:
+			inst.notify(requestStart)
+		default:
+			inst.notify(request)
+		}
+	case stateStopping:
+		if request != requestRemove {
+			return fmt.Errorf("%s is %s", inst.Name, inst.state)
+		}
+		inst.request = request
+	default:
+		return fmt.Errorf("%s is %s", inst.Name, inst.state)
+	}
+	return nil
+}
+
+// resumeInstance vuelve a arrancar una instancia detenida o completada.
+func (f *mango) resumeInstance(inst *instance) error {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+
+	switch inst.state {
+	case stateStopped, stateCompleted, stateBackoff:
+		inst.notify(requestStart)
+		return nil
+	}
+	return fmt.Errorf("%s is already %s", inst.Name, inst.state)
+}
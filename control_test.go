@@ -0,0 +1,168 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFindInstances(t *testing.T) {
+	web := ProcfileEntry{Name: "web", Command: "bin/web"}
+	f := &mango{states: map[string]*procState{"web": newProcState(2), "worker": newProcState(0)}}
+	for i := 0; i < 3; i++ {
+		f.states["web"].add(newInstance(0, i, web))
+	}
+
+	// Las dos primeras instancias se muestran como web, pero web.2 nombra
+	// sólo la segunda.
+	cases := map[string][]string{
+		"web":   {"web", "web", "web.3"},
+		"web.1": {"web"},
+		"web.2": {"web"},
+		"web.3": {"web.3"},
+	}
+	for target, want := range cases {
+		instances, err := f.findInstances(target)
+		if err != nil {
+			t.Fatalf("findInstances(%q) no debería fallar: %s", target, err)
+		}
+		if len(instances) != len(want) {
+			t.Fatalf("findInstances(%q): esperaba %d instancias, obtuve %d", target, len(want), len(instances))
+		}
+		for i, inst := range instances {
+			if inst.Name != want[i] {
+				t.Fatalf("findInstances(%q): esperaba %q, obtuve %q", target, want[i], inst.Name)
+			}
+		}
+	}
+	if instances, _ := f.findInstances("web.2"); len(instances) != 1 || instances[0].Num != 1 {
+		t.Fatal("findInstances(\"web.2\") debería devolver la segunda instancia")
+	}
+
+	for _, target := range []string{"", "web.4", "db", "worker"} {
+		if _, err := f.findInstances(target); err == nil {
+			t.Fatalf("esperaba error para %q, pero no lo hubo", target)
+		}
+	}
+}
+
+func TestStopInstanceStates(t *testing.T) {
+	f := &mango{}
+	inst := newInstance(0, 0, ProcfileEntry{Name: "worker"})
+
+	inst.setState(stateStopped)
+	if err := f.stopInstance(inst, requestStop); err == nil {
+		t.Fatal("detener una instancia ya detenida debería fallar")
+	}
+	if err := f.resumeInstance(inst); err != nil {
+		t.Fatalf("arrancar una instancia detenida no debería fallar: %s", err)
+	}
+	if got := inst.takeRequest(); got != requestStart {
+		t.Fatalf("esperaba la petición %q, obtuve %q", requestStart, got)
+	}
+
+	inst.setState(stateRunning)
+	if err := f.resumeInstance(inst); err == nil {
+		t.Fatal("arrancar una instancia en marcha debería fallar")
+	}
+}
+
+// TestInstanceStatusNumber comprueba que ps distingue las instancias que
+// comparten nombre por el número que usan los comandos de control.
+func TestInstanceStatusNumber(t *testing.T) {
+	web := ProcfileEntry{Name: "web"}
+	for num, want := range []instanceStatus{{Name: "web", Instance: 1}, {Name: "web", Instance: 2}, {Name: "web.3", Instance: 3}} {
+		status := newInstance(0, num, web).status()
+		if status.Name != want.Name || status.Instance != want.Instance {
+			t.Errorf("instancia %d: %q número %d, se esperaba %q número %d", num, status.Name, status.Instance, want.Name, want.Instance)
+		}
+	}
+}
+
+func TestHandleScaleValidation(t *testing.T) {
+	f := &mango{states: map[string]*procState{"web": newProcState(1)}}
+	for _, target := range []string{"db=2", "web", "web=x"} {
+		if resp := f.handleScale(target); resp.Error == "" {
+			t.Fatalf("esperaba error para %q, pero no lo hubo", target)
+		}
+	}
+}
+
+func TestScaleDownKeepsUnstoppedInstances(t *testing.T) {
+	web := ProcfileEntry{Name: "web"}
+	f := &mango{states: map[string]*procState{"web": newProcState(3)}}
+	for i, state := range []string{stateStopped, stateStarting, stateStopped} {
+		inst := newInstance(0, i, web)
+		inst.setState(state)
+		f.states["web"].add(inst)
+	}
+
+	if err := f.scale("web", 0); err == nil {
+		t.Fatal("reducir con una instancia arrancando debería fallar")
+	}
+	list := f.states["web"].snapshot()
+	if len(list) != 2 || list[1].Num != 1 {
+		t.Fatalf("esperaba que quedaran las dos primeras instancias, quedan %d", len(list))
+	}
+	if got := list[1].takeRequest(); got != "" {
+		t.Fatalf("la instancia que arranca no debería tener petición, tiene %q", got)
+	}
+}
+
+// TestScaleToZeroFinishes comprueba que las instancias que quita scale dejan
+// de contar como vivas, para que mango termine cuando no queda ninguna.
+func TestScaleToZeroFinishes(t *testing.T) {
+	// La instancia se quita mientras espera para reiniciarse.
+	proc := ProcfileEntry{Name: "web", Command: "exit 1", Restart: RestartAlways}
+	f := &mango{
+		outletFactory: NewOutletFactory(),
+		sinks:         &LogDispatcher{},
+		procfile:      &Procfile{Entries: []ProcfileEntry{proc}},
+		states:        map[string]*procState{proc.Name: newProcState(1)},
+		env:           Env{},
+	}
+	f.startProcess(0, 0, proc, f.env, f.outletFactory)
+	defer func() {
+		f.teardown.Fall()
+		f.wg.Wait()
+	}()
+
+	inst := f.states[proc.Name].snapshot()[0]
+	deadline := time.Now().Add(5 * time.Second)
+	for inst.status().State != stateBackoff {
+		if time.Now().After(deadline) {
+			t.Fatalf("la instancia sigue %s; se esperaba que esperara para reiniciarse", inst.status().State)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := f.scale("web", 0); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-f.teardown.Barrier():
+	case <-time.After(5 * time.Second):
+		t.Fatal("sin instancias, mango debería haber terminado")
+	}
+}
+
+func TestInstanceReadyIgnoresScaledInstances(t *testing.T) {
+	st := newProcState(2)
+	fallen := func() bool {
+		select {
+		case <-st.ready.Barrier():
+			return true
+		default:
+			return false
+		}
+	}
+	// web.3 la añadió scale, y la 0 avisa dos veces.
+	st.instanceReady(2)
+	st.instanceReady(0)
+	st.instanceReady(0)
+	if fallen() {
+		t.Fatal("ready no debería caer hasta que estén listas las instancias iniciales")
+	}
+	st.instanceReady(1)
+	if !fallen() {
+		t.Fatal("ready debería caer con las instancias iniciales listas")
+	}
+}
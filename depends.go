@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultReadyTimeout = 60 * time.Second
+const readyPollInterval = 250 * time.Millisecond
+
+// ReadyCheck describe cómo saber que una instancia está lista para que
+// arranquen las entradas que dependen de ella.
+type ReadyCheck struct {
+	Kind   string // "port", "log" o "cmd"
+	Target string
+
+	pattern *regexp.Regexp
+}
+
+// parseReadyCheck interpreta el valor de la opción ready: "port" (el PORT de
+// la instancia), "port:5432", "log:<regexp>" o "cmd:<comando>".
+func parseReadyCheck(value string) (*ReadyCheck, error) {
+	check := &ReadyCheck{Kind: value}
+	if i := strings.Index(value, ":"); i >= 0 {
+		check.Kind, check.Target = value[:i], strings.TrimSpace(value[i+1:])
+	}
+	switch check.Kind {
+	case "port":
+		if check.Target != "" {
+			if _, err := strconv.Atoi(check.Target); err != nil {
+				return nil, fmt.Errorf("invalid ready port %q", check.Target)
+			}
+		}
+	case "log":
+		if check.Target == "" {
+			return nil, fmt.Errorf("ready=log needs a pattern")
+		}
+		pattern, err := regexp.Compile(check.Target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ready pattern: %v", err)
+		}
+		check.pattern = pattern
+	case "cmd":
+		if check.Target == "" {
+			return nil, fmt.Errorf("ready=cmd needs a command")
+		}
+	default:
+		return nil, fmt.Errorf("invalid ready check %q (expected port, log:<pattern> or cmd:<command>)", value)
+	}
+	return check, nil
+}
+
+// checkDependencies verifica que cada depends_on nombre una entrada existente
+// y que no haya ciclos.
+func (pf *Procfile) checkDependencies() error {
+	byName := make(map[string]ProcfileEntry, len(pf.Entries))
+	for _, entry := range pf.Entries {
+		byName[entry.Name] = entry
+	}
+	for _, entry := range pf.Entries {
+		for _, dep := range entry.DependsOn {
+			if _, ok := byName[dep]; !ok {
+				return fmt.Errorf("%s depends on unknown process %q", entry.Name, dep)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(pf.Entries))
+	var path []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			for i, n := range path {
+				if n == name {
+					cycle := append(append([]string{}, path[i:]...), name)
+					return fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+				}
+			}
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		path = append(path, name)
+		for _, dep := range byName[name].DependsOn {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+		return nil
+	}
+	for _, entry := range pf.Entries {
+		if err := visit(entry.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartOrder devuelve los índices de las entradas en orden topológico: cada
+// entrada aparece después de sus dependencias y, a igualdad, en el orden del
+// Procfile.
+func (pf *Procfile) StartOrder() []int {
+	placed := make(map[string]bool, len(pf.Entries))
+	order := make([]int, 0, len(pf.Entries))
+	for len(order) < len(pf.Entries) {
+		progress := false
+		for idx, entry := range pf.Entries {
+			if placed[entry.Name] {
+				continue
+			}
+			ready := true
+			for _, dep := range entry.DependsOn {
+				if !placed[dep] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				placed[entry.Name] = true
+				order = append(order, idx)
+				progress = true
+			}
+		}
+		if !progress {
+			// Sólo ocurre con ciclos, que parseProcfile ya rechaza.
+			break
+		}
+	}
+	return order
+}
+
+// Dependents devuelve, para cada entrada, las entradas que dependen de ella.
+func (pf *Procfile) Dependents() map[string][]string {
+	dependents := make(map[string][]string)
+	for _, entry := range pf.Entries {
+		for _, dep := range entry.DependsOn {
+			dependents[dep] = append(dependents[dep], entry.Name)
+		}
+	}
+	return dependents
+}
+
+// procState sigue a todas las instancias de una entrada para resolver el
+// orden de arranque y de parada.
+type procState struct {
+	idx       int
+	proc      ProcfileEntry
+	instances int
+
+	// ready cae cuando todas las instancias iniciales han pasado su
+	// chequeo. notReady son los números de las que aún no lo han hecho; las
+	// que añade scale por encima de instances no cuentan.
+	ready    Barrier
+	mu       sync.Mutex
+	notReady map[int]bool
+
+	// running cuenta las instancias (y su lanzador) que siguen vivas.
+	running sync.WaitGroup
+
+	// list son las instancias creadas, en orden.
+	list []*instance
+}
+
+func newProcState(instances int) *procState {
+	st := &procState{instances: instances, notReady: make(map[int]bool, instances)}
+	for i := 0; i < instances; i++ {
+		st.notReady[i] = true
+	}
+	if instances == 0 {
+		st.ready.Fall()
+	}
+	return st
+}
+
+func (st *procState) add(inst *instance) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.list = append(st.list, inst)
+}
+
+// snapshot devuelve una copia de las instancias creadas.
+func (st *procState) snapshot() []*instance {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return append([]*instance(nil), st.list...)
+}
+
+// instanceReady anota que la instancia procNum está lista. Una instancia
+// que scale vuelve a crear con el número de otra inicial la sustituye.
+func (st *procState) instanceReady(procNum int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.notReady[procNum] {
+		return
+	}
+	delete(st.notReady, procNum)
+	if len(st.notReady) == 0 {
+		st.ready.Fall()
+	}
+}
+
+// lineMatcher es un io.Writer que busca pattern en cada línea escrita.
+type lineMatcher struct {
+	pattern *regexp.Regexp
+	matched Barrier
+
+	mu     sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (m *lineMatcher) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.buffer.Write(p)
+	for {
+		line, err := m.buffer.ReadBytes('\n')
+		if err != nil {
+			// Línea incompleta: se conserva para la próxima escritura.
+			m.buffer.Reset()
+			m.buffer.Write(line)
+			break
+		}
+		if m.pattern.Match(line) {
+			m.matched.Fall()
+		}
+	}
+	return len(p), nil
+}
+
+// runProbe ejecuta el chequeo cmd y espera a que termine. CommandContext
+// solo mata al shell, así que si ctx termina antes se mata a todo su grupo.
+func runProbe(ctx context.Context, workDir, command string, env Env) error {
+	ps := NewProcessContext(ctx, workDir, command, env, false)
+	if err := ps.Start(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ps.Signal(syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+	return ps.Wait()
+}
+
+// readyTimeout es lo que puede tardar proc en estar listo.
+func readyTimeout(proc ProcfileEntry) time.Duration {
+	if proc.ReadyTimeout > 0 {
+		return proc.ReadyTimeout
+	}
+	return defaultReadyTimeout
+}
+
+// waitReady bloquea hasta que la instancia pasa su chequeo (true), o hasta
+// que termina o se agota timeout sin conseguirlo (false). Un chequeo cmd que
+// sigue en marcha al agotarse timeout, o al terminar la instancia, se mata.
+func waitReady(check *ReadyCheck, timeout time.Duration, port int, workDir string, env Env, matcher *lineMatcher, finished <-chan struct{}) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-finished:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if check.Kind == "log" {
+		select {
+		case <-matcher.matched.Barrier():
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	target := port
+	if check.Kind == "port" && check.Target != "" {
+		target, _ = strconv.Atoi(check.Target)
+	}
+
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+	for {
+		switch check.Kind {
+		case "port":
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort("localhost", strconv.Itoa(target)), readyPollInterval)
+			if err == nil {
+				conn.Close()
+				return true
+			}
+		case "cmd":
+			if runProbe(ctx, workDir, check.Target, env) == nil {
+				return true
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
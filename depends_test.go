@@ -0,0 +1,27 @@
+//go:build darwin || freebsd || linux || netbsd || openbsd
+// +build darwin freebsd linux netbsd openbsd
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWaitReadyCmdTimeout(t *testing.T) {
+	check := &ReadyCheck{Kind: "cmd", Target: "sleep 10"}
+	start := time.Now()
+	if waitReady(check, 200*time.Millisecond, 0, t.TempDir(), Env{}, nil, make(chan struct{})) {
+		t.Fatal("waitReady = true con un chequeo que no termina")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("waitReady tardó %v, se esperaba que respetara el timeout", elapsed)
+	}
+}
+
+func TestWaitReadyCmd(t *testing.T) {
+	check := &ReadyCheck{Kind: "cmd", Target: "true"}
+	if !waitReady(check, time.Second, 0, t.TempDir(), Env{}, nil, make(chan struct{})) {
+		t.Fatal("waitReady = false con un chequeo que pasa")
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultElasticsearchIndex = "mango-%Y.%m.%d"
+
+var flagElasticsearchURL string
+var flagElasticsearchIndex string
+var flagElasticsearchUsername string
+var flagElasticsearchPassword string
+var flagElasticsearchAPIKey string
+var flagElasticsearchCAFile string
+var flagElasticsearchInsecureSkipVerify bool
+var flagElasticsearchBatchSize int
+var flagElasticsearchBatchWait time.Duration
+var flagElasticsearchQueueSize int
+var flagElasticsearchRetryFor time.Duration
+
+// elasticsearchAuthSettings son, como lokiAuthSettings, los ajustes que
+// pueden darse también en variables de entorno.
+var elasticsearchAuthSettings = map[string]*string{
+	"elasticsearch.username": &flagElasticsearchUsername,
+	"elasticsearch.password": &flagElasticsearchPassword,
+	"elasticsearch.api_key":  &flagElasticsearchAPIKey,
+	"elasticsearch.ca_file":  &flagElasticsearchCAFile,
+}
+
+func readElasticsearchConfig(config Config) error {
+	var errs configErrors
+	for key, value := range map[string]*string{
+		"elasticsearch.url":   &flagElasticsearchURL,
+		"elasticsearch.index": &flagElasticsearchIndex,
+	} {
+		if config[key] != "" {
+			*value = config[key]
+		}
+	}
+	for key, value := range elasticsearchAuthSettings {
+		if env := os.Getenv(settingEnv(key)); env != "" {
+			*value = env
+		} else if config[key] != "" {
+			*value = config[key]
+		}
+	}
+	errs.parseBool("elasticsearch.insecure_skip_verify", config["elasticsearch.insecure_skip_verify"], &flagElasticsearchInsecureSkipVerify)
+	for key, value := range map[string]*int{
+		"elasticsearch.batch_size": &flagElasticsearchBatchSize,
+		"elasticsearch.queue_size": &flagElasticsearchQueueSize,
+	} {
+		errs.parseInt(key, config[key], value)
+	}
+	for key, value := range map[string]*time.Duration{
+		"elasticsearch.batch_wait":    &flagElasticsearchBatchWait,
+		"elasticsearch.retry_timeout": &flagElasticsearchRetryFor,
+	} {
+		errs.parseDuration(key, config[key], value)
+	}
+	return errs.err()
+}
+
+// formatIndex expande en pattern la fecha t, en UTC: %Y, %y, %m, %d, %H y
+// %j, y %% para un %. Lo demás se deja como está.
+func formatIndex(pattern string, t time.Time) string {
+	t = t.UTC()
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' || i+1 == len(pattern) {
+			b.WriteByte(pattern[i])
+			continue
+		}
+		i++
+		switch pattern[i] {
+		case 'Y':
+			b.WriteString(t.Format("2006"))
+		case 'y':
+			b.WriteString(t.Format("06"))
+		case 'm':
+			b.WriteString(t.Format("01"))
+		case 'd':
+			b.WriteString(t.Format("02"))
+		case 'H':
+			b.WriteString(t.Format("15"))
+		case 'j':
+			b.WriteString(t.Format("002"))
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(pattern[i])
+		}
+	}
+	return b.String()
+}
+
+// ElasticsearchOptions dice a qué clúster e índices enviar los logs.
+type ElasticsearchOptions struct {
+	// URL es la del clúster, como http://localhost:9200.
+	URL      string
+	Index    string // patrón del índice, como mango-%Y.%m.%d
+	Username string
+	Password string
+	APIKey   string
+	Timeout  time.Duration
+	TLS      *tls.Config
+	Host     string
+}
+
+// ElasticsearchClient indexa los registros con la API _bulk, que también
+// entiende OpenSearch, en lotes y con los mismos reintentos que LokiClient.
+// Los documentos que el clúster rechaza por estar saturado (429) se
+// reintentan solos, con el mismo backoff; los demás rechazos se descartan y
+// se informa de ellos.
+type ElasticsearchClient struct {
+	opts       ElasticsearchOptions
+	httpClient *http.Client
+	batcher    *batcher
+	logf       func(msg string)
+}
+
+func NewElasticsearchClient(opts ElasticsearchOptions, cfg batchConfig, logf func(msg string)) *ElasticsearchClient {
+	c := &ElasticsearchClient{
+		opts:       opts,
+		httpClient: newHTTPClient(opts.Timeout, opts.TLS),
+		logf:       logf,
+	}
+	c.batcher = newBatcher("elasticsearch", cfg, c.push, logf)
+	return c
+}
+
+// Send añade rec a la cola de envío sin esperar al clúster.
+func (c *ElasticsearchClient) Send(rec LogRecord) {
+	c.batcher.Add(rec)
+}
+
+// Close envía lo pendiente e informa de las líneas que se hayan perdido,
+// también las rechazadas.
+func (c *ElasticsearchClient) Close() {
+	c.batcher.Close()
+}
+
+// esDocument es un registro tal y como se indexa, con los nombres de campo
+// de Elastic Common Schema.
+type esDocument struct {
+	Timestamp string `json:"@timestamp"`
+	Message   string `json:"message"`
+	Level     string `json:"log.level,omitempty"`
+	Stream    string `json:"log.iostream"`
+	Host      string `json:"host.name,omitempty"`
+	Process   string `json:"process.name"`
+	Pid       int    `json:"process.pid,omitempty"`
+	Name      string `json:"mango.name"`
+	Instance  int    `json:"mango.instance,omitempty"`
+}
+
+type esAction struct {
+	Create struct {
+		Index string `json:"_index"`
+	} `json:"create"`
+}
+
+// esBulkResponse es la parte de la respuesta de _bulk que se consulta: un
+// elemento por documento, con su resultado bajo el nombre de la acción.
+type esBulkResponse struct {
+	Errors bool                    `json:"errors"`
+	Items  []map[string]esBulkItem `json:"items"`
+}
+
+type esBulkItem struct {
+	Status int `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+// bulkBody codifica batch en NDJSON, con una acción create antes de cada
+// documento; create sirve igual para índices y para data streams.
+func (c *ElasticsearchClient) bulkBody(batch []LogRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	for _, rec := range batch {
+		var action esAction
+		action.Create.Index = formatIndex(c.opts.Index, rec.Time)
+		doc := esDocument{
+			Timestamp: rec.Time.UTC().Format(time.RFC3339Nano),
+			Message:   rec.Line,
+			Level:     rec.Level,
+			Stream:    rec.Stream,
+			Host:      c.opts.Host,
+			Process:   rec.Process,
+			Pid:       rec.Pid,
+			Name:      rec.Name,
+			Instance:  rec.Instance,
+		}
+		// Encode termina cada objeto con el salto de línea que pide NDJSON.
+		if err := enc.Encode(action); err != nil {
+			return nil, err
+		}
+		if err := enc.Encode(doc); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *ElasticsearchClient) push(batch []LogRecord) error {
+	body, err := c.bulkBody(batch)
+	if err != nil {
+		return &pushError{err: fmt.Errorf("encoding bulk request: %v", err)}
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(c.opts.URL, "/")+"/_bulk", bytes.NewReader(body))
+	if err != nil {
+		return &pushError{err: err}
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if c.opts.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+c.opts.APIKey)
+	} else if c.opts.Username != "" {
+		req.SetBasicAuth(c.opts.Username, c.opts.Password)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := responseError(resp); err != nil {
+		io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	var result esBulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return &pushError{err: fmt.Errorf("decoding bulk response: %v", err)}
+	}
+	if result.Errors {
+		return c.partialFailure(batch, result.Items)
+	}
+	return nil
+}
+
+// partialFailure descarta los documentos de batch rechazados, informando del
+// primer motivo y contándolos como un envío fallido y como líneas perdidas,
+// y devuelve un error temporal con los rechazados con 429 para que el batcher
+// los reintente.
+func (c *ElasticsearchClient) partialFailure(batch []LogRecord, items []map[string]esBulkItem) error {
+	var throttled []LogRecord
+	rejected := 0
+	reason := ""
+	for i, item := range items {
+		if i >= len(batch) {
+			break
+		}
+		for _, result := range item {
+			switch {
+			case result.Status >= 200 && result.Status < 300:
+			case result.Status == http.StatusTooManyRequests:
+				throttled = append(throttled, batch[i])
+			default:
+				rejected++
+				if reason == "" && result.Error != nil {
+					reason = fmt.Sprintf(": %s: %s", result.Error.Type, result.Error.Reason)
+				}
+			}
+		}
+	}
+	if rejected > 0 {
+		countPushError("elasticsearch")
+		c.batcher.addDropped(rejected)
+		c.logf(fmt.Sprintf("elasticsearch: %d of %d documents were rejected%s", rejected, len(batch), reason))
+	}
+	if len(throttled) > 0 {
+		return &pushError{
+			err:   fmt.Errorf("%d of %d documents were throttled", len(throttled), len(batch)),
+			retry: true,
+			rest:  throttled,
+		}
+	}
+	return nil
+}
+
+type elasticsearchSink struct {
+	client *ElasticsearchClient
+	parser *LogParser
+}
+
+// openElasticsearchSink inicializa el sink de Elasticsearch si se ha
+// configurado elasticsearch.url.
+func openElasticsearchSink(of *OutletFactory, pf *Procfile) (LogSink, error) {
+	if flagElasticsearchURL == "" {
+		return nil, nil
+	}
+	if u, err := url.Parse(flagElasticsearchURL); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid url %q", flagElasticsearchURL)
+	}
+	if flagElasticsearchIndex == "" {
+		return nil, fmt.Errorf("elasticsearch.index must not be empty")
+	}
+	if flagElasticsearchBatchSize <= 0 || flagElasticsearchBatchWait <= 0 {
+		return nil, fmt.Errorf("elasticsearch.batch_size and elasticsearch.batch_wait must be positive")
+	}
+	tlsConfig, err := loadTLSConfig(flagElasticsearchCAFile, "", "", flagElasticsearchInsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	parser, err := levelParser()
+	if err != nil {
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+	opts := ElasticsearchOptions{
+		URL:      flagElasticsearchURL,
+		Index:    flagElasticsearchIndex,
+		Username: flagElasticsearchUsername,
+		Password: flagElasticsearchPassword,
+		APIKey:   flagElasticsearchAPIKey,
+		Timeout:  10 * time.Second,
+		TLS:      tlsConfig,
+		Host:     host,
+	}
+	cfg := batchConfig{
+		Size:       flagElasticsearchBatchSize,
+		Interval:   flagElasticsearchBatchWait,
+		QueueSize:  flagElasticsearchQueueSize,
+		Drop:       dropOldest,
+		Backoff:    defaultSinkBackoff,
+		BackoffMax: defaultSinkBackoffMax,
+		RetryFor:   flagElasticsearchRetryFor,
+	}
+	of.SystemOutput(fmt.Sprintf("elasticsearch: indexing logs into %s at %s", opts.Index, opts.URL))
+	return &elasticsearchSink{client: NewElasticsearchClient(opts, cfg, of.SystemOutput), parser: parser}, nil
+}
+
+func (s *elasticsearchSink) Send(rec LogRecord) {
+	if s.parser != nil {
+		s.parser.Process(&rec)
+	}
+	s.client.Send(rec)
+}
+
+func (s *elasticsearchSink) Close() {
+	s.client.Close()
+}
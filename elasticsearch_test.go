@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFormatIndex(t *testing.T) {
+	at := time.Date(2024, 3, 5, 23, 30, 0, 0, time.FixedZone("", -2*3600))
+	tests := []struct {
+		pattern, want string
+	}{
+		{"mango-%Y.%m.%d", "mango-2024.03.06"},
+		{"logs-%y%j-%H", "logs-24066-01"},
+		{"mango", "mango"},
+		{"100%%-%x-%", "100%-%x-%"},
+	}
+	for _, test := range tests {
+		if got := formatIndex(test.pattern, at); got != test.want {
+			t.Errorf("formatIndex(%q) = %q, se esperaba %q", test.pattern, got, test.want)
+		}
+	}
+}
+
+// bulkReceiver es un clúster de prueba que rechaza los documentos cuyo
+// mensaje esté en reject, con el estado indicado.
+type bulkReceiver struct {
+	mu     sync.Mutex
+	reject map[string]int
+	docs   []esDocument
+	index  []string
+	auth   []string
+}
+
+func (r *bulkReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if req.URL.Path != "/_bulk" || req.Header.Get("Content-Type") != "application/x-ndjson" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	r.auth = append(r.auth, req.Header.Get("Authorization"))
+
+	var items []string
+	errors := false
+	scanner := bufio.NewScanner(req.Body)
+	for scanner.Scan() {
+		var action esAction
+		json.Unmarshal(scanner.Bytes(), &action)
+		scanner.Scan()
+		var doc esDocument
+		json.Unmarshal(scanner.Bytes(), &doc)
+
+		status := r.reject[doc.Message]
+		if status == 0 {
+			status = 201
+			r.docs = append(r.docs, doc)
+			r.index = append(r.index, action.Create.Index)
+		} else {
+			errors = true
+			// Un rechazo por saturación sólo se da una vez.
+			if status == http.StatusTooManyRequests {
+				delete(r.reject, doc.Message)
+			}
+		}
+		items = append(items, fmt.Sprintf(`{"create":{"status":%d,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}`, status))
+	}
+	fmt.Fprintf(w, `{"took":1,"errors":%t,"items":[%s]}`, errors, strings.Join(items, ","))
+}
+
+func TestElasticsearchClient(t *testing.T) {
+	receiver := &bulkReceiver{reject: map[string]int{
+		"boom":      http.StatusTooManyRequests,
+		"sin nivel": http.StatusBadRequest,
+	}}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	countPushError("elasticsearch")
+	counters.Lock()
+	pushErrors := counters.pushErrors["elasticsearch"]
+	counters.Unlock()
+	before := atomic.LoadInt64(pushErrors)
+
+	var mu sync.Mutex
+	var logs []string
+	c := NewElasticsearchClient(ElasticsearchOptions{
+		URL:     srv.URL + "/",
+		Index:   "mango-%Y.%m.%d",
+		APIKey:  "abc",
+		Timeout: time.Second,
+		Host:    "box1",
+	}, testBatchConfig(), func(msg string) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, msg)
+	})
+	for _, rec := range testOTLPBatch() {
+		c.Send(rec)
+	}
+	c.Close()
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if len(receiver.docs) != 2 {
+		t.Fatalf("%d documentos indexados, se esperaban 2: %+v", len(receiver.docs), receiver.docs)
+	}
+	// boom se rechazó con 429 y se reintentó; sin nivel se descartó.
+	if receiver.docs[0].Message != "hola" || receiver.docs[1].Message != "boom" {
+		t.Errorf("documentos = %+v", receiver.docs)
+	}
+	want := esDocument{
+		Timestamp: "2023-11-14T22:13:20.000000005Z",
+		Message:   "boom",
+		Level:     "error",
+		Stream:    "stderr",
+		Host:      "box1",
+		Process:   "web",
+		Pid:       42,
+		Name:      "web.1",
+		Instance:  1,
+	}
+	if receiver.docs[1] != want {
+		t.Errorf("documento = %+v, se esperaba %+v", receiver.docs[1], want)
+	}
+	if receiver.index[0] != "mango-2023.11.14" {
+		t.Errorf("índice = %q", receiver.index[0])
+	}
+	for _, auth := range receiver.auth {
+		if auth != "ApiKey abc" {
+			t.Errorf("Authorization = %q", auth)
+		}
+	}
+
+	// El lote con un rechazo y uno saturado cuenta por los dos.
+	if got := atomic.LoadInt64(pushErrors); got != before+2 {
+		t.Errorf("errores de elasticsearch = %d, se esperaba %d", got, before+2)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	joined := strings.Join(logs, "\n")
+	for _, msg := range []string{
+		"push failed: 1 of 2 documents were throttled; retrying in",
+		"documents were rejected: mapper_parsing_exception: failed to parse",
+		"elasticsearch: dropped 1 lines that could not be sent",
+	} {
+		if !strings.Contains(joined, msg) {
+			t.Errorf("falta %q en los mensajes:\n%s", msg, joined)
+		}
+	}
+}
+
+func TestElasticsearchBulkBody(t *testing.T) {
+	c := &ElasticsearchClient{opts: ElasticsearchOptions{Index: "logs"}}
+	body, err := c.bulkBody([]LogRecord{{Time: time.Unix(0, 0), Process: "web", Stream: "stdout", Line: "<a & b>"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"create":{"_index":"logs"}}` + "\n" +
+		`{"@timestamp":"1970-01-01T00:00:00Z","message":"<a & b>","log.iostream":"stdout","process.name":"web","mango.name":""}` + "\n"
+	if string(body) != want {
+		t.Errorf("cuerpo =\n%s\nse esperaba\n%s", body, want)
+	}
+}
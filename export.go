@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+//go:embed templates/export
+var exportTemplates embed.FS
+
+var flagExportApp string
+var flagExportUser string
+var flagExportRoot string
+var flagExportLogDir string
+var flagExportTemplates string
+var exportEnvs envFiles
+
+var cmdExport = &Command{
+	Run:   runExport,
+	Usage: "export <format> <location> [-f procfile] [-e env] [-p port] [-c concurrency] [-t shutdown_grace_time] [-a app] [-u user] [-d root] [-l log] [-T templates]",
+	Short: "Export the application to another process manager",
+	Long: `
+Export the application specified by a Procfile to the configuration format of
+another process manager, writing the files into location. Supported formats
+are systemd, supervisord, runit and docker-compose.
+
+The -f, -e, -p, -c and -t options, and the .mango file, work as for 'mango
+start'; each instance gets its PORT following the same scheme, and restart
+policies declared in the Procfile are carried over (processes without one are
+always restarted). Additionally:
+
+  -a app       Name of the application. Defaults to the name of the directory
+               containing the Procfile.
+
+  -u user      User the processes run as. Defaults to the application name.
+
+  -d root      Working directory of the processes. Defaults to the directory
+               containing the Procfile.
+
+  -l log       Directory for log files. Defaults to /var/log/<app>.
+
+  -T templates Directory with custom templates. A file <templates>/<format>/<name>
+               replaces the built-in template of the same name; the built-in
+               ones can be used as a starting point.
+
+Examples:
+
+  mango export systemd /etc/systemd/system -a myapp
+  mango export supervisord /etc/supervisor/conf.d -c web=2,worker=1
+  mango export docker-compose .
+`,
+}
+
+func init() {
+	cmdExport.Flag.StringVar(&flagProcfile, "f", "Procfile", "procfile")
+	cmdExport.Flag.Var(&exportEnvs, "e", "env")
+	cmdExport.Flag.IntVar(&flagPort, "p", defaultPort, "port")
+	cmdExport.Flag.StringVar(&flagConcurrency, "c", "", "concurrency")
+	cmdExport.Flag.IntVar(&flagShutdownGraceTime, "t", defaultShutdownGraceTime, "shutdown grace time")
+	cmdExport.Flag.StringVar(&flagExportApp, "a", "", "app")
+	cmdExport.Flag.StringVar(&flagExportUser, "u", "", "user")
+	cmdExport.Flag.StringVar(&flagExportRoot, "d", "", "root")
+	cmdExport.Flag.StringVar(&flagExportLogDir, "l", "", "log")
+	cmdExport.Flag.StringVar(&flagExportTemplates, "T", "", "templates")
+}
+
+// Ámbitos de un fichero exportado: uno por aplicación, por proceso o por
+// instancia.
+const (
+	exportScopeApp = iota
+	exportScopeProcess
+	exportScopeInstance
+)
+
+// exportFile es un fichero que genera un formato: Template es el nombre de la
+// plantilla y Path, a su vez una plantilla, la ruta relativa del resultado.
+type exportFile struct {
+	Template string
+	Path     string
+	Scope    int
+	Mode     os.FileMode
+}
+
+// exportFormats declara los ficheros de cada formato. Añadir un formato es
+// añadir sus plantillas en templates/export/<formato> y una entrada aquí.
+var exportFormats = map[string][]exportFile{
+	"systemd": {
+		{"master.target", "{{.App}}.target", exportScopeApp, 0644},
+		{"process.target", "{{.App}}-{{.Process.Name}}.target", exportScopeProcess, 0644},
+		{"process.service", "{{.App}}-{{.Process.Name}}-{{.Instance.Num}}.service", exportScopeInstance, 0644},
+	},
+	"supervisord": {
+		{"app.conf", "{{.App}}.conf", exportScopeApp, 0644},
+	},
+	"runit": {
+		{"run", "{{.App}}-{{.Process.Name}}-{{.Instance.Num}}/run", exportScopeInstance, 0755},
+		{"finish", "{{.App}}-{{.Process.Name}}-{{.Instance.Num}}/finish", exportScopeInstance, 0755},
+		{"log-run", "{{.App}}-{{.Process.Name}}-{{.Instance.Num}}/log/run", exportScopeInstance, 0755},
+	},
+	"docker-compose": {
+		{"docker-compose.yml", "docker-compose.yml", exportScopeApp, 0644},
+	},
+}
+
+type exportVar struct {
+	Key, Value string
+}
+
+type exportInstance struct {
+	Name string // nombre visible, como en mango start
+	Num  int    // número de instancia empezando en 1
+	Port int
+	Env  []exportVar
+}
+
+type exportProcess struct {
+	Name      string
+	Command   string
+	Restart   RestartPolicy
+	Instances []*exportInstance
+}
+
+// exportData es lo que reciben las plantillas; Process e Instance sólo están
+// definidos en los ficheros de ese ámbito.
+type exportData struct {
+	App               string
+	User              string
+	Root              string
+	LogDir            string
+	ShutdownGraceTime int
+	Processes         []*exportProcess
+
+	Process  *exportProcess
+	Instance *exportInstance
+}
+
+var exportFuncs = template.FuncMap{
+	"quote":      exportQuote,
+	"shellquote": shellQuote,
+	// docker-compose interpola $VAR, y supervisord %(var)s y systemd %s al
+	// leer el fichero.
+	"escapedollar":  func(s string) string { return strings.ReplaceAll(s, "$", "$$") },
+	"escapepercent": func(s string) string { return strings.ReplaceAll(s, "%", "%%") },
+}
+
+// exportQuote entrecomilla s con comillas dobles y escapes al estilo JSON,
+// que entienden tanto YAML como systemd y supervisord. &, < y > se dejan como
+// están: ninguno de los tres decodifica \u0026.
+func exportQuote(s string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// shellQuote entrecomilla s para sh con comillas simples.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func runExport(cmd *Command, args []string) {
+	if len(args) != 2 {
+		cmd.printUsage()
+		os.Exit(1)
+	}
+	format, location := args[0], args[1]
+	files, ok := exportFormats[format]
+	if !ok {
+		handleError(fmt.Errorf("unknown export format %q", format))
+	}
+
+	pf, err := ReadProcfile(flagProcfile)
+	handleError(err)
+
+	concurrency, err := parseConcurrency(flagConcurrency)
+	handleError(err)
+
+	env, err := loadEnvs(exportEnvs)
+	handleError(err)
+
+	data, err := newExportData(pf, concurrency, env)
+	handleError(err)
+
+	handleError(exportFiles(format, files, data, location))
+}
+
+// newExportData reúne lo que necesitan las plantillas a partir del Procfile,
+// la concurrencia y el entorno, con los mismos puertos que mango start.
+func newExportData(pf *Procfile, concurrency map[string]int, env Env) (*exportData, error) {
+	root := flagExportRoot
+	if root == "" {
+		root = filepath.Dir(flagProcfile)
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &exportData{
+		App:               flagExportApp,
+		User:              flagExportUser,
+		Root:              root,
+		LogDir:            flagExportLogDir,
+		ShutdownGraceTime: flagShutdownGraceTime,
+	}
+	if data.App == "" {
+		data.App = filepath.Base(root)
+	}
+	if data.User == "" {
+		data.User = data.App
+	}
+	if data.LogDir == "" {
+		data.LogDir = "/var/log/" + data.App
+	}
+
+	port, err := basePort(env)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultConcurrency := 1
+	if num, ok := concurrency["all"]; ok {
+		defaultConcurrency = num
+	}
+
+	for idx, entry := range pf.Entries {
+		numProcs := defaultConcurrency
+		if value, ok := concurrency[entry.Name]; ok {
+			numProcs = value
+		}
+
+		proc := &exportProcess{Name: entry.Name, Command: entry.Command, Restart: entry.Restart}
+		if proc.Restart == "" {
+			proc.Restart = RestartAlways
+		}
+		for i := 0; i < numProcs; i++ {
+			// Los ficheros exportados necesitan un nombre distinto por
+			// instancia.
+			name := entry.Name
+			if i > 0 {
+				name = fmt.Sprintf("%s.%d", entry.Name, i+1)
+			}
+			inst := &exportInstance{Name: name, Num: i + 1}
+			instEnv := env.Clone()
+			if port > 0 {
+				inst.Port = port + idx*100 + i
+				instEnv["PORT"] = strconv.Itoa(inst.Port)
+			}
+			for key, value := range instEnv {
+				inst.Env = append(inst.Env, exportVar{key, value})
+			}
+			sort.Slice(inst.Env, func(a, b int) bool { return inst.Env[a].Key < inst.Env[b].Key })
+			proc.Instances = append(proc.Instances, inst)
+		}
+		data.Processes = append(data.Processes, proc)
+	}
+	return data, nil
+}
+
+// exportFiles genera en location los ficheros de format.
+func exportFiles(format string, files []exportFile, data *exportData, location string) error {
+	for _, file := range files {
+		tmpl, err := loadExportTemplate(format, file.Template)
+		if err != nil {
+			return err
+		}
+		pathTmpl, err := template.New(file.Template).Parse(file.Path)
+		if err != nil {
+			return err
+		}
+
+		var contexts []exportData
+		switch file.Scope {
+		case exportScopeApp:
+			contexts = append(contexts, *data)
+		case exportScopeProcess, exportScopeInstance:
+			for _, proc := range data.Processes {
+				if file.Scope == exportScopeProcess {
+					ctx := *data
+					ctx.Process = proc
+					contexts = append(contexts, ctx)
+					continue
+				}
+				for _, inst := range proc.Instances {
+					ctx := *data
+					ctx.Process, ctx.Instance = proc, inst
+					contexts = append(contexts, ctx)
+				}
+			}
+		}
+
+		for _, ctx := range contexts {
+			var path, content bytes.Buffer
+			if err := pathTmpl.Execute(&path, ctx); err != nil {
+				return err
+			}
+			if err := tmpl.Execute(&content, ctx); err != nil {
+				return fmt.Errorf("%s/%s: %v", format, file.Template, err)
+			}
+			if err := writeExportFile(filepath.Join(location, path.String()), content.Bytes(), file.Mode); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadExportTemplate carga la plantilla name de format, primero del
+// directorio de -T y si no de las incluidas en mango.
+func loadExportTemplate(format, name string) (*template.Template, error) {
+	var content []byte
+	var err error
+	if flagExportTemplates != "" {
+		content, err = os.ReadFile(filepath.Join(flagExportTemplates, format, name))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if content == nil {
+		content, err = fs.ReadFile(exportTemplates, "templates/export/"+format+"/"+name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return template.New(name).Funcs(exportFuncs).Parse(string(content))
+}
+
+func writeExportFile(path string, content []byte, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	Println("writing:", path)
+	if err := os.WriteFile(path, content, mode); err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
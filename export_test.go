@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportSystemd(t *testing.T) {
+	defer func(port, grace int) { flagPort, flagShutdownGraceTime = port, grace }(flagPort, flagShutdownGraceTime)
+	flagPort, flagShutdownGraceTime = 5000, 7
+	flagExportApp, flagExportRoot = "myapp", "/srv/myapp"
+	defer func() { flagExportApp, flagExportRoot = "", "" }()
+
+	pf, err := parseProcfile(strings.NewReader("web: bin/web -p $PORT\n# mango: restart=once\nmigrate: bin/migrate\nclock: date +%s && echo ok\n"))
+	if err != nil {
+		t.Fatalf("parseProcfile no debería fallar: %s", err)
+	}
+	data, err := newExportData(pf, map[string]int{"web": 2}, Env{"FOO": "bar", "RATIO": "50%"})
+	if err != nil {
+		t.Fatalf("newExportData no debería fallar: %s", err)
+	}
+
+	dir := t.TempDir()
+	stdout = &strings.Builder{}
+	defer func() { stdout = os.Stdout }()
+	if err := exportFiles("systemd", exportFormats["systemd"], data, dir); err != nil {
+		t.Fatalf("exportFiles no debería fallar: %s", err)
+	}
+
+	for _, name := range []string{"myapp.target", "myapp-web.target", "myapp-web-1.service", "myapp-web-2.service", "myapp-migrate.target", "myapp-migrate-1.service"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("esperaba el fichero %s: %s", name, err)
+		}
+	}
+
+	service, _ := os.ReadFile(filepath.Join(dir, "myapp-web-2.service"))
+	for _, want := range []string{
+		"WorkingDirectory=/srv/myapp\n",
+		"Environment=\"PORT=5001\"\n",
+		"Environment=\"FOO=bar\"\n",
+		"Environment=\"RATIO=50%%\"\n",
+		"ExecStart=/bin/sh -c 'bin/web -p $PORT'\n",
+		"Restart=always\n",
+		"TimeoutStopSec=7\n",
+	} {
+		if !strings.Contains(string(service), want) {
+			t.Fatalf("myapp-web-2.service no contiene %q:\n%s", want, service)
+		}
+	}
+
+	migrate, _ := os.ReadFile(filepath.Join(dir, "myapp-migrate-1.service"))
+	if !strings.Contains(string(migrate), "Restart=no\n") || !strings.Contains(string(migrate), "PORT=5100") {
+		t.Fatalf("myapp-migrate-1.service inesperado:\n%s", migrate)
+	}
+
+	// systemd expandiría %s como especificador.
+	clock, _ := os.ReadFile(filepath.Join(dir, "myapp-clock-1.service"))
+	if !strings.Contains(string(clock), "ExecStart=/bin/sh -c 'date +%%s && echo ok'\n") {
+		t.Fatalf("myapp-clock-1.service inesperado:\n%s", clock)
+	}
+}
+
+func TestExportQuote(t *testing.T) {
+	for s, want := range map[string]string{
+		"a && b":      `"a && b"`,
+		`<"x">`:       `"<\"x\">"`,
+		"línea\notra": `"línea\notra"`,
+	} {
+		if got := exportQuote(s); got != want {
+			t.Errorf("exportQuote(%q) = %s, se esperaba %s", s, got, want)
+		}
+	}
+}
+
+func TestExportCustomTemplates(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "supervisord"), 0755)
+	os.WriteFile(filepath.Join(dir, "supervisord", "app.conf"), []byte("custom {{.App}}\n"), 0644)
+	flagExportTemplates = dir
+	defer func() { flagExportTemplates = "" }()
+
+	tmpl, err := loadExportTemplate("supervisord", "app.conf")
+	if err != nil {
+		t.Fatalf("loadExportTemplate no debería fallar: %s", err)
+	}
+	var out strings.Builder
+	tmpl.Execute(&out, exportData{App: "myapp"})
+	if out.String() != "custom myapp\n" {
+		t.Fatalf("esperaba la plantilla personalizada, obtuve %q", out.String())
+	}
+
+	if _, err := loadExportTemplate("runit", "run"); err != nil {
+		t.Fatalf("sin plantilla personalizada debería usar la incluida: %s", err)
+	}
+}
@@ -0,0 +1,9 @@
+#!/bin/sh
+
+echo "2024-05-01 10:00:00 INFO starting"
+echo "2024-05-01 10:00:01 ERROR request failed"
+echo "java.lang.IllegalStateException: boom"
+printf '\tat com.example.Web.handle(Web.java:42)\n'
+printf '\tat com.example.Web.main(Web.java:7)\n'
+sleep 1
+echo "2024-05-01 10:00:02 INFO finish!"
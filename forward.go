@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultForwardAckTimeout = 30 * time.Second
+
+var flagForwardAddress string
+var flagForwardTag string
+var flagForwardRequireAck bool
+var flagForwardAckTimeout time.Duration
+var flagForwardBatchSize int
+var flagForwardBatchWait time.Duration
+var flagForwardQueueSize int
+var flagForwardRetryFor time.Duration
+
+func readForwardConfig(config Config) error {
+	var errs configErrors
+	for key, value := range map[string]*string{
+		"forward.address": &flagForwardAddress,
+		"forward.tag":     &flagForwardTag,
+	} {
+		if config[key] != "" {
+			*value = config[key]
+		}
+	}
+	errs.parseBool("forward.require_ack", config["forward.require_ack"], &flagForwardRequireAck)
+	for key, value := range map[string]*int{
+		"forward.batch_size": &flagForwardBatchSize,
+		"forward.queue_size": &flagForwardQueueSize,
+	} {
+		errs.parseInt(key, config[key], value)
+	}
+	for key, value := range map[string]*time.Duration{
+		"forward.ack_timeout":   &flagForwardAckTimeout,
+		"forward.batch_wait":    &flagForwardBatchWait,
+		"forward.retry_timeout": &flagForwardRetryFor,
+	} {
+		errs.parseDuration(key, config[key], value)
+	}
+	return errs.err()
+}
+
+// parseForwardAddress interpreta la dirección de Fluent Bit o Fluentd:
+// tcp://host:24224, host:24224, unix:///var/run/fluent.sock o una ruta a un
+// socket.
+func parseForwardAddress(value string) (network, address string, err error) {
+	switch {
+	case strings.HasPrefix(value, "/"):
+		return "unix", value, nil
+	case strings.HasPrefix(value, "unix://"):
+		if path := strings.TrimPrefix(value, "unix://"); path != "" {
+			return "unix", path, nil
+		}
+	case strings.HasPrefix(value, "tcp://"):
+		value = strings.TrimPrefix(value, "tcp://")
+		fallthrough
+	case !strings.Contains(value, "://"):
+		if _, _, err := net.SplitHostPort(value); err == nil {
+			return "tcp", value, nil
+		}
+	}
+	return "", "", fmt.Errorf("invalid forward address %q (want tcp://host:port, unix://path or a path)", value)
+}
+
+// ForwardOptions dice a qué servidor enviar los logs y con qué tag.
+type ForwardOptions struct {
+	Network string // tcp o unix
+	Address string
+	Timeout time.Duration
+
+	// Tag es el prefijo de los tags: los registros de web van con el tag
+	// Tag.web.
+	Tag  string
+	Host string
+
+	// RequireAck pide a cada mensaje la confirmación del servidor, que
+	// debe llegar antes de AckTimeout.
+	RequireAck bool
+	AckTimeout time.Duration
+}
+
+// ForwardClient envía los registros con el protocolo Forward de Fluentd, que
+// también entiende Fluent Bit, en modo Forward: un mensaje
+// [tag, [[time, record], ...], option] por proceso y lote. Usa una sola
+// conexión, que se vuelve a abrir tras un error; los lotes se reintentan como
+// en LokiClient, así que tras un error un mensaje puede llegar dos veces.
+type ForwardClient struct {
+	opts    ForwardOptions
+	batcher *batcher
+
+	// conn sólo la usa la goroutine del batcher.
+	conn   net.Conn
+	reader *bufio.Reader
+	buf    []byte
+}
+
+func NewForwardClient(opts ForwardOptions, cfg batchConfig, logf func(msg string)) *ForwardClient {
+	c := &ForwardClient{opts: opts}
+	c.batcher = newBatcher("forward", cfg, c.push, logf)
+	return c
+}
+
+// Send añade rec a la cola de envío sin esperar al servidor.
+func (c *ForwardClient) Send(rec LogRecord) {
+	c.batcher.Add(rec)
+}
+
+// Close envía lo pendiente, cierra la conexión e informa de las líneas que
+// se hayan perdido.
+func (c *ForwardClient) Close() {
+	c.batcher.Close()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// tag devuelve el tag de los registros de process.
+func (c *ForwardClient) tag(process string) string {
+	if c.opts.Tag == "" {
+		return process
+	}
+	return c.opts.Tag + "." + process
+}
+
+func (c *ForwardClient) push(batch []LogRecord) error {
+	if c.conn == nil {
+		conn, err := net.DialTimeout(c.opts.Network, c.opts.Address, c.opts.Timeout)
+		if err != nil {
+			return err
+		}
+		c.conn, c.reader = conn, bufio.NewReader(conn)
+	}
+	if err := c.write(batch); err != nil {
+		c.conn.Close()
+		c.conn = nil
+		return err
+	}
+	return nil
+}
+
+// write envía un mensaje por cada tag de batch, en el orden en que aparece
+// cada uno, y espera su confirmación si se pide.
+func (c *ForwardClient) write(batch []LogRecord) error {
+	var tags []string
+	entries := make(map[string][]LogRecord)
+	for _, rec := range batch {
+		tag := c.tag(rec.Process)
+		if _, ok := entries[tag]; !ok {
+			tags = append(tags, tag)
+		}
+		entries[tag] = append(entries[tag], rec)
+	}
+
+	for _, tag := range tags {
+		chunk := ""
+		if c.opts.RequireAck {
+			var err error
+			if chunk, err = newChunkID(); err != nil {
+				return &pushError{err: err}
+			}
+		}
+		c.buf = c.message(c.buf[:0], tag, entries[tag], chunk)
+		c.conn.SetWriteDeadline(time.Now().Add(c.opts.Timeout))
+		if _, err := c.conn.Write(c.buf); err != nil {
+			return err
+		}
+		if chunk != "" {
+			if err := c.waitAck(chunk); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// message codifica los registros de tag como un mensaje en modo Forward.
+func (c *ForwardClient) message(b []byte, tag string, records []LogRecord, chunk string) []byte {
+	fields := 2
+	if chunk != "" {
+		fields = 3
+	}
+	b = appendMsgpackArray(b, fields)
+	b = appendMsgpackString(b, tag)
+	b = appendMsgpackArray(b, len(records))
+	for _, rec := range records {
+		b = appendMsgpackArray(b, 2)
+		b = appendMsgpackEventTime(b, rec.Time)
+		b = c.record(b, rec)
+	}
+	if chunk != "" {
+		b = appendMsgpackMap(b, 2)
+		b = appendMsgpackString(b, "size")
+		b = appendMsgpackInt(b, int64(len(records)))
+		b = appendMsgpackString(b, "chunk")
+		b = appendMsgpackString(b, chunk)
+	}
+	return b
+}
+
+// record codifica los campos de rec; los que están vacíos se omiten.
+func (c *ForwardClient) record(b []byte, rec LogRecord) []byte {
+	text := []struct{ key, value string }{
+		{"message", rec.Line},
+		{"stream", rec.Stream},
+		{"name", rec.Name},
+		{"process", rec.Process},
+		{"host", c.opts.Host},
+		{"level", rec.Level},
+	}
+	numbers := []struct {
+		key   string
+		value int
+	}{
+		{"instance", rec.Instance},
+		{"pid", rec.Pid},
+	}
+	n := 0
+	for _, field := range text {
+		if field.value != "" {
+			n++
+		}
+	}
+	for _, field := range numbers {
+		if field.value != 0 {
+			n++
+		}
+	}
+
+	b = appendMsgpackMap(b, n)
+	for _, field := range text {
+		if field.value != "" {
+			b = appendMsgpackString(b, field.key)
+			b = appendMsgpackString(b, field.value)
+		}
+	}
+	for _, field := range numbers {
+		if field.value != 0 {
+			b = appendMsgpackString(b, field.key)
+			b = appendMsgpackInt(b, int64(field.value))
+		}
+	}
+	return b
+}
+
+// waitAck espera la respuesta {"ack": chunk} del servidor.
+func (c *ForwardClient) waitAck(chunk string) error {
+	c.conn.SetReadDeadline(time.Now().Add(c.opts.AckTimeout))
+	v, err := decodeMsgpack(c.reader)
+	if err != nil {
+		return fmt.Errorf("waiting for ack: %v", err)
+	}
+	resp, _ := v.(map[string]interface{})
+	if ack, _ := resp["ack"].(string); ack != chunk {
+		return fmt.Errorf("unexpected ack %v (want %s)", v, chunk)
+	}
+	return nil
+}
+
+// newChunkID devuelve un identificador de mensaje al azar.
+func newChunkID() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(id[:]), nil
+}
+
+type forwardSink struct {
+	client *ForwardClient
+	parser *LogParser
+}
+
+// openForwardSink inicializa el sink Forward si se ha configurado
+// forward.address.
+func openForwardSink(of *OutletFactory, pf *Procfile) (LogSink, error) {
+	if flagForwardAddress == "" {
+		return nil, nil
+	}
+	network, address, err := parseForwardAddress(flagForwardAddress)
+	if err != nil {
+		return nil, err
+	}
+	if flagForwardBatchSize <= 0 || flagForwardBatchWait <= 0 {
+		return nil, fmt.Errorf("forward.batch_size and forward.batch_wait must be positive")
+	}
+	if flagForwardAckTimeout <= 0 {
+		return nil, fmt.Errorf("forward.ack_timeout must be positive")
+	}
+	parser, err := levelParser()
+	if err != nil {
+		return nil, err
+	}
+
+	// Sin forward.tag, el prefijo es loki.job, el nombre de la aplicación
+	// que comparten todos los sinks.
+	tag := flagForwardTag
+	if tag == "" {
+		tag = flagLokiJob
+	}
+	host, _ := os.Hostname()
+	opts := ForwardOptions{
+		Network:    network,
+		Address:    address,
+		Timeout:    10 * time.Second,
+		Tag:        tag,
+		Host:       host,
+		RequireAck: flagForwardRequireAck,
+		AckTimeout: flagForwardAckTimeout,
+	}
+	cfg := batchConfig{
+		Size:       flagForwardBatchSize,
+		Interval:   flagForwardBatchWait,
+		QueueSize:  flagForwardQueueSize,
+		Drop:       dropOldest,
+		Backoff:    defaultSinkBackoff,
+		BackoffMax: defaultSinkBackoffMax,
+		RetryFor:   flagForwardRetryFor,
+	}
+	of.SystemOutput(fmt.Sprintf("forward: sending logs to %s with tag %s.<process>", flagForwardAddress, tag))
+	return &forwardSink{client: NewForwardClient(opts, cfg, of.SystemOutput), parser: parser}, nil
+}
+
+func (s *forwardSink) Send(rec LogRecord) {
+	if s.parser != nil {
+		s.parser.Process(&rec)
+	}
+	s.client.Send(rec)
+}
+
+func (s *forwardSink) Close() {
+	s.client.Close()
+}
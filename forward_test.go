@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	var b []byte
+	b = appendMsgpackArray(b, 8)
+	b = appendMsgpackString(b, "hola")
+	b = appendMsgpackString(b, long)
+	b = appendMsgpackInt(b, 7)
+	b = appendMsgpackInt(b, -3)
+	b = appendMsgpackInt(b, 70000)
+	b = appendMsgpackInt(b, -70000)
+	b = appendMsgpackMap(b, 1)
+	b = appendMsgpackString(b, "k")
+	b = appendMsgpackArray(b, 20)
+	for i := 0; i < 20; i++ {
+		b = appendMsgpackInt(b, int64(i))
+	}
+	b = appendMsgpackEventTime(b, time.Unix(1700000000, 5))
+
+	v, err := decodeMsgpack(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := make([]interface{}, 20)
+	for i := range list {
+		list[i] = int64(i)
+	}
+	want := []interface{}{
+		"hola", long, int64(7), int64(-3), uint64(70000), int64(-70000),
+		map[string]interface{}{"k": list},
+		msgpackExt{Type: 0, Data: []byte{0x65, 0x53, 0xf1, 0x00, 0, 0, 0, 5}},
+	}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("decodeMsgpack = %#v, se esperaba %#v", v, want)
+	}
+}
+
+func TestParseForwardAddress(t *testing.T) {
+	tests := []struct {
+		value, network, address string
+	}{
+		{"localhost:24224", "tcp", "localhost:24224"},
+		{"tcp://10.0.0.1:24224", "tcp", "10.0.0.1:24224"},
+		{"unix:///var/run/fluent.sock", "unix", "/var/run/fluent.sock"},
+		{"/var/run/fluent.sock", "unix", "/var/run/fluent.sock"},
+	}
+	for _, test := range tests {
+		network, address, err := parseForwardAddress(test.value)
+		if err != nil || network != test.network || address != test.address {
+			t.Errorf("parseForwardAddress(%q) = %q, %q, %v", test.value, network, address, err)
+		}
+	}
+	for _, value := range []string{"localhost", "udp://host:1", "unix://", "tcp://host"} {
+		if _, _, err := parseForwardAddress(value); err == nil {
+			t.Errorf("parseForwardAddress(%q) debería fallar", value)
+		}
+	}
+}
+
+// forwardMessage es un mensaje recibido por forwardServer.
+type forwardMessage struct {
+	Tag     string
+	Times   []time.Time
+	Records []map[string]interface{}
+	Option  map[string]interface{}
+}
+
+// forwardServer es un Fluent Bit de prueba que decodifica los mensajes en
+// modo Forward y, si ack, confirma cada chunk.
+type forwardServer struct {
+	ln  net.Listener
+	ack bool
+
+	mu       sync.Mutex
+	messages []forwardMessage
+}
+
+func newForwardServer(t *testing.T, network, address string, ack bool) *forwardServer {
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &forwardServer{ln: ln, ack: ack}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(t, conn)
+		}
+	}()
+	return s
+}
+
+func (s *forwardServer) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		v, err := decodeMsgpack(r)
+		if err != nil {
+			return
+		}
+		fields := v.([]interface{})
+		msg := forwardMessage{Tag: fields[0].(string)}
+		for _, entry := range fields[1].([]interface{}) {
+			pair := entry.([]interface{})
+			ext := pair[0].(msgpackExt)
+			msg.Times = append(msg.Times, time.Unix(int64(binary.BigEndian.Uint32(ext.Data)), int64(binary.BigEndian.Uint32(ext.Data[4:]))))
+			msg.Records = append(msg.Records, pair[1].(map[string]interface{}))
+		}
+		if len(fields) > 2 {
+			msg.Option = fields[2].(map[string]interface{})
+		}
+		s.mu.Lock()
+		s.messages = append(s.messages, msg)
+		s.mu.Unlock()
+
+		if s.ack && msg.Option != nil {
+			var b []byte
+			b = appendMsgpackMap(b, 1)
+			b = appendMsgpackString(b, "ack")
+			b = appendMsgpackString(b, msg.Option["chunk"].(string))
+			conn.Write(b)
+		}
+	}
+}
+
+func testForwardClient(t *testing.T, network, address string, ack bool) *forwardServer {
+	srv := newForwardServer(t, network, address, ack)
+	defer srv.ln.Close()
+
+	c := NewForwardClient(ForwardOptions{
+		Network:    network,
+		Address:    srv.ln.Addr().String(),
+		Timeout:    time.Second,
+		Tag:        "app",
+		Host:       "box1",
+		RequireAck: ack,
+		AckTimeout: time.Second,
+	}, testBatchConfig(), func(msg string) { t.Log(msg) })
+	for _, rec := range testOTLPBatch() {
+		c.Send(rec)
+	}
+	c.Close()
+
+	// El servidor termina de leer en cuanto el cliente cierra la conexión.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		srv.mu.Lock()
+		n := 0
+		for _, msg := range srv.messages {
+			n += len(msg.Records)
+		}
+		srv.mu.Unlock()
+		if n >= 3 || time.Now().After(deadline) {
+			return srv
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestForwardClient(t *testing.T) {
+	srv := testForwardClient(t, "tcp", "127.0.0.1:0", false)
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	var tags []string
+	var records []map[string]interface{}
+	for _, msg := range srv.messages {
+		tags = append(tags, msg.Tag)
+		records = append(records, msg.Records...)
+		if msg.Option != nil {
+			t.Errorf("opciones sin ack: %v", msg.Option)
+		}
+		for _, at := range msg.Times {
+			if !at.Equal(time.Unix(1700000000, 5)) {
+				t.Errorf("hora = %v", at)
+			}
+		}
+	}
+	// testBatchConfig envía lotes de 2: web.1 va en el primero y worker.2
+	// en el segundo.
+	if want := []string{"app.web", "app.worker"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("tags = %v, se esperaba %v", tags, want)
+	}
+	if len(records) != 3 {
+		t.Fatalf("%d registros, se esperaban 3", len(records))
+	}
+	want := map[string]interface{}{
+		"message":  "boom",
+		"stream":   "stderr",
+		"name":     "web.1",
+		"process":  "web",
+		"host":     "box1",
+		"level":    "error",
+		"instance": int64(1),
+		"pid":      int64(42),
+	}
+	if !reflect.DeepEqual(records[1], want) {
+		t.Errorf("registro = %v, se esperaba %v", records[1], want)
+	}
+}
+
+func TestForwardClientAck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fluent.sock")
+	srv := testForwardClient(t, "unix", path, true)
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	total := 0
+	for _, msg := range srv.messages {
+		total += len(msg.Records)
+		chunk, _ := msg.Option["chunk"].(string)
+		if chunk == "" || msg.Option["size"] != int64(len(msg.Records)) {
+			t.Errorf("opciones = %v", msg.Option)
+		}
+	}
+	// Con ack no hay reintentos, así que cada registro llega una vez.
+	if total != 3 {
+		t.Errorf("%d registros, se esperaban 3", total)
+	}
+}
+
+func TestForwardClientBadAck(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		decodeMsgpack(bufio.NewReader(conn))
+		var b []byte
+		b = appendMsgpackMap(b, 1)
+		b = appendMsgpackString(b, "ack")
+		b = appendMsgpackString(b, "otro")
+		conn.Write(b)
+	}()
+
+	c := &ForwardClient{opts: ForwardOptions{Network: "tcp", Address: ln.Addr().String(), Timeout: time.Second, RequireAck: true, AckTimeout: time.Second}}
+	err = c.push(testOTLPBatch()[:1])
+	if err == nil || !strings.Contains(err.Error(), "unexpected ack") {
+		t.Errorf("push = %v, se esperaba un error de ack", err)
+	}
+	if c.conn != nil {
+		t.Error("la conexión debería cerrarse tras el error")
+	}
+}
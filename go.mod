@@ -4,6 +4,7 @@ go 1.18
 
 require (
 	github.com/daviddengcn/go-colortext v1.0.0
+	github.com/golang/snappy v1.0.0
 	github.com/subosito/gotenv v1.6.0
 )
 
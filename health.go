@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultHealthInterval = 10 * time.Second
+const defaultHealthTimeout = 2 * time.Second
+const defaultHealthThreshold = 3
+
+// HealthCheck describe cómo comprobar periódicamente que una instancia sigue
+// sana. Kind vacío significa que la entrada no declara chequeo.
+type HealthCheck struct {
+	Kind   string // "http", "tcp" o "cmd"
+	Target string
+
+	Interval  time.Duration
+	Timeout   time.Duration
+	Threshold int
+}
+
+// parseHealthCheck interpreta el valor de la opción health: "http" o
+// "http:/path" (GET contra el PORT de la instancia), "http://host/url",
+// "tcp", "tcp:port", "tcp:host:port" o "cmd:<comando>".
+func parseHealthCheck(value string) (kind, target string, err error) {
+	if strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://") {
+		return "http", value, nil
+	}
+	kind = value
+	if i := strings.Index(value, ":"); i >= 0 {
+		kind, target = value[:i], strings.TrimSpace(value[i+1:])
+	}
+	switch kind {
+	case "http":
+		if target != "" && !strings.HasPrefix(target, "/") {
+			return "", "", fmt.Errorf("invalid health path %q", target)
+		}
+	case "tcp":
+	case "cmd":
+		if target == "" {
+			return "", "", fmt.Errorf("health=cmd needs a command")
+		}
+	default:
+		return "", "", fmt.Errorf("invalid health check %q (expected http, tcp or cmd:<command>)", value)
+	}
+	return kind, target, nil
+}
+
+func (h HealthCheck) interval() time.Duration {
+	if h.Interval > 0 {
+		return h.Interval
+	}
+	return defaultHealthInterval
+}
+
+func (h HealthCheck) timeout() time.Duration {
+	if h.Timeout > 0 {
+		return h.Timeout
+	}
+	return defaultHealthTimeout
+}
+
+func (h HealthCheck) threshold() int {
+	if h.Threshold > 0 {
+		return h.Threshold
+	}
+	return defaultHealthThreshold
+}
+
+// probe ejecuta el chequeo una vez contra la instancia que escucha en port.
+func (h HealthCheck) probe(port int, workDir string, env Env) error {
+	switch h.Kind {
+	case "http":
+		url := h.Target
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			if port == 0 {
+				return fmt.Errorf("no PORT to check")
+			}
+			url = "http://" + net.JoinHostPort("localhost", strconv.Itoa(port)) + h.Target
+		}
+		client := &http.Client{Timeout: h.timeout()}
+		resp, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("GET %s: status %d", url, resp.StatusCode)
+		}
+		return nil
+
+	case "tcp":
+		address := h.Target
+		if address == "" {
+			if port == 0 {
+				return fmt.Errorf("no PORT to check")
+			}
+			address = strconv.Itoa(port)
+		}
+		if !strings.Contains(address, ":") {
+			address = net.JoinHostPort("localhost", address)
+		}
+		conn, err := net.DialTimeout("tcp", address, h.timeout())
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+
+	case "cmd":
+		ps := NewProcess(workDir, h.Target, env, false)
+		if err := ps.Start(); err != nil {
+			return err
+		}
+		done := make(chan error, 1)
+		go func() { done <- ps.Wait() }()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(h.timeout()):
+			ps.SendSigKill()
+			<-done
+			return fmt.Errorf("timed out after %s", h.timeout())
+		}
+	}
+	return nil
+}
+
+// monitorHealth comprueba la instancia cada intervalo desde que está lista y,
+// si falla threshold veces seguidas, la detiene como fallida para que su
+// política de reinicio decida qué hacer.
+func (f *mango) monitorHealth(inst *instance, check HealthCheck, port int, workDir string, env Env, ps *Process, ready *Barrier, finished <-chan struct{}) {
+	select {
+	case <-ready.Barrier():
+	case <-finished:
+		return
+	}
+
+	ticker := time.NewTicker(check.interval())
+	defer ticker.Stop()
+
+	healthy := false
+	failures := 0
+	procName := inst.Name
+	for {
+		select {
+		case <-ticker.C:
+		case <-finished:
+			return
+		}
+
+		err := check.probe(port, workDir, env)
+		if err == nil {
+			failures = 0
+			if !healthy {
+				healthy = true
+				f.systemEvent(fmt.Sprintf("%s is healthy", procName))
+			}
+			continue
+		}
+
+		failures++
+		if failures < check.threshold() {
+			continue
+		}
+		f.systemEvent(fmt.Sprintf("%s is unhealthy after %d failed checks: %v", procName, failures, err))
+		f.systemEvent(fmt.Sprintf("stopping unhealthy %s", procName))
+		inst.mu.Lock()
+		inst.unhealthy = true
+		inst.mu.Unlock()
+		f.terminate(procName, ps, finished)
+		return
+	}
+}
+
+// systemEvent imprime msg como línea de sistema y la reenvía a los sinks.
+func (f *mango) systemEvent(msg string) {
+	f.outletFactory.SystemOutput(msg)
+	if f.sinks != nil {
+		f.sinks.Dispatch(systemRecord(msg))
+	}
+}
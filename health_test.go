@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseHealthCheck(t *testing.T) {
+	cases := map[string][2]string{
+		"http":                 {"http", ""},
+		"http:/healthz":        {"http", "/healthz"},
+		"http://localhost:9/x": {"http", "http://localhost:9/x"},
+		"tcp":                  {"tcp", ""},
+		"tcp:db:5432":          {"tcp", "db:5432"},
+		"cmd:pg_isready -q":    {"cmd", "pg_isready -q"},
+	}
+	for input, want := range cases {
+		kind, target, err := parseHealthCheck(input)
+		if err != nil {
+			t.Fatalf("parseHealthCheck(%q) no debería fallar: %s", input, err)
+		}
+		if kind != want[0] || target != want[1] {
+			t.Fatalf("parseHealthCheck(%q): esperaba %q, obtuve %q %q", input, want, kind, target)
+		}
+	}
+
+	for _, input := range []string{"udp", "cmd:", "http:healthz"} {
+		if _, _, err := parseHealthCheck(input); err == nil {
+			t.Fatalf("esperaba error para %q, pero no lo hubo", input)
+		}
+	}
+}
+
+func TestHealthCheckProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	_, portStr, _ := net.SplitHostPort(server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	if err := (HealthCheck{Kind: "http", Target: "/healthz"}).probe(port, ".", Env{}); err != nil {
+		t.Fatalf("el chequeo http debería pasar: %s", err)
+	}
+	if err := (HealthCheck{Kind: "http", Target: "/down"}).probe(port, ".", Env{}); err == nil {
+		t.Fatal("el chequeo http debería fallar con 503")
+	}
+	if err := (HealthCheck{Kind: "tcp"}).probe(port, ".", Env{}); err != nil {
+		t.Fatalf("el chequeo tcp debería pasar: %s", err)
+	}
+	if err := (HealthCheck{Kind: "cmd", Target: "exit 3"}).probe(0, ".", Env{}); err == nil {
+		t.Fatal("el chequeo cmd debería fallar con exit 3")
+	}
+}
+
+// TestUnhealthyExitIsFailure comprueba que una instancia parada por su
+// chequeo de salud se reinicia con restart=on-failure aunque salga con 0.
+func TestUnhealthyExitIsFailure(t *testing.T) {
+	proc := ProcfileEntry{
+		Name:    "web",
+		Command: "trap 'exit 0' TERM; while :; do sleep 0.05; done",
+		Restart: RestartOnFailure,
+		Health:  HealthCheck{Kind: "cmd", Target: "exit 1", Interval: 50 * time.Millisecond, Threshold: 1},
+	}
+	f := &mango{
+		outletFactory: NewOutletFactory(),
+		sinks:         &LogDispatcher{},
+		procfile:      &Procfile{Entries: []ProcfileEntry{proc}},
+		states:        map[string]*procState{proc.Name: newProcState(1)},
+		env:           Env{},
+	}
+	f.startProcess(0, 0, proc, f.env, f.outletFactory)
+	defer func() {
+		f.teardown.Fall()
+		f.wg.Wait()
+	}()
+
+	inst := f.states[proc.Name].snapshot()[0]
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		inst.mu.Lock()
+		state := inst.state
+		inst.mu.Unlock()
+		switch {
+		case state == stateBackoff:
+			return
+		case state == stateCompleted:
+			t.Fatal("la instancia parada por el chequeo de salud no debería completarse")
+		case time.Now().After(deadline):
+			t.Fatalf("la instancia sigue %s; se esperaba que esperara para reiniciarse", state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -41,7 +41,7 @@ var usageTemplate = template.Must(template.New("usage").Parse(`
 Usage: mango <command> [<args>]
 
 Available commands:{{range .Commands}}{{if .Runnable}}{{if .List}}
-   {{.Name | printf "%-8s"}}  {{.Short}}{{end}}{{end}}{{end}}
+   {{.Name | printf "%-10s"}}  {{.Short}}{{end}}{{end}}{{end}}
 
 Run 'mango help [command]' for details.
 `[1:]))
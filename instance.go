@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Estados de una instancia, tal como los muestra `mango ps`.
+const (
+	stateStarting  = "starting"
+	stateRunning   = "running"
+	stateBackoff   = "backoff"
+	stateStopping  = "stopping"
+	stateStopped   = "stopped"
+	stateCompleted = "completed"
+)
+
+// Peticiones que un usuario puede hacer a una instancia por el socket de
+// control.
+const (
+	requestStop    = "stop"
+	requestRestart = "restart"
+	requestStart   = "start"
+	requestRemove  = "remove"
+)
+
+// instance es una instancia supervisada de una entrada del Procfile.
+type instance struct {
+	Name string
+	Proc ProcfileEntry
+	Idx  int
+	Num  int
+
+	// ready cae la primera vez que la instancia pasa su chequeo.
+	ready  *Barrier
+	budget *restartBudget
+
+	// wake despierta a la instancia mientras espera (backoff, detenida o
+	// completada) para que atienda request.
+	wake chan struct{}
+
+	mu       sync.Mutex
+	state    string
+	request  string
+	ps       *Process
+	finished <-chan struct{}
+	port     int
+	started  time.Time
+	restarts int
+
+	// unhealthy marca que el chequeo de salud ha parado la ejecución en
+	// curso, que entonces cuenta como fallida aunque salga con 0.
+	unhealthy bool
+}
+
+// instanceStatus es la foto de una instancia que devuelve `mango ps`.
+// Instance es su número desde 1, el de web.<n> en el socket de control.
+type instanceStatus struct {
+	Name     string  `json:"name"`
+	Instance int     `json:"instance"`
+	Pid      int     `json:"pid"`
+	State    string  `json:"state"`
+	Uptime   float64 `json:"uptime"`
+	Restarts int     `json:"restarts"`
+	Port     int     `json:"port"`
+}
+
+func newInstance(idx, procNum int, proc ProcfileEntry) *instance {
+	return &instance{
+		Name:   instanceName(proc.Name, procNum),
+		Proc:   proc,
+		Idx:    idx,
+		Num:    procNum,
+		ready:  new(Barrier),
+		budget: newRestartBudget(),
+		wake:   make(chan struct{}, 1),
+		state:  stateStarting,
+	}
+}
+
+// instanceName devuelve el nombre visible de la instancia procNum de name.
+// Como siempre en mango, las dos primeras instancias se muestran sólo con
+// el nombre de la entrada; para el socket de control se distinguen por su
+// número, como web.2.
+func instanceName(name string, procNum int) string {
+	if procNum > 1 {
+		return fmt.Sprintf("%s.%d", name, procNum+1)
+	}
+	return name
+}
+
+func (inst *instance) setState(state string) {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	inst.state = state
+}
+
+// takeRequest devuelve y olvida la petición pendiente.
+func (inst *instance) takeRequest() string {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	request := inst.request
+	inst.request = ""
+	return request
+}
+
+// notify deja request pendiente y despierta a la instancia si está esperando.
+// Debe llamarse con inst.mu tomado.
+func (inst *instance) notify(request string) {
+	inst.request = request
+	select {
+	case inst.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (inst *instance) status() instanceStatus {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	status := instanceStatus{
+		Name:     inst.Name,
+		Instance: inst.Num + 1,
+		State:    inst.state,
+		Restarts: inst.restarts,
+		Port:     inst.port,
+	}
+	if inst.state == stateRunning || inst.state == stateStopping {
+		if inst.ps != nil && inst.ps.Process != nil {
+			status.Pid = inst.ps.Process.Pid
+		}
+		status.Uptime = time.Since(inst.started).Seconds()
+	}
+	return status
+}
+
+// supervise ejecuta la instancia hasta el teardown: cuando el proceso termina
+// decide, según la petición del usuario, su política de reinicio y el
+// presupuesto de reinicios, si relanzarlo, dejarlo parado o bajar todo.
+func (f *mango) supervise(inst *instance, env Env, of *OutletFactory) {
+	policy := restartPolicy(inst.Proc)
+
+	// live dice si la instancia cuenta en f.live; deja de contar al salir,
+	// también cuando scale la quita.
+	live := true
+	defer func() {
+		if live {
+			f.addLive(-1)
+		}
+	}()
+
+	for {
+		exited, success := f.runProcess(inst, env, of)
+		if !exited {
+			return
+		}
+
+		switch request := inst.takeRequest(); {
+		case request == requestRemove:
+			of.SystemOutput(fmt.Sprintf("%s removed", inst.Name))
+			return
+		case request == requestRestart:
+			inst.budget = newRestartBudget()
+			inst.mu.Lock()
+			inst.restarts++
+			inst.mu.Unlock()
+			continue
+		case request == requestStop:
+			of.SystemOutput(fmt.Sprintf("%s stopped", inst.Name))
+			if !f.park(inst, stateStopped) {
+				return
+			}
+			continue
+		case success && (policy == RestartOnce || policy == RestartOnFailure):
+			of.SystemOutput(fmt.Sprintf("%s completed", inst.Name))
+			inst.ready.Fall()
+			live = false
+			f.addLive(-1)
+			if !f.park(inst, stateCompleted) {
+				return
+			}
+			live = true
+			f.addLive(1)
+			continue
+		case policy == RestartNever || policy == RestartOnce:
+			of.SystemOutput(fmt.Sprintf("teardown cause: %s finished (restart=%s)", inst.Name, policy))
+			f.teardown.Fall()
+			return
+		}
+
+		delay, ok := inst.budget.next(time.Now())
+		if !ok {
+			of.SystemOutput(fmt.Sprintf("giving up on %s: restarted %d times within %s", inst.Name, inst.budget.limit, inst.budget.window))
+			of.SystemOutput(fmt.Sprintf("teardown cause: %s exceeded restart limit", inst.Name))
+			f.teardown.Fall()
+			return
+		}
+
+		of.SystemOutput(fmt.Sprintf("restart policy: restarting %s in %s", inst.Name, delay))
+		inst.setState(stateBackoff)
+		select {
+		case <-time.After(delay):
+		case <-inst.wake:
+			switch inst.takeRequest() {
+			case requestRemove:
+				of.SystemOutput(fmt.Sprintf("%s removed", inst.Name))
+				return
+			case requestStop:
+				of.SystemOutput(fmt.Sprintf("%s stopped", inst.Name))
+				if !f.park(inst, stateStopped) {
+					return
+				}
+			}
+		case <-f.teardown.Barrier():
+			return
+		}
+
+		inst.mu.Lock()
+		inst.restarts++
+		inst.mu.Unlock()
+	}
+}
+
+// park deja la instancia en state hasta que un usuario la vuelve a arrancar.
+// Devuelve false si entretanto empieza el teardown o se quita la instancia.
+func (f *mango) park(inst *instance, state string) bool {
+	inst.setState(state)
+	for {
+		select {
+		case <-inst.wake:
+			switch inst.takeRequest() {
+			case requestStop:
+				continue
+			case requestRemove:
+				f.outletFactory.SystemOutput(fmt.Sprintf("%s removed", inst.Name))
+				return false
+			}
+			return true
+		case <-f.teardown.Barrier():
+			return false
+		}
+	}
+}
+
+// terminate pide a ps que termine y, si no lo hace dentro del grace time, lo
+// mata. Bloquea hasta que finished se cierra o se agota la espera.
+func (f *mango) terminate(procName string, ps *Process, finished <-chan struct{}) {
+	if !osHaveSigTerm {
+		f.outletFactory.SystemOutput(fmt.Sprintf("Killing %s", procName))
+		_ = ps.Process.Kill()
+		return
+	}
+	ps.SendSigTerm()
+	select {
+	case <-finished:
+	case <-time.After(time.Duration(flagShutdownGraceTime) * time.Second):
+		f.outletFactory.SystemOutput(fmt.Sprintf("Killing %s", procName))
+		ps.SendSigKill()
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLogMaxSize  = "10M"
+	defaultLogMaxFiles = 5
+	combinedLogName    = "mango"
+)
+
+var flagLogDir string
+var flagLogCombined bool
+var flagLogMaxSize string
+var flagLogMaxAge time.Duration
+var flagLogMaxFiles int
+var flagLogCompress bool
+
+func readLogFileConfig(config Config) error {
+	var errs configErrors
+	if config["log.dir"] != "" {
+		flagLogDir = config["log.dir"]
+	}
+	if config["log.max_size"] != "" {
+		flagLogMaxSize = config["log.max_size"]
+	}
+	errs.parseBool("log.combined", config["log.combined"], &flagLogCombined)
+	errs.parseDuration("log.max_age", config["log.max_age"], &flagLogMaxAge)
+	errs.parseInt("log.max_files", config["log.max_files"], &flagLogMaxFiles)
+	errs.parseBool("log.compress", config["log.compress"], &flagLogCompress)
+	return errs.err()
+}
+
+// parseSize interpreta un tamaño en bytes con sufijo opcional K, M o G.
+func parseSize(value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	s = strings.TrimSuffix(s, "B")
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult, s = 1<<10, s[:len(s)-1]
+	case strings.HasSuffix(s, "M"):
+		mult, s = 1<<20, s[:len(s)-1]
+	case strings.HasSuffix(s, "G"):
+		mult, s = 1<<30, s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n * mult, nil
+}
+
+// LogFiles reparte la salida de las instancias en ficheros bajo dir: uno por
+// instancia (web.1.log) o, si combined, uno común (mango.log).
+type LogFiles struct {
+	dir      string
+	combined bool
+	maxSize  int64
+	maxAge   time.Duration
+	maxFiles int
+	compress bool
+
+	mu    sync.Mutex
+	files map[string]*rotatingFile
+}
+
+func NewLogFiles(dir string, combined bool, maxSize int64, maxAge time.Duration, maxFiles int, compress bool) (*LogFiles, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &LogFiles{
+		dir:      dir,
+		combined: combined,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		maxFiles: maxFiles,
+		compress: compress,
+		files:    make(map[string]*rotatingFile),
+	}, nil
+}
+
+// openFileSink abre los ficheros de log si se ha configurado log.dir.
+func openFileSink(of *OutletFactory, pf *Procfile) (LogSink, error) {
+	if flagLogDir == "" {
+		return nil, nil
+	}
+	maxSize, err := parseSize(flagLogMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	return NewLogFiles(flagLogDir, flagLogCombined, maxSize, flagLogMaxAge, flagLogMaxFiles, flagLogCompress)
+}
+
+// Send añade rec al fichero de su instancia, precedido de la hora y, en el
+// fichero común, del nombre y el stream. Los mensajes de mango sólo van al
+// fichero común.
+func (l *LogFiles) Send(rec LogRecord) {
+	name := fmt.Sprintf("%s.%d", rec.Process, rec.Instance)
+	prefix := ""
+	if l.combined {
+		name = combinedLogName
+		prefix = fmt.Sprintf("%s %s | ", rec.Name, rec.Stream)
+	} else if rec.Stream == "system" {
+		return
+	}
+
+	l.mu.Lock()
+	file, ok := l.files[name]
+	if !ok {
+		file = &rotatingFile{
+			path:     filepath.Join(l.dir, name+".log"),
+			maxSize:  l.maxSize,
+			maxAge:   l.maxAge,
+			maxFiles: l.maxFiles,
+			compress: l.compress,
+		}
+		l.files[name] = file
+	}
+	l.mu.Unlock()
+
+	stamp := rec.Time.Format("2006-01-02T15:04:05.000Z07:00")
+	// Un fallo del fichero no debe afectar al proceso.
+	file.WriteLine(stamp + " " + prefix + rec.Line + "\n")
+}
+
+// Close cierra todos los ficheros y espera a que terminen las compresiones.
+func (l *LogFiles) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, file := range l.files {
+		file.Close()
+	}
+}
+
+// rotatingFile es un fichero de log que se rota al superar maxSize bytes o
+// maxAge de antigüedad, conservando maxFiles ficheros rotados (path.1 es el
+// más reciente), opcionalmente comprimidos con gzip.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	maxFiles int
+	compress bool
+
+	mu          sync.Mutex
+	file        *os.File
+	size        int64
+	opened      time.Time
+	compressing sync.WaitGroup
+}
+
+// WriteLine añade line, que debe terminar en salto de línea.
+func (r *rotatingFile) WriteLine(line string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file != nil && r.due(int64(len(line))) {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+	n, err := r.file.WriteString(line)
+	r.size += int64(n)
+	return err
+}
+
+// due dice si hay que rotar antes de escribir n bytes más.
+func (r *rotatingFile) due(n int64) bool {
+	if r.maxSize > 0 && r.size > 0 && r.size+n > r.maxSize {
+		return true
+	}
+	return r.maxAge > 0 && time.Since(r.opened) >= r.maxAge
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.size, r.opened = file, info.Size(), time.Now()
+	if r.maxAge > 0 && info.Size() > 0 && time.Since(info.ModTime()) >= r.maxAge {
+		// Un fichero antiguo de una ejecución anterior se rota al abrirlo.
+		return r.rotate()
+	}
+	return nil
+}
+
+// rotate cierra el fichero actual y desplaza los rotados: path.1 pasa a
+// path.2 y así hasta maxFiles, borrando el más antiguo.
+func (r *rotatingFile) rotate() error {
+	r.file.Close()
+	r.file = nil
+
+	// Una compresión pendiente debe acabar antes de mover su resultado.
+	r.compressing.Wait()
+
+	ext := ""
+	if r.compress {
+		ext = ".gz"
+	}
+	rotated := func(i int) string { return fmt.Sprintf("%s.%d%s", r.path, i, ext) }
+
+	if r.maxFiles <= 0 {
+		if err := os.Remove(r.path); err != nil {
+			return err
+		}
+		return r.open()
+	}
+	os.Remove(rotated(r.maxFiles))
+	for i := r.maxFiles - 1; i >= 1; i-- {
+		os.Rename(rotated(i), rotated(i+1))
+	}
+
+	first := fmt.Sprintf("%s.1", r.path)
+	if err := os.Rename(r.path, first); err != nil {
+		return err
+	}
+	if r.compress {
+		r.compressing.Add(1)
+		go func() {
+			defer r.compressing.Done()
+			gzipFile(first)
+		}()
+	}
+	return r.open()
+}
+
+// Close cierra el fichero y espera a que acabe la compresión en curso.
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.compressing.Wait()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// gzipFile comprime path en path.gz y borra el original.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
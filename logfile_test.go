@@ -0,0 +1,107 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]int64{"0": 0, "512": 512, "10K": 10 << 10, "10m": 10 << 20, "1GB": 1 << 30}
+	for value, want := range cases {
+		if got, err := parseSize(value); err != nil || got != want {
+			t.Fatalf("parseSize(%q) = %d, %v; esperaba %d", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "diez", "-1K"} {
+		if _, err := parseSize(value); err == nil {
+			t.Fatalf("esperaba error para %q", value)
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "web.1.log")
+	r := &rotatingFile{path: path, maxSize: 20, maxFiles: 2}
+	for i := 0; i < 5; i++ {
+		if err := r.WriteLine(fmt.Sprintf("línea número %d\n", i)); err != nil {
+			t.Fatalf("WriteLine no debería fallar: %s", err)
+		}
+	}
+	r.Close()
+
+	// Cada línea supera la mitad de maxSize, así que cada una acaba en su
+	// propio fichero y sólo se conservan los dos rotados más recientes.
+	for file, want := range map[string]string{path: "4", path + ".1": "3", path + ".2": "2"} {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("esperaba el fichero %s: %s", file, err)
+		}
+		if !strings.HasSuffix(string(content), want+"\n") {
+			t.Fatalf("%s: contenido inesperado %q", file, content)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("no esperaba %s.3", path)
+	}
+}
+
+func TestRotatingFileCompress(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mango.log")
+	r := &rotatingFile{path: path, maxSize: 10, maxFiles: 3, compress: true}
+	r.WriteLine("primera línea\n")
+	r.WriteLine("segunda línea\n")
+	r.Close()
+
+	f, err := os.Open(path + ".1.gz")
+	if err != nil {
+		t.Fatalf("esperaba el fichero comprimido: %s", err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("el fichero rotado no es gzip: %s", err)
+	}
+	content, _ := io.ReadAll(zr)
+	if string(content) != "primera línea\n" {
+		t.Fatalf("contenido inesperado: %q", content)
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Fatalf("el fichero sin comprimir debería haberse borrado")
+	}
+}
+
+func TestLogFilesSend(t *testing.T) {
+	dir := t.TempDir()
+	l, err := NewLogFiles(dir, true, 0, 0, 1, false)
+	if err != nil {
+		t.Fatalf("NewLogFiles no debería fallar: %s", err)
+	}
+	l.Send(LogRecord{Time: time.Now(), Name: "web.2", Process: "web", Instance: 2, Stream: "stderr", Line: "hola mundo"})
+	l.Send(systemRecord("starting web"))
+	l.Close()
+
+	content, _ := os.ReadFile(filepath.Join(dir, "mango.log"))
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], " web.2 stderr | hola mundo") || !strings.HasSuffix(lines[1], " mango system | starting web") {
+		t.Fatalf("contenido inesperado: %q", content)
+	}
+
+	// Por instancia, los mensajes de mango no tienen fichero.
+	dir = t.TempDir()
+	l, _ = NewLogFiles(dir, false, 0, 0, 1, false)
+	l.Send(LogRecord{Time: time.Now(), Name: "web.2", Process: "web", Instance: 2, Stream: "stdout", Line: "hola"})
+	l.Send(systemRecord("starting web"))
+	l.Close()
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != "web.2.log" {
+		t.Fatalf("esperaba sólo web.2.log, obtuve %v", entries)
+	}
+}
@@ -2,158 +2,434 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"os"
+	"regexp"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 )
 
-// Estructuras para el payload de push
-type pushRequest struct {
-	Streams []stream `json:"streams"`
+var flagLokiBatchSize int
+var flagLokiBatchWait time.Duration
+var flagLokiQueueSize int
+var flagLokiDrop string
+var flagLokiBackoff time.Duration
+var flagLokiBackoffMax time.Duration
+var flagLokiRetryFor time.Duration
+var flagLokiSpoolDir string
+var flagLokiSpoolMaxSize string
+var flagLokiTenant string
+var flagLokiUsername string
+var flagLokiPassword string
+var flagLokiBearerToken string
+var flagLokiBearerTokenFile string
+var flagLokiCAFile string
+var flagLokiCertFile string
+var flagLokiKeyFile string
+var flagLokiInsecureSkipVerify bool
+var flagLokiLabels string
+var flagLokiDynamicLabels string
+var flagLokiFormat string
+
+// lokiLabelNameRegexp son los nombres de etiqueta que admite Loki; los que
+// empiezan por "__" están reservados.
+var lokiLabelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// lokiDynamicLabels son las etiquetas que mango puede añadir a cada stream a
+// partir de la instancia que escribe la línea.
+var lokiDynamicLabels = []string{"process", "instance", "stream", "pid"}
+
+// lokiAuthSettings son los ajustes de autenticación y TLS, que además de en
+// .mango pueden darse en variables de entorno (loki.ca_file en
+// MANGO_LOKI_CA_FILE) para no guardar credenciales en el repositorio. El
+// entorno tiene prioridad sobre .mango, y los flags sobre ambos.
+var lokiAuthSettings = map[string]*string{
+	"loki.tenant":            &flagLokiTenant,
+	"loki.username":          &flagLokiUsername,
+	"loki.password":          &flagLokiPassword,
+	"loki.bearer_token":      &flagLokiBearerToken,
+	"loki.bearer_token_file": &flagLokiBearerTokenFile,
+	"loki.ca_file":           &flagLokiCAFile,
+	"loki.cert_file":         &flagLokiCertFile,
+	"loki.key_file":          &flagLokiKeyFile,
 }
 
-type stream struct {
-	Stream map[string]string `json:"stream"`
-	Values [][]string        `json:"values"`
+// settingEnv devuelve la variable de entorno de un ajuste de .mango.
+func settingEnv(key string) string {
+	return "MANGO_" + strings.ToUpper(strings.NewReplacer(".", "_").Replace(key))
 }
 
-type LokiClient struct {
-	endpoint   string
-	httpClient *http.Client
+func readLokiConfig(config Config) error {
+	var errs configErrors
+	if config["loki.drop"] != "" {
+		flagLokiDrop = config["loki.drop"]
+	}
+	if config["loki.spool_dir"] != "" {
+		flagLokiSpoolDir = config["loki.spool_dir"]
+	}
+	if config["loki.spool_max_size"] != "" {
+		flagLokiSpoolMaxSize = config["loki.spool_max_size"]
+	}
+	if config["loki.labels"] != "" {
+		flagLokiLabels = config["loki.labels"]
+	}
+	if config["loki.dynamic_labels"] != "" {
+		flagLokiDynamicLabels = config["loki.dynamic_labels"]
+	}
+	if config["loki.format"] != "" {
+		flagLokiFormat = config["loki.format"]
+	}
+	for key, value := range lokiAuthSettings {
+		if env := os.Getenv(settingEnv(key)); env != "" {
+			*value = env
+		} else if config[key] != "" {
+			*value = config[key]
+		}
+	}
+	insecure := os.Getenv(settingEnv("loki.insecure_skip_verify"))
+	if insecure == "" {
+		insecure = config["loki.insecure_skip_verify"]
+	}
+	errs.parseBool("loki.insecure_skip_verify", insecure, &flagLokiInsecureSkipVerify)
+	for key, value := range map[string]*int{
+		"loki.batch_size": &flagLokiBatchSize,
+		"loki.queue_size": &flagLokiQueueSize,
+	} {
+		errs.parseInt(key, config[key], value)
+	}
+	for key, value := range map[string]*time.Duration{
+		"loki.batch_wait":    &flagLokiBatchWait,
+		"loki.backoff":       &flagLokiBackoff,
+		"loki.backoff_max":   &flagLokiBackoffMax,
+		"loki.retry_timeout": &flagLokiRetryFor,
+	} {
+		errs.parseDuration(key, config[key], value)
+	}
+	return errs.err()
+}
 
-	// Campos para el manejo de lotes
-	batchInterval time.Duration
-	batchSize     int
-	mu            sync.Mutex // Para asegurar concurrencia segura en el acceso a los buffers
+// parseLokiLabels interpreta una lista de etiquetas "name=value,..."; los
+// valores pueden usar variables de entorno, como host=$HOSTNAME.
+// $HOSTNAME vale el nombre de la máquina aunque el shell no lo exporte.
+func parseLokiLabels(value string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, val, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok {
+			return nil, fmt.Errorf("invalid label %q (want name=value)", pair)
+		}
+		if err := validLokiLabelName(name); err != nil {
+			return nil, err
+		}
+		labels[name] = os.Expand(strings.TrimSpace(val), expandLabelVar)
+	}
+	return labels, nil
+}
 
-	streams map[string]*stream // Buffer para los logs antes de ser enviados
+func expandLabelVar(name string) string {
+	value := os.Getenv(name)
+	if value == "" && name == "HOSTNAME" {
+		value, _ = os.Hostname()
+	}
+	return value
+}
 
-	stop chan struct{} // Canal para detener el worker
+func validLokiLabelName(name string) error {
+	if !lokiLabelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") {
+		return fmt.Errorf("invalid label name %q", name)
+	}
+	return nil
 }
 
-func NewLokiClient(endpoint string, timeout, batchInterval time.Duration, batchSize int) *LokiClient {
-	c := &LokiClient{
-		endpoint: endpoint,
-		httpClient: &http.Client{
-			Timeout: timeout,
-		},
-		batchInterval: batchInterval,
-		batchSize:     batchSize,
-		streams:       make(map[string]*stream),
-		stop:          make(chan struct{}),
+// parseLokiDynamicLabels interpreta la lista de etiquetas dinámicas.
+func parseLokiDynamicLabels(value string) ([]string, error) {
+	var labels []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		known := false
+		for _, label := range lokiDynamicLabels {
+			known = known || name == label
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown dynamic label %q (want %s)", name, strings.Join(lokiDynamicLabels, ", "))
+		}
+		labels = append(labels, name)
 	}
+	return labels, nil
+}
 
-	// Iniciar el worker en segundo plano
-	go c.startWorker()
+// LokiOptions dice a qué Loki enviar y cómo autenticarse.
+type LokiOptions struct {
+	URL     string
+	Job     string
+	Timeout time.Duration
 
-	return c
+	// Format es la codificación de los envíos: lokiFormatJSON,
+	// lokiFormatJSONGzip o lokiFormatProtobuf.
+	Format string
+
+	// Tenant va en la cabecera X-Scope-OrgID.
+	Tenant string
+
+	// Username y Password para autenticación básica, o un token Bearer,
+	// directamente o leído de BearerTokenFile en cada envío para seguir
+	// sus rotaciones.
+	Username        string
+	Password        string
+	BearerToken     string
+	BearerTokenFile string
+
+	TLS *tls.Config
+
+	// Labels son las etiquetas comunes a todos los streams, y
+	// ProcessLabels las de cada entrada del Procfile, que tienen prioridad.
+	// DynamicLabels nombra las que se toman de cada línea (process,
+	// instance, stream o pid); sin ninguna, stream es el nombre de la
+	// instancia, como web.1.
+	Labels        map[string]string
+	ProcessLabels map[string]map[string]string
+	DynamicLabels []string
+
+	// LevelAs dice si el nivel de cada línea va como etiqueta
+	// (levelAsLabel) o como structured metadata (levelAsMetadata).
+	LevelAs string
 }
 
-// startWorker gestiona el envío periódico de los logs acumulados.
-func (c *LokiClient) startWorker() {
-	ticker := time.NewTicker(c.batchInterval)
-	defer ticker.Stop()
+type LokiClient struct {
+	opts       LokiOptions
+	httpClient *http.Client
+
+	// El batcher acumula las líneas y las envía en lotes, con reintentos.
+	batcher *batcher
+}
 
-	for {
-		select {
-		case <-ticker.C:
-			c.Flush()
-		case <-c.stop:
-			// Al detenerse, se envía el último lote de logs
-			c.Flush()
-			return
+func NewLokiClient(opts LokiOptions, cfg batchConfig, logf func(msg string)) *LokiClient {
+	c := &LokiClient{
+		opts:       opts,
+		httpClient: newHTTPClient(opts.Timeout, opts.TLS),
+	}
+	if cfg.Spool != nil && cfg.Ready == nil {
+		cfg.Ready = func() bool { return c.WaitReady(1, 2*time.Second) == nil }
+	}
+	c.batcher = newBatcher("loki", cfg, c.push, logf)
+	return c
+}
+
+// authorize añade a req las cabeceras de tenant y autenticación.
+func (c *LokiClient) authorize(req *http.Request) error {
+	if c.opts.Tenant != "" {
+		req.Header.Set("X-Scope-OrgID", c.opts.Tenant)
+	}
+	token := c.opts.BearerToken
+	if c.opts.BearerTokenFile != "" {
+		content, err := os.ReadFile(c.opts.BearerTokenFile)
+		if err != nil {
+			return err
 		}
+		token = strings.TrimSpace(string(content))
+	}
+	switch {
+	case token != "":
+		req.Header.Set("Authorization", "Bearer "+token)
+	case c.opts.Username != "":
+		req.SetBasicAuth(c.opts.Username, c.opts.Password)
 	}
+	return nil
 }
 
-// PushLog recibe una línea de log y las etiquetas, y la añade al buffer.
-func (c *LokiClient) Send(job, streamName, line string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// newHTTPClient devuelve un cliente HTTP con timeout y, si no es nil, la
+// configuración TLS dada.
+func newHTTPClient(timeout time.Duration, config *tls.Config) *http.Client {
+	client := &http.Client{Timeout: timeout}
+	if config != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config
+		client.Transport = transport
+	}
+	return client
+}
 
-	key := fmt.Sprintf("%s-%s", job, streamName)
-	if _, ok := c.streams[key]; !ok {
-		c.streams[key] = &stream{
-			Stream: map[string]string{
-				"job":    job,
-				"stream": streamName,
-			},
-			Values: make([][]string, 0, c.batchSize),
+// loadTLSConfig construye la configuración TLS de un cliente: caFile añade
+// una CA a las del sistema, certFile y keyFile son el certificado de
+// cliente. Devuelve nil si no hay nada que configurar.
+func loadTLSConfig(caFile, certFile, keyFile string, insecure bool) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" && !insecure {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
 		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", caFile)
+		}
+		config.RootCAs = pool
 	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("a client certificate needs both a cert and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
 
-	ts := strconv.FormatInt(time.Now().UnixNano(), 10)
-	c.streams[key].Values = append(c.streams[key].Values, []string{ts, line})
+// Send añade rec a la cola de envío sin esperar a Loki.
+func (c *LokiClient) Send(rec LogRecord) {
+	c.batcher.Add(rec)
+}
 
-	// Si se alcanza el tamaño de lote, se envía
-	if len(c.streams[key].Values) >= c.batchSize {
-		c.Flush()
+// labels devuelve las etiquetas del stream al que pertenece rec.
+func (c *LokiClient) labels(rec LogRecord) map[string]string {
+	labels := map[string]string{"job": c.opts.Job}
+	for name, value := range c.opts.Labels {
+		labels[name] = value
 	}
+	if len(c.opts.DynamicLabels) == 0 {
+		labels["stream"] = rec.Name
+	}
+	for _, name := range c.opts.DynamicLabels {
+		switch name {
+		case "process":
+			labels[name] = rec.Process
+		case "instance":
+			if rec.Instance > 0 {
+				labels[name] = strconv.Itoa(rec.Instance)
+			}
+		case "stream":
+			labels[name] = rec.Stream
+		case "pid":
+			if rec.Pid > 0 {
+				labels[name] = strconv.Itoa(rec.Pid)
+			}
+		}
+	}
+	if c.opts.LevelAs == levelAsLabel && rec.Level != "" {
+		labels["level"] = rec.Level
+	}
+	for name, value := range c.opts.ProcessLabels[rec.Process] {
+		labels[name] = value
+	}
+	// Loki no admite etiquetas vacías.
+	for name, value := range labels {
+		if value == "" {
+			delete(labels, name)
+		}
+	}
+	return labels
 }
 
-// Flush envía los logs acumulados a Loki.
-func (c *LokiClient) Flush() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	if len(c.streams) == 0 {
-		return
+// streamKey identifica un conjunto de etiquetas, como {a="1", b="2"}.
+func streamKey(labels map[string]string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range sortedKeys(labels) {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s=%q", name, labels[name])
 	}
+	b.WriteByte('}')
+	return b.String()
+}
 
-	var streamsToSend []stream
-	for _, s := range c.streams {
-		streamsToSend = append(streamsToSend, *s)
+// streams agrupa batch por conjunto de etiquetas, en el orden en que aparece
+// cada uno.
+func (c *LokiClient) streams(batch []LogRecord) []lokiStream {
+	index := make(map[string]int)
+	var streams []lokiStream
+	for _, rec := range batch {
+		labels := c.labels(rec)
+		key := streamKey(labels)
+		i, ok := index[key]
+		if !ok {
+			i = len(streams)
+			index[key] = i
+			streams = append(streams, lokiStream{Key: key, Labels: labels})
+		}
+		entry := lokiEntry{Time: rec.Time, Line: rec.Line}
+		if c.opts.LevelAs == levelAsMetadata && rec.Level != "" {
+			entry.Metadata = map[string]string{"level": rec.Level}
+		}
+		streams[i].Entries = append(streams[i].Entries, entry)
 	}
+	return streams
+}
 
-	reqBody := pushRequest{Streams: streamsToSend}
-	jsonBytes, err := json.Marshal(reqBody)
+// push envía un lote a Loki, con un stream por conjunto de etiquetas.
+func (c *LokiClient) push(batch []LogRecord) error {
+	body, err := encodeLokiPush(c.opts.Format, c.streams(batch))
 	if err != nil {
-		fmt.Printf("Error marshaling push request: %v\n", err)
-		return
+		return &pushError{err: fmt.Errorf("encoding push request: %v", err)}
 	}
 
-	req, err := http.NewRequest("POST", c.endpoint, bytes.NewBuffer(jsonBytes))
+	req, err := http.NewRequest("POST", c.opts.URL, bytes.NewReader(body.data))
 	if err != nil {
-		fmt.Printf("Error building HTTP request: %v\n", err)
-		return
+		return &pushError{err: err}
+	}
+	req.Header.Set("Content-Type", body.contentType)
+	if body.contentEncoding != "" {
+		req.Header.Set("Content-Encoding", body.contentEncoding)
+	}
+	if err := c.authorize(req); err != nil {
+		return &pushError{err: err}
 	}
-	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		fmt.Printf("Error sending to Loki: %v\n", err)
-		return
+		return err
 	}
 	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
-		fmt.Printf("Unexpected status code from Loki: %d\n", resp.StatusCode)
-	}
-
-	// Reiniciar el buffer después de un envío exitoso o fallido
-	c.streams = make(map[string]*stream)
+	io.Copy(io.Discard, resp.Body)
+	return responseError(resp)
 }
 
-// Close detiene el worker de fondo y envía cualquier log pendiente.
+// Close envía lo pendiente e informa de las líneas que se hayan perdido.
 func (c *LokiClient) Close() {
-	close(c.stop)
+	c.batcher.Close()
 }
 
 // WaitReady intenta hacer GET al endpoint /ready hasta maxRetries veces,
 // pausando "interval" entre cada intento, y retorna error si no obtiene 200 OK.
+// Con un spool, el cliente lo usa además para saber cuándo reenviarlo.
 func (c *LokiClient) WaitReady(maxRetries int, interval time.Duration) error {
-	readyURL := c.endpoint
-	if u, err := url.Parse(c.endpoint); err == nil {
+	readyURL := c.opts.URL
+	if u, err := url.Parse(c.opts.URL); err == nil {
 		u.Path = "/ready"
 		readyURL = u.String()
 	}
-	client := &http.Client{Timeout: interval}
+	client := &http.Client{Timeout: interval, Transport: c.httpClient.Transport}
 	for i := 0; i < maxRetries; i++ {
-		resp, err := client.Get(readyURL)
+		req, err := http.NewRequest("GET", readyURL, nil)
+		if err != nil {
+			return err
+		}
+		if err := c.authorize(req); err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
 		if err == nil && resp.StatusCode == http.StatusOK {
 			resp.Body.Close()
 			return nil
@@ -161,7 +437,125 @@ func (c *LokiClient) WaitReady(maxRetries int, interval time.Duration) error {
 		if resp != nil {
 			resp.Body.Close()
 		}
-		time.Sleep(interval)
+		if i < maxRetries-1 {
+			time.Sleep(interval)
+		}
 	}
 	return fmt.Errorf("loki no respondió en %s tras %d intentos", readyURL, maxRetries)
 }
+
+// lokiSink adapta LokiClient a LogSink: cada instancia es un stream.
+type lokiSink struct {
+	client *LokiClient
+	parser *LogParser // nil si no se extrae nada de las líneas
+}
+
+// openLokiSink inicializa el cliente de Loki, si se ha configurado loki.url,
+// y espera a que esté listo antes de continuar.
+func openLokiSink(of *OutletFactory, pf *Procfile) (LogSink, error) {
+	if flagLokiURL == "" {
+		return nil, nil
+	}
+	format, err := parseLokiFormat(flagLokiFormat)
+	if err != nil {
+		return nil, err
+	}
+	labels, err := parseLokiLabels(flagLokiLabels)
+	if err != nil {
+		return nil, err
+	}
+	if flagLokiLevelAs != levelAsLabel && flagLokiLevelAs != levelAsMetadata {
+		return nil, fmt.Errorf("invalid loki.level_as %q (want %s or %s)", flagLokiLevelAs, levelAsLabel, levelAsMetadata)
+	}
+	parser, err := NewLogParser(flagLokiParse, flagLokiLevelField, flagLokiTimeField, flagLokiTimeFormat, flagLokiUseTimestamp, lokiRegexRules)
+	if err != nil {
+		return nil, err
+	}
+	for name := range lokiRegexRules {
+		if !pf.HasProcess(name) {
+			return nil, fmt.Errorf("%s%s: no such process", lokiRegexPrefix, name)
+		}
+	}
+	dynamicLabels, err := parseLokiDynamicLabels(flagLokiDynamicLabels)
+	if err != nil {
+		return nil, err
+	}
+	processLabels := make(map[string]map[string]string)
+	for _, entry := range pf.Entries {
+		if len(entry.Labels) > 0 {
+			processLabels[entry.Name] = entry.Labels
+		}
+	}
+	drop, err := parseDropPolicy(flagLokiDrop)
+	if err != nil {
+		return nil, err
+	}
+	if flagLokiBatchSize <= 0 || flagLokiBatchWait <= 0 {
+		return nil, fmt.Errorf("loki.batch_size and loki.batch_wait must be positive")
+	}
+	cfg := batchConfig{
+		Size:       flagLokiBatchSize,
+		Interval:   flagLokiBatchWait,
+		QueueSize:  flagLokiQueueSize,
+		Drop:       drop,
+		Backoff:    flagLokiBackoff,
+		BackoffMax: flagLokiBackoffMax,
+		RetryFor:   flagLokiRetryFor,
+	}
+	if flagLokiSpoolDir != "" {
+		maxSize, err := parseSize(flagLokiSpoolMaxSize)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Spool, err = openSpool(flagLokiSpoolDir, maxSize); err != nil {
+			return nil, err
+		}
+	}
+	tlsConfig, err := loadTLSConfig(flagLokiCAFile, flagLokiCertFile, flagLokiKeyFile, flagLokiInsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	opts := LokiOptions{
+		URL:             flagLokiURL,
+		Job:             flagLokiJob,
+		Timeout:         10 * time.Second,
+		Format:          format,
+		Tenant:          flagLokiTenant,
+		Username:        flagLokiUsername,
+		Password:        flagLokiPassword,
+		BearerToken:     flagLokiBearerToken,
+		BearerTokenFile: flagLokiBearerTokenFile,
+		TLS:             tlsConfig,
+		Labels:          labels,
+		ProcessLabels:   processLabels,
+		DynamicLabels:   dynamicLabels,
+		LevelAs:         flagLokiLevelAs,
+	}
+	client := NewLokiClient(opts, cfg, of.SystemOutput)
+	of.SystemOutput(fmt.Sprintf("Loki habilitado: %s (job=%s)", flagLokiURL, flagLokiJob))
+
+	// Espera readiness
+	of.SystemOutput("Esperando a que Loki esté listo...")
+	if err := client.WaitReady(10, 1*time.Second); err != nil {
+		of.SystemOutput("Aviso: no se pudo verificar readiness de Loki: " + err.Error())
+	} else {
+		of.SystemOutput("Loki está listo")
+	}
+	if cfg.Spool != nil {
+		if n := cfg.Spool.Pending(); n > 0 {
+			of.SystemOutput(fmt.Sprintf("loki: %d spooled lines from a previous run will be sent first", n))
+		}
+	}
+	return &lokiSink{client: client, parser: parser}, nil
+}
+
+func (s *lokiSink) Send(rec LogRecord) {
+	if s.parser != nil {
+		s.parser.Process(&rec)
+	}
+	s.client.Send(rec)
+}
+
+func (s *lokiSink) Close() {
+	s.client.Close()
+}
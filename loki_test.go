@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLokiClientAuthorize(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(tokenFile, []byte("from-file\n"), 0600)
+
+	tests := []struct {
+		opts   LokiOptions
+		tenant string
+		auth   string
+	}{
+		{LokiOptions{}, "", ""},
+		{LokiOptions{Tenant: "team-a"}, "team-a", ""},
+		{LokiOptions{Username: "user", Password: "secret"}, "", "Basic dXNlcjpzZWNyZXQ="},
+		{LokiOptions{BearerToken: "abc"}, "", "Bearer abc"},
+		{LokiOptions{BearerToken: "abc", BearerTokenFile: tokenFile}, "", "Bearer from-file"},
+	}
+	for _, test := range tests {
+		c := &LokiClient{opts: test.opts}
+		req, _ := http.NewRequest("POST", "http://loki/push", nil)
+		if err := c.authorize(req); err != nil {
+			t.Fatalf("%+v: error inesperado: %v", test.opts, err)
+		}
+		if got := req.Header.Get("X-Scope-OrgID"); got != test.tenant {
+			t.Errorf("%+v: X-Scope-OrgID = %q, se esperaba %q", test.opts, got, test.tenant)
+		}
+		if got := req.Header.Get("Authorization"); got != test.auth {
+			t.Errorf("%+v: Authorization = %q, se esperaba %q", test.opts, got, test.auth)
+		}
+	}
+
+	c := &LokiClient{opts: LokiOptions{BearerTokenFile: filepath.Join(t.TempDir(), "missing")}}
+	req, _ := http.NewRequest("POST", "http://loki/push", nil)
+	if err := c.authorize(req); err == nil {
+		t.Error("se esperaba un error con un fichero de token inexistente")
+	}
+}
+
+func TestLokiClientTLS(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := loadTLSConfig(caFile, "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewLokiClient(LokiOptions{
+		URL:     srv.URL,
+		Job:     "test",
+		Timeout: time.Second,
+		Tenant:  "team-a",
+	}, testBatchConfig(), func(string) {})
+	if err := c.push([]LogRecord{{Time: time.Now(), Name: "web.1", Line: "hola"}}); err == nil {
+		t.Error("se esperaba un error sin la CA del servidor")
+	}
+
+	c = NewLokiClient(LokiOptions{
+		URL:     srv.URL,
+		Job:     "test",
+		Timeout: time.Second,
+		Tenant:  "team-a",
+		TLS:     tlsConfig,
+	}, testBatchConfig(), func(string) {})
+	defer c.Close()
+	if err := c.push([]LogRecord{{Time: time.Now(), Name: "web.1", Line: "hola"}}); err != nil {
+		t.Fatalf("error inesperado: %v", err)
+	}
+	if r := <-received; r.Header.Get("X-Scope-OrgID") != "team-a" {
+		t.Errorf("X-Scope-OrgID = %q, se esperaba team-a", r.Header.Get("X-Scope-OrgID"))
+	}
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	if config, err := loadTLSConfig("", "", "", false); config != nil || err != nil {
+		t.Errorf("sin opciones: %v, %v; se esperaba nil", config, err)
+	}
+	if config, err := loadTLSConfig("", "", "", true); err != nil || !config.InsecureSkipVerify {
+		t.Errorf("insecure: %v, %v", config, err)
+	}
+	if _, err := loadTLSConfig("", "cert.pem", "", false); err == nil {
+		t.Error("se esperaba un error con certificado sin clave")
+	}
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(empty, nil, 0644)
+	if _, err := loadTLSConfig(empty, "", "", false); err == nil {
+		t.Error("se esperaba un error con una CA sin certificados")
+	}
+}
+
+func TestReadLokiConfigEnv(t *testing.T) {
+	defer func(tenant, token string) {
+		flagLokiTenant, flagLokiBearerToken = tenant, token
+	}(flagLokiTenant, flagLokiBearerToken)
+
+	t.Setenv("MANGO_LOKI_BEARER_TOKEN", "from-env")
+	err := readLokiConfig(Config{"loki.tenant": "team-a", "loki.bearer_token": "from-config"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flagLokiTenant != "team-a" {
+		t.Errorf("flagLokiTenant = %q, se esperaba team-a", flagLokiTenant)
+	}
+	if flagLokiBearerToken != "from-env" {
+		t.Errorf("flagLokiBearerToken = %q, se esperaba from-env", flagLokiBearerToken)
+	}
+}
+
+func TestParseLokiLabels(t *testing.T) {
+	t.Setenv("MANGO_TEST_HOST", "box1")
+	labels, err := parseLokiLabels("env=dev, host=$MANGO_TEST_HOST,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"env": "dev", "host": "box1"}
+	if !reflect.DeepEqual(labels, want) {
+		t.Errorf("etiquetas = %v, se esperaba %v", labels, want)
+	}
+	t.Setenv("HOSTNAME", "")
+	hostname, _ := os.Hostname()
+	if labels, _ := parseLokiLabels("host=$HOSTNAME"); labels["host"] != hostname {
+		t.Errorf("host = %q, se esperaba el nombre de la máquina %q", labels["host"], hostname)
+	}
+	for _, value := range []string{"env", "1env=dev", "__name__=x", "a-b=c"} {
+		if _, err := parseLokiLabels(value); err == nil {
+			t.Errorf("%q: se esperaba un error", value)
+		}
+	}
+	if _, err := parseLokiDynamicLabels("process,pid,host"); err == nil {
+		t.Error("se esperaba un error con una etiqueta dinámica desconocida")
+	}
+}
+
+func TestLokiClientLabels(t *testing.T) {
+	received := make(chan pushRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req pushRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		received <- req
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	c := NewLokiClient(LokiOptions{
+		URL:           srv.URL,
+		Job:           "test",
+		Timeout:       time.Second,
+		Labels:        map[string]string{"env": "dev", "tier": "default"},
+		ProcessLabels: map[string]map[string]string{"web": {"tier": "front"}},
+		DynamicLabels: []string{"process", "instance", "stream"},
+	}, testBatchConfig(), func(string) {})
+	defer c.Close()
+
+	now := time.Now()
+	err := c.push([]LogRecord{
+		{Time: now, Name: "web.1", Process: "web", Instance: 1, Stream: "stdout", Line: "a"},
+		{Time: now, Name: "web.1", Process: "web", Instance: 1, Stream: "stderr", Line: "b"},
+		{Time: now, Name: "web.1", Process: "web", Instance: 1, Stream: "stdout", Line: "c"},
+		{Time: now, Name: "worker.2", Process: "worker", Instance: 2, Stream: "stdout", Line: "d"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := <-received
+	want := []map[string]string{
+		{"job": "test", "env": "dev", "tier": "front", "process": "web", "instance": "1", "stream": "stdout"},
+		{"job": "test", "env": "dev", "tier": "front", "process": "web", "instance": "1", "stream": "stderr"},
+		{"job": "test", "env": "dev", "tier": "default", "process": "worker", "instance": "2", "stream": "stdout"},
+	}
+	if len(req.Streams) != len(want) {
+		t.Fatalf("%d streams, se esperaban %d: %+v", len(req.Streams), len(want), req.Streams)
+	}
+	for i, s := range req.Streams {
+		if !reflect.DeepEqual(s.Stream, want[i]) {
+			t.Errorf("stream %d: etiquetas %v, se esperaba %v", i, s.Stream, want[i])
+		}
+	}
+	if len(req.Streams[0].Values) != 2 {
+		t.Errorf("el primer stream tiene %d líneas, se esperaban 2", len(req.Streams[0].Values))
+	}
+}
+
+func TestLokiClientLevel(t *testing.T) {
+	batch := []LogRecord{
+		{Name: "web.1", Process: "web", Instance: 1, Stream: "stdout", Line: "a", Level: "error"},
+		{Name: "web.1", Process: "web", Instance: 1, Stream: "stdout", Line: "b"},
+	}
+
+	c := &LokiClient{opts: LokiOptions{Job: "test", LevelAs: levelAsLabel}}
+	streams := c.streams(batch)
+	if len(streams) != 2 || streams[0].Key != `{job="test", level="error", stream="web.1"}` || streams[1].Key != `{job="test", stream="web.1"}` {
+		t.Errorf("con etiqueta: %+v", streams)
+	}
+
+	c = &LokiClient{opts: LokiOptions{Job: "test", LevelAs: levelAsMetadata}}
+	streams = c.streams(batch)
+	if len(streams) != 1 {
+		t.Fatalf("con metadata: %d streams, se esperaba 1", len(streams))
+	}
+	if got := streams[0].Entries[0].Metadata; !reflect.DeepEqual(got, map[string]string{"level": "error"}) {
+		t.Errorf("metadata %v, se esperaba level=error", got)
+	}
+	if got := streams[0].Entries[1].Metadata; got != nil {
+		t.Errorf("metadata %v, se esperaba nil", got)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// Codificaciones de los envíos a Loki.
+const (
+	lokiFormatJSON     = "json"      // JSON sin comprimir
+	lokiFormatJSONGzip = "json+gzip" // JSON con Content-Encoding: gzip
+	lokiFormatProtobuf = "protobuf"  // PushRequest de Loki comprimido con snappy
+)
+
+func parseLokiFormat(value string) (string, error) {
+	switch value {
+	case "", lokiFormatJSON:
+		return lokiFormatJSON, nil
+	case lokiFormatJSONGzip, lokiFormatProtobuf:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid Loki format %q (want %s, %s or %s)", value, lokiFormatJSON, lokiFormatJSONGzip, lokiFormatProtobuf)
+}
+
+// lokiStream son las líneas de un lote con las mismas etiquetas; Key son las
+// etiquetas en el formato de Loki, como {job="app", stream="web.1"}.
+type lokiStream struct {
+	Key     string
+	Labels  map[string]string
+	Entries []lokiEntry
+}
+
+type lokiEntry struct {
+	Time time.Time
+	Line string
+
+	// Metadata es la structured metadata de la línea.
+	Metadata map[string]string
+}
+
+// lokiBody es un envío codificado.
+type lokiBody struct {
+	data            []byte
+	contentType     string
+	contentEncoding string
+}
+
+// Estructuras para el payload de push
+type pushRequest struct {
+	Streams []stream `json:"streams"`
+}
+
+// Cada valor es [timestamp, línea] o [timestamp, línea, metadata].
+type stream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][]interface{}   `json:"values"`
+}
+
+// encodeLokiPush codifica streams en el formato indicado.
+func encodeLokiPush(format string, streams []lokiStream) (lokiBody, error) {
+	if format == lokiFormatProtobuf {
+		// Loki espera el cuerpo comprimido con snappy, sin Content-Encoding.
+		return lokiBody{
+			data:        snappy.Encode(nil, encodeLokiProtobuf(streams)),
+			contentType: "application/x-protobuf",
+		}, nil
+	}
+
+	var reqBody pushRequest
+	for _, s := range streams {
+		values := make([][]interface{}, 0, len(s.Entries))
+		for _, entry := range s.Entries {
+			value := []interface{}{strconv.FormatInt(entry.Time.UnixNano(), 10), entry.Line}
+			if len(entry.Metadata) > 0 {
+				value = append(value, entry.Metadata)
+			}
+			values = append(values, value)
+		}
+		reqBody.Streams = append(reqBody.Streams, stream{Stream: s.Labels, Values: values})
+	}
+	data, err := json.Marshal(reqBody)
+	if err != nil {
+		return lokiBody{}, err
+	}
+	if format != lokiFormatJSONGzip {
+		return lokiBody{data: data, contentType: "application/json"}, nil
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return lokiBody{}, err
+	}
+	if err := zw.Close(); err != nil {
+		return lokiBody{}, err
+	}
+	return lokiBody{data: buf.Bytes(), contentType: "application/json", contentEncoding: "gzip"}, nil
+}
+
+// encodeLokiProtobuf codifica streams como el mensaje logproto.PushRequest de
+// Loki:
+//
+//	message PushRequest { repeated Stream streams = 1; }
+//	message Stream { string labels = 1; repeated Entry entries = 2; }
+//	message Entry {
+//	  google.protobuf.Timestamp timestamp = 1;
+//	  string line = 2;
+//	  repeated LabelPair structuredMetadata = 3;
+//	}
+//	message Timestamp { int64 seconds = 1; int32 nanos = 2; }
+//	message LabelPair { string name = 1; string value = 2; }
+func encodeLokiProtobuf(streams []lokiStream) []byte {
+	// ts, e y msg se reutilizan entre entradas y streams.
+	var req, msg, e, ts, pair []byte
+	for _, s := range streams {
+		msg = appendProtoBytes(msg[:0], 1, []byte(s.Key))
+		for _, entry := range s.Entries {
+			ts = ts[:0]
+			if secs := entry.Time.Unix(); secs != 0 {
+				ts = appendProtoVarint(ts, 1, uint64(secs))
+			}
+			if nanos := entry.Time.Nanosecond(); nanos != 0 {
+				ts = appendProtoVarint(ts, 2, uint64(nanos))
+			}
+			e = appendProtoBytes(e[:0], 1, ts)
+			e = appendProtoBytes(e, 2, []byte(entry.Line))
+			for _, name := range sortedKeys(entry.Metadata) {
+				pair = appendProtoBytes(pair[:0], 1, []byte(name))
+				pair = appendProtoBytes(pair, 2, []byte(entry.Metadata[name]))
+				e = appendProtoBytes(e, 3, pair)
+			}
+			msg = appendProtoBytes(msg, 2, e)
+		}
+		req = appendProtoBytes(req, 1, msg)
+	}
+	return req
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+func testLokiStreams() []lokiStream {
+	return []lokiStream{
+		{
+			Key:    `{job="app", stream="web.1"}`,
+			Labels: map[string]string{"job": "app", "stream": "web.1"},
+			Entries: []lokiEntry{
+				{Time: time.Unix(1700000000, 123), Line: "GET / 200"},
+				{Time: time.Unix(1700000001, 0), Line: "GET /favicon.ico 404", Metadata: map[string]string{"level": "warn"}},
+			},
+		},
+		{
+			Key:     `{job="app", stream="worker.1"}`,
+			Labels:  map[string]string{"job": "app", "stream": "worker.1"},
+			Entries: []lokiEntry{{Time: time.Unix(1700000002, 5), Line: "job done"}},
+		},
+	}
+}
+
+func TestEncodeLokiPushJSON(t *testing.T) {
+	want := pushRequest{Streams: []stream{
+		{Stream: map[string]string{"job": "app", "stream": "web.1"}, Values: [][]interface{}{
+			{"1700000000000000123", "GET / 200"},
+			{"1700000001000000000", "GET /favicon.ico 404", map[string]interface{}{"level": "warn"}},
+		}},
+		{Stream: map[string]string{"job": "app", "stream": "worker.1"}, Values: [][]interface{}{
+			{"1700000002000000005", "job done"},
+		}},
+	}}
+
+	for _, format := range []string{lokiFormatJSON, lokiFormatJSONGzip} {
+		body, err := encodeLokiPush(format, testLokiStreams())
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := body.data
+		if format == lokiFormatJSONGzip {
+			if body.contentEncoding != "gzip" {
+				t.Errorf("%s: Content-Encoding = %q, se esperaba gzip", format, body.contentEncoding)
+			}
+			zr, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, err = io.ReadAll(zr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var got pushRequest
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: %+v, se esperaba %+v", format, got, want)
+		}
+	}
+}
+
+// protoFields lee los campos de un mensaje protobuf como número de campo y
+// valor: los varint y fixed64 como uint64 y los de longitud como []byte.
+func protoFields(t *testing.T, b []byte) (fields []int, values []interface{}) {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("clave inválida en %x", b)
+		}
+		b = b[n:]
+		fields = append(fields, int(key>>3))
+		switch key & 7 {
+		case protoVarint:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatalf("varint inválido en %x", b)
+			}
+			values, b = append(values, v), b[n:]
+		case protoFixed64:
+			if len(b) < 8 {
+				t.Fatalf("fixed64 inválido en %x", b)
+			}
+			values, b = append(values, binary.LittleEndian.Uint64(b)), b[8:]
+		case protoBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				t.Fatalf("longitud inválida en %x", b)
+			}
+			values, b = append(values, b[n:n+int(l)]), b[n+int(l):]
+		default:
+			t.Fatalf("tipo de campo inesperado %d", key&7)
+		}
+	}
+	return fields, values
+}
+
+func TestEncodeLokiPushProtobuf(t *testing.T) {
+	body, err := encodeLokiPush(lokiFormatProtobuf, testLokiStreams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body.contentType != "application/x-protobuf" || body.contentEncoding != "" {
+		t.Errorf("cabeceras %q, %q", body.contentType, body.contentEncoding)
+	}
+	data, err := snappy.Decode(nil, body.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	fields, values := protoFields(t, data)
+	for i := range fields {
+		if fields[i] != 1 {
+			t.Fatalf("PushRequest: campo %d inesperado", fields[i])
+		}
+		sfields, svalues := protoFields(t, values[i].([]byte))
+		for j := range sfields {
+			switch sfields[j] {
+			case 1:
+				got = append(got, string(svalues[j].([]byte)))
+			case 2:
+				efields, evalues := protoFields(t, svalues[j].([]byte))
+				var secs, nanos uint64
+				var line, metadata string
+				for k := range efields {
+					switch efields[k] {
+					case 1:
+						tfields, tvalues := protoFields(t, evalues[k].([]byte))
+						for l := range tfields {
+							if tfields[l] == 1 {
+								secs = tvalues[l].(uint64)
+							} else {
+								nanos = tvalues[l].(uint64)
+							}
+						}
+					case 2:
+						line = string(evalues[k].([]byte))
+					case 3:
+						_, pvalues := protoFields(t, evalues[k].([]byte))
+						metadata += fmt.Sprintf(" %s=%s", pvalues[0], pvalues[1])
+					}
+				}
+				got = append(got, fmt.Sprintf("%d.%09d %s%s", secs, nanos, line, metadata))
+			}
+		}
+	}
+	want := []string{
+		`{job="app", stream="web.1"}`,
+		"1700000000.000000123 GET / 200",
+		"1700000001.000000000 GET /favicon.ico 404 level=warn",
+		`{job="app", stream="worker.1"}`,
+		"1700000002.000000005 job done",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%q, se esperaba %q", got, want)
+	}
+}
+
+func TestParseLokiFormat(t *testing.T) {
+	for value, want := range map[string]string{"": lokiFormatJSON, "json": lokiFormatJSON, "json+gzip": lokiFormatJSONGzip, "protobuf": lokiFormatProtobuf} {
+		if got, err := parseLokiFormat(value); err != nil || got != want {
+			t.Errorf("parseLokiFormat(%q) = %q, %v; se esperaba %q", value, got, err, want)
+		}
+	}
+	if _, err := parseLokiFormat("xml"); err == nil {
+		t.Error("se esperaba un error con un formato desconocido")
+	}
+}
+
+// BenchmarkLokiPush compara las codificaciones enviando lotes de 500 líneas a
+// un receptor local; bytes/op son los bytes enviados por lote.
+func BenchmarkLokiPush(b *testing.B) {
+	var received int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		atomic.AddInt64(&received, n)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	now := time.Now()
+	batch := make([]LogRecord, 500)
+	for i := range batch {
+		batch[i] = LogRecord{
+			Time:     now.Add(time.Duration(i) * time.Millisecond),
+			Name:     fmt.Sprintf("worker.%d", i%4+1),
+			Process:  "worker",
+			Instance: i%4 + 1,
+			Stream:   "stdout",
+			Line:     fmt.Sprintf(`level=info msg="processed job" queue=default job_id=%d duration=%dms`, 100000+i, i%250),
+		}
+	}
+
+	for _, format := range []string{lokiFormatJSON, lokiFormatJSONGzip, lokiFormatProtobuf} {
+		b.Run(format, func(b *testing.B) {
+			c := NewLokiClient(LokiOptions{URL: srv.URL, Job: "bench", Timeout: time.Second, Format: format}, testBatchConfig(), func(string) {})
+			defer c.Close()
+			atomic.StoreInt64(&received, 0)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := c.push(batch); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(&received))/float64(b.N), "bytes/op")
+		})
+	}
+}
@@ -5,6 +5,13 @@ import "os"
 var commands = []*Command{
 	cmdStart,
 	cmdRun,
+	cmdPs,
+	cmdRestart,
+	cmdStop,
+	cmdStartProc,
+	cmdScale,
+	cmdExport,
+	cmdCheck,
 	// cmdUpdate,
 	cmdVersion,
 	cmdHelp,
@@ -24,6 +31,9 @@ func main() {
 
 	for _, cmd := range commands {
 		if cmd.Name() == args[0] && cmd.Runnable() {
+			if cmd != cmdCheck {
+				handleError(configErr)
+			}
 			cmd.Flag.Usage = func() {
 				cmd.printUsage()
 			}
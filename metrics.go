@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var flagMetricsAddress string
+
+func readMetricsConfig(config Config) error {
+	if config["metrics.address"] != "" {
+		flagMetricsAddress = config["metrics.address"]
+	}
+	return nil
+}
+
+// lineKey identifica el contador de líneas de un stream de una instancia.
+type lineKey struct {
+	process  string
+	instance int
+	stream   string
+}
+
+// counters son los contadores que no se pueden sacar del estado de las
+// instancias: las líneas de cada stream y los envíos fallidos de cada sink.
+// Sobreviven a los reinicios, como piden los counters de Prometheus.
+var counters = struct {
+	sync.Mutex
+	lines      map[lineKey]*int64
+	pushErrors map[string]*int64
+}{
+	lines:      make(map[lineKey]*int64),
+	pushErrors: make(map[string]*int64),
+}
+
+// lineCounter devuelve el contador de líneas de stream de la instancia
+// instance de process.
+func lineCounter(process string, instance int, stream string) *int64 {
+	counters.Lock()
+	defer counters.Unlock()
+	key := lineKey{process, instance, stream}
+	if counters.lines[key] == nil {
+		counters.lines[key] = new(int64)
+	}
+	return counters.lines[key]
+}
+
+// countPushError cuenta un envío fallido del sink name.
+func countPushError(name string) {
+	counters.Lock()
+	n := counters.pushErrors[name]
+	if n == nil {
+		n = new(int64)
+		counters.pushErrors[name] = n
+	}
+	counters.Unlock()
+	atomic.AddInt64(n, 1)
+}
+
+// listenMetrics abre el puerto de las métricas, o devuelve nil si no se ha
+// configurado metrics.address.
+func listenMetrics(address string) (net.Listener, error) {
+	if address == "" {
+		return nil, nil
+	}
+	return net.Listen("tcp", address)
+}
+
+func (f *mango) serveMetrics(l net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		f.writeMetrics(w)
+	})
+	http.Serve(l, mux)
+}
+
+// metricFamily es una métrica con sus muestras en el formato de texto de
+// Prometheus.
+type metricFamily struct {
+	name, kind, help string
+	samples          []string
+}
+
+func (m *metricFamily) add(labels string, value interface{}) {
+	m.samples = append(m.samples, fmt.Sprintf("%s{%s} %v", m.name, labels, value))
+}
+
+// instanceLabels devuelve las etiquetas process e instance, y las que se
+// añadan en extra como pares nombre, valor.
+func instanceLabels(process string, instance int, extra ...string) string {
+	labels := fmt.Sprintf(`process="%s",instance="%d"`, escapeLabel(process), instance)
+	for i := 0; i+1 < len(extra); i += 2 {
+		labels += fmt.Sprintf(`,%s="%s"`, extra[i], escapeLabel(extra[i+1]))
+	}
+	return labels
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// writeMetrics escribe las métricas de las instancias, en el orden del
+// Procfile, y de los sinks.
+func (f *mango) writeMetrics(w io.Writer) {
+	up := &metricFamily{name: "mango_process_up", kind: "gauge", help: "Whether the instance is running."}
+	restarts := &metricFamily{name: "mango_process_restarts_total", kind: "counter", help: "Times the instance has been restarted."}
+	started := &metricFamily{name: "mango_process_start_time_seconds", kind: "gauge", help: "Start time of the latest run of the instance, in seconds since the epoch."}
+	lines := &metricFamily{name: "mango_log_lines_total", kind: "counter", help: "Lines written by the instance."}
+	lokiErrors := &metricFamily{name: "mango_loki_push_errors_total", kind: "counter", help: "Failed pushes to Loki, including retries."}
+	sinkErrors := &metricFamily{name: "mango_sink_push_errors_total", kind: "counter", help: "Failed sends by each remote sink, including retries."}
+
+	for _, entry := range f.procfile.Entries {
+		for _, inst := range f.states[entry.Name].snapshot() {
+			labels := instanceLabels(entry.Name, inst.Num+1)
+			inst.mu.Lock()
+			running := 0
+			if inst.state == stateRunning {
+				running = 1
+			}
+			up.add(labels, running)
+			restarts.add(labels, inst.restarts)
+			if !inst.started.IsZero() {
+				started.add(labels, fmt.Sprintf("%.3f", float64(inst.started.UnixNano())/1e9))
+			}
+			inst.mu.Unlock()
+		}
+	}
+
+	counters.Lock()
+	keys := make([]lineKey, 0, len(counters.lines))
+	for key := range counters.lines {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.process != b.process {
+			return a.process < b.process
+		}
+		if a.instance != b.instance {
+			return a.instance < b.instance
+		}
+		return a.stream < b.stream
+	})
+	for _, key := range keys {
+		lines.add(instanceLabels(key.process, key.instance, "stream", key.stream), atomic.LoadInt64(counters.lines[key]))
+	}
+	var lokiCount int64
+	if n := counters.pushErrors["loki"]; n != nil {
+		lokiCount = atomic.LoadInt64(n)
+	}
+	lokiErrors.samples = append(lokiErrors.samples, fmt.Sprintf("%s %d", lokiErrors.name, lokiCount))
+	for _, name := range sortedCounterNames(counters.pushErrors) {
+		sinkErrors.add(fmt.Sprintf(`sink="%s"`, escapeLabel(name)), atomic.LoadInt64(counters.pushErrors[name]))
+	}
+	counters.Unlock()
+
+	out := bufio.NewWriter(w)
+	for _, m := range []*metricFamily{up, restarts, started, lines, lokiErrors, sinkErrors} {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, sample := range m.samples {
+			fmt.Fprintln(out, sample)
+		}
+	}
+	out.Flush()
+}
+
+func sortedCounterNames(m map[string]*int64) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testMetricsMango devuelve un mango con dos instancias de metricsweb: la
+// primera corriendo tras dos reinicios y la segunda detenida sin arrancar.
+func testMetricsMango() *mango {
+	proc := ProcfileEntry{Name: "metricsweb"}
+	st := newProcState(2)
+	running := newInstance(0, 0, proc)
+	running.state = stateRunning
+	running.restarts = 2
+	running.started = time.Unix(1700000000, 500000000)
+	st.add(running)
+	st.add(newInstance(0, 1, proc))
+	return &mango{
+		procfile: &Procfile{Entries: []ProcfileEntry{proc}},
+		states:   map[string]*procState{proc.Name: st},
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	f := testMetricsMango()
+	atomic.StoreInt64(lineCounter("metricsweb", 1, "stdout"), 3)
+	atomic.StoreInt64(lineCounter("metricsweb", 1, "stderr"), 1)
+	countPushError("loki")
+
+	var buf bytes.Buffer
+	f.writeMetrics(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE mango_process_up gauge\n",
+		`mango_process_up{process="metricsweb",instance="1"} 1` + "\n",
+		`mango_process_up{process="metricsweb",instance="2"} 0` + "\n",
+		`mango_process_restarts_total{process="metricsweb",instance="1"} 2` + "\n",
+		`mango_process_restarts_total{process="metricsweb",instance="2"} 0` + "\n",
+		`mango_process_start_time_seconds{process="metricsweb",instance="1"} 1700000000.500` + "\n",
+		`mango_log_lines_total{process="metricsweb",instance="1",stream="stderr"} 1` + "\n",
+		`mango_log_lines_total{process="metricsweb",instance="1",stream="stdout"} 3` + "\n",
+		"# TYPE mango_loki_push_errors_total counter\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("falta %q en:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `mango_process_start_time_seconds{process="metricsweb",instance="2"}`) {
+		t.Errorf("una instancia que no ha arrancado no tiene hora de inicio:\n%s", out)
+	}
+	// Otros tests también cuentan envíos fallidos, así que sólo se
+	// comprueba que haya alguno.
+	for _, re := range []string{`(?m)^mango_loki_push_errors_total [1-9]\d*$`, `(?m)^mango_sink_push_errors_total\{sink="loki"\} [1-9]\d*$`} {
+		if !regexp.MustCompile(re).MatchString(out) {
+			t.Errorf("no se encuentra %s en:\n%s", re, out)
+		}
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	l, err := listenMetrics("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go testMetricsMango().serveMetrics(l)
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("respuesta %s, %s", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	if !strings.Contains(string(body), `mango_process_up{process="metricsweb",instance="1"} 1`) {
+		t.Errorf("cuerpo inesperado:\n%s", body)
+	}
+
+	if l, err := listenMetrics(""); l != nil || err != nil {
+		t.Errorf("listenMetrics sin dirección = %v, %v", l, err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMultilineTimeout es cuánto se espera a una continuación antes de
+// dar por terminado un registro de varias líneas.
+const defaultMultilineTimeout = 500 * time.Millisecond
+
+// defaultMultilineMaxLines es el máximo de líneas de un registro: un proceso
+// que no deja de escribir continuaciones no lo retiene para siempre.
+const defaultMultilineMaxLines = 500
+
+// MultilineRule dice qué líneas continúan el registro anterior, como las de
+// una traza: con Start, las que no coinciden con él; sin Start, las que
+// empiezan por espacio o tabulador.
+type MultilineRule struct {
+	Start *regexp.Regexp
+}
+
+// parseMultilineRule interpreta el valor de "# mango: multiline=rule":
+// "indent" o "start:regexp".
+func parseMultilineRule(value string) (*MultilineRule, error) {
+	if value == "indent" {
+		return &MultilineRule{}, nil
+	}
+	if pattern := strings.TrimPrefix(value, "start:"); pattern != value && pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid multiline regexp: %v", err)
+		}
+		return &MultilineRule{Start: re}, nil
+	}
+	return nil, fmt.Errorf("invalid multiline rule %q (want indent or start:regexp)", value)
+}
+
+// continues dice si line continúa el registro anterior.
+func (r *MultilineRule) continues(line string) bool {
+	if r.Start != nil {
+		return !r.Start.MatchString(line)
+	}
+	return strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+}
+
+// lineGrouper junta las líneas de un registro según su regla y entrega cada
+// registro a emit, cuando empieza el siguiente, al llegar a maxLines líneas o
+// tras timeout sin líneas nuevas. Sin regla, cada línea es un registro.
+type lineGrouper struct {
+	rule     *MultilineRule
+	timeout  time.Duration
+	maxLines int
+	emit     func(first time.Time, text string)
+
+	mu      sync.Mutex
+	pending []string
+	first   time.Time
+	timer   *time.Timer
+}
+
+func newLineGrouper(rule *MultilineRule, timeout time.Duration, maxLines int, emit func(first time.Time, text string)) *lineGrouper {
+	if timeout <= 0 {
+		timeout = defaultMultilineTimeout
+	}
+	if maxLines <= 0 {
+		maxLines = defaultMultilineMaxLines
+	}
+	return &lineGrouper{rule: rule, timeout: timeout, maxLines: maxLines, emit: emit}
+}
+
+// Add añade una línea, sin el salto de línea final.
+func (g *lineGrouper) Add(line string) {
+	if g.rule == nil {
+		g.emit(time.Now(), line)
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.pending) > 0 && !g.rule.continues(line) {
+		g.flush()
+	}
+	if len(g.pending) == 0 {
+		g.first = time.Now()
+	}
+	g.pending = append(g.pending, line)
+	if len(g.pending) >= g.maxLines {
+		g.flush()
+		return
+	}
+	if g.timer == nil {
+		g.timer = time.AfterFunc(g.timeout, func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			g.flush()
+		})
+	} else {
+		g.timer.Reset(g.timeout)
+	}
+}
+
+// Close entrega el registro pendiente.
+func (g *lineGrouper) Close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+	g.flush()
+}
+
+// flush entrega el registro pendiente. Debe llamarse con g.mu tomado.
+func (g *lineGrouper) flush() {
+	if len(g.pending) == 0 {
+		return
+	}
+	g.emit(g.first, strings.Join(g.pending, "\n"))
+	g.pending = g.pending[:0]
+}
+
+// readLines llama a line con cada línea de r, sin el salto de línea, hasta
+// el final o un error; una última línea sin terminar también se entrega.
+func readLines(r io.Reader, line func(string)) {
+	reader := bufio.NewReader(r)
+	for {
+		text, err := reader.ReadString('\n')
+		if text != "" {
+			line(strings.TrimRight(text, "\r\n"))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
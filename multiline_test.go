@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseMultilineRule(t *testing.T) {
+	rule, err := parseMultilineRule("indent")
+	if err != nil || rule.Start != nil {
+		t.Fatalf("indent: %+v, %v", rule, err)
+	}
+	if !rule.continues("\tat Foo") || !rule.continues("  from app.rb:3") || rule.continues("Caused by: x") {
+		t.Error("indent: continuaciones mal reconocidas")
+	}
+	rule, err = parseMultilineRule(`start:^\d{4}-`)
+	if err != nil || rule.Start == nil {
+		t.Fatalf("start: %+v, %v", rule, err)
+	}
+	if rule.continues("2024-05-01 INFO") || !rule.continues("Caused by: x") {
+		t.Error("start: continuaciones mal reconocidas")
+	}
+	for _, value := range []string{"", "start:", "start:(", "regexp"} {
+		if _, err := parseMultilineRule(value); err == nil {
+			t.Errorf("%q: se esperaba un error", value)
+		}
+	}
+}
+
+// groupedOutput agrupa las líneas que entrega lines con la regla de proc,
+// como readOutput.
+func groupedOutput(proc ProcfileEntry, lines func(line func(string))) []string {
+	var mu sync.Mutex
+	var records []string
+	group := newLineGrouper(proc.Multiline, proc.MultilineTimeout, proc.MultilineMaxLines, func(first time.Time, text string) {
+		mu.Lock()
+		defer mu.Unlock()
+		records = append(records, text)
+	})
+	lines(group.Add)
+	group.Close()
+	return records
+}
+
+func TestLineGrouperTimeout(t *testing.T) {
+	proc := ProcfileEntry{Multiline: &MultilineRule{}, MultilineTimeout: 20 * time.Millisecond}
+	var emitted []string
+	var mu sync.Mutex
+	group := newLineGrouper(proc.Multiline, proc.MultilineTimeout, proc.MultilineMaxLines, func(first time.Time, text string) {
+		mu.Lock()
+		defer mu.Unlock()
+		emitted = append(emitted, text)
+	})
+	group.Add("Error: boom")
+	group.Add("\tat main")
+
+	// La traza se entrega sin esperar a la siguiente línea.
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	got := append([]string(nil), emitted...)
+	mu.Unlock()
+	if want := []string{"Error: boom\n\tat main"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("%q, se esperaba %q", got, want)
+	}
+	group.Close()
+
+	records := groupedOutput(ProcfileEntry{}, func(add func(string)) {
+		add("a")
+		add("\tb")
+	})
+	if want := []string{"a", "\tb"}; !reflect.DeepEqual(records, want) {
+		t.Errorf("sin regla: %q, se esperaba %q", records, want)
+	}
+}
+
+func TestLineGrouperMaxLines(t *testing.T) {
+	proc := ProcfileEntry{Multiline: &MultilineRule{}, MultilineMaxLines: 3}
+	records := groupedOutput(proc, func(add func(string)) {
+		for _, line := range []string{"a", "\t1", "\t2", "\t3", "\t4"} {
+			add(line)
+		}
+	})
+	if want := []string{"a\n\t1\n\t2", "\t3\n\t4"}; !reflect.DeepEqual(records, want) {
+		t.Errorf("%q, se esperaba %q", records, want)
+	}
+}
+
+// TestMultilineFixture ejecuta los procesos de fixtures/multiline y comprueba
+// que cada traza queda en un solo registro según la regla de cada uno.
+func TestMultilineFixture(t *testing.T) {
+	pf, err := ReadProcfile("fixtures/multiline/Procfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace := "java.lang.IllegalStateException: boom\n" +
+		"\tat com.example.Web.handle(Web.java:42)\n" +
+		"\tat com.example.Web.main(Web.java:7)"
+	want := map[string][]string{
+		"stdout1": {
+			"2024-05-01 10:00:00 INFO starting",
+			"2024-05-01 10:00:01 ERROR request failed",
+			trace,
+			"2024-05-01 10:00:02 INFO finish!",
+		},
+		"stdout2": {
+			"2024-05-01 10:00:00 INFO starting",
+			"2024-05-01 10:00:01 ERROR request failed\n" + trace,
+			"2024-05-01 10:00:02 INFO finish!",
+		},
+	}
+	if len(pf.Entries) != len(want) {
+		t.Fatalf("esperaba %d entradas, obtuve %d", len(want), len(pf.Entries))
+	}
+	for _, proc := range pf.Entries {
+		cmd := exec.Command("sh", "-c", proc.Command)
+		cmd.Dir = "fixtures/multiline"
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		records := groupedOutput(proc, func(add func(string)) { readLines(out, add) })
+		if err := cmd.Wait(); err != nil {
+			t.Fatalf("%s: %v", proc.Name, err)
+		}
+		if !reflect.DeepEqual(records, want[proc.Name]) {
+			t.Errorf("%s:\n%s\nse esperaba:\n%s", proc.Name, strings.Join(records, "\n--\n"), strings.Join(want[proc.Name], "\n--\n"))
+		}
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Protocolos de exportación OTLP/HTTP.
+const (
+	otlpProtobuf = "http/protobuf"
+	otlpJSON     = "http/json"
+)
+
+var flagOTLPEndpoint string
+var flagOTLPProtocol string
+var flagOTLPHeaders string
+var flagOTLPServiceName string
+var flagOTLPBatchSize int
+var flagOTLPBatchWait time.Duration
+var flagOTLPQueueSize int
+var flagOTLPRetryFor time.Duration
+var flagOTLPCAFile string
+var flagOTLPCertFile string
+var flagOTLPKeyFile string
+var flagOTLPInsecureSkipVerify bool
+
+func readOTLPConfig(config Config) error {
+	var errs configErrors
+	for key, value := range map[string]*string{
+		"otlp.endpoint":     &flagOTLPEndpoint,
+		"otlp.protocol":     &flagOTLPProtocol,
+		"otlp.service_name": &flagOTLPServiceName,
+		"otlp.ca_file":      &flagOTLPCAFile,
+		"otlp.cert_file":    &flagOTLPCertFile,
+		"otlp.key_file":     &flagOTLPKeyFile,
+	} {
+		if config[key] != "" {
+			*value = config[key]
+		}
+	}
+	// Las cabeceras suelen llevar credenciales, así que se pueden dar
+	// también en MANGO_OTLP_HEADERS.
+	if env := os.Getenv(settingEnv("otlp.headers")); env != "" {
+		flagOTLPHeaders = env
+	} else if config["otlp.headers"] != "" {
+		flagOTLPHeaders = config["otlp.headers"]
+	}
+	errs.parseBool("otlp.insecure_skip_verify", config["otlp.insecure_skip_verify"], &flagOTLPInsecureSkipVerify)
+	for key, value := range map[string]*int{
+		"otlp.batch_size": &flagOTLPBatchSize,
+		"otlp.queue_size": &flagOTLPQueueSize,
+	} {
+		errs.parseInt(key, config[key], value)
+	}
+	for key, value := range map[string]*time.Duration{
+		"otlp.batch_wait":    &flagOTLPBatchWait,
+		"otlp.retry_timeout": &flagOTLPRetryFor,
+	} {
+		errs.parseDuration(key, config[key], value)
+	}
+	return errs.err()
+}
+
+// parseHeaders interpreta una lista "name=value,..." como la de
+// OTEL_EXPORTER_OTLP_HEADERS; los valores pueden ir codificados como en una
+// URL.
+func parseHeaders(value string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, val, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid header %q (want name=value)", pair)
+		}
+		if unescaped, err := url.QueryUnescape(val); err == nil {
+			val = unescaped
+		}
+		headers.Add(strings.TrimSpace(name), strings.TrimSpace(val))
+	}
+	return headers, nil
+}
+
+// OTLPOptions dice a qué colector enviar los logs y cómo.
+type OTLPOptions struct {
+	// URL es el endpoint de logs, como http://localhost:4318/v1/logs.
+	URL      string
+	Protocol string // otlpProtobuf u otlpJSON
+	Headers  http.Header
+	Timeout  time.Duration
+	TLS      *tls.Config
+
+	// ServiceName es el service.name de todos los recursos, y Host su
+	// host.name.
+	ServiceName string
+	Host        string
+}
+
+// OTLPClient exporta los logs a un colector de OpenTelemetry por OTLP/HTTP,
+// en lotes y con los mismos reintentos que LokiClient.
+type OTLPClient struct {
+	opts       OTLPOptions
+	httpClient *http.Client
+	batcher    *batcher
+}
+
+func NewOTLPClient(opts OTLPOptions, cfg batchConfig, logf func(msg string)) *OTLPClient {
+	c := &OTLPClient{
+		opts:       opts,
+		httpClient: newHTTPClient(opts.Timeout, opts.TLS),
+	}
+	c.batcher = newBatcher("otlp", cfg, c.push, logf)
+	return c
+}
+
+// Send añade rec a la cola de envío sin esperar al colector.
+func (c *OTLPClient) Send(rec LogRecord) {
+	c.batcher.Add(rec)
+}
+
+// Close envía lo pendiente e informa de las líneas que se hayan perdido.
+func (c *OTLPClient) Close() {
+	c.batcher.Close()
+}
+
+func (c *OTLPClient) push(batch []LogRecord) error {
+	req := c.request(batch)
+	var body []byte
+	contentType := "application/x-protobuf"
+	if c.opts.Protocol == otlpJSON {
+		var err error
+		if body, err = json.Marshal(req); err != nil {
+			return &pushError{err: fmt.Errorf("encoding export request: %v", err)}
+		}
+		contentType = "application/json"
+	} else {
+		body = req.protobuf()
+	}
+
+	httpReq, err := http.NewRequest("POST", c.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return &pushError{err: err}
+	}
+	for name, values := range c.opts.Headers {
+		httpReq.Header[name] = values
+	}
+	httpReq.Header.Set("Content-Type", contentType)
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return otlpResponseError(resp)
+}
+
+// otlpResponseError es como responseError, pero sólo reintenta los códigos
+// que permite OTLP/HTTP: 429, 502, 503 y 504. Los demás son definitivos.
+func otlpResponseError(resp *http.Response) error {
+	err := responseError(resp)
+	if perr, ok := err.(*pushError); ok {
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		default:
+			perr.retry = false
+		}
+	}
+	return err
+}
+
+// request agrupa batch en un recurso por instancia, en el orden en que
+// aparece cada una.
+func (c *OTLPClient) request(batch []LogRecord) otlpExportRequest {
+	var req otlpExportRequest
+	index := make(map[string]int)
+	observed := uint64(time.Now().UnixNano())
+	for _, rec := range batch {
+		key := rec.Name + "/" + strconv.Itoa(rec.Pid)
+		i, ok := index[key]
+		if !ok {
+			i = len(req.ResourceLogs)
+			index[key] = i
+			req.ResourceLogs = append(req.ResourceLogs, otlpResourceLogs{
+				Resource:  otlpResource{Attributes: c.resourceAttributes(rec)},
+				ScopeLogs: []otlpScopeLogs{{Scope: otlpScope{Name: "mango", Version: Version}}},
+			})
+		}
+		scope := &req.ResourceLogs[i].ScopeLogs[0]
+		number, text := otlpSeverity(rec.Level)
+		scope.LogRecords = append(scope.LogRecords, otlpLogRecord{
+			TimeUnixNano:         uint64(rec.Time.UnixNano()),
+			ObservedTimeUnixNano: observed,
+			SeverityNumber:       number,
+			SeverityText:         text,
+			Body:                 otlpAnyValue{StringValue: rec.Line},
+			Attributes:           []otlpKeyValue{stringAttribute("log.iostream", rec.Stream)},
+		})
+	}
+	return req
+}
+
+// resourceAttributes describe la instancia que escribió rec.
+func (c *OTLPClient) resourceAttributes(rec LogRecord) []otlpKeyValue {
+	attrs := []otlpKeyValue{
+		stringAttribute("service.name", c.opts.ServiceName),
+		stringAttribute("service.instance.id", rec.Name),
+		stringAttribute("mango.process", rec.Process),
+	}
+	if rec.Instance > 0 {
+		attrs = append(attrs, intAttribute("mango.instance", int64(rec.Instance)))
+	}
+	if rec.Pid > 0 {
+		attrs = append(attrs, intAttribute("process.pid", int64(rec.Pid)))
+	}
+	if c.opts.Host != "" {
+		attrs = append(attrs, stringAttribute("host.name", c.opts.Host))
+	}
+	return attrs
+}
+
+// otlpSeverity devuelve el SeverityNumber de OpenTelemetry de un nivel ya
+// normalizado, y el texto a enviar con él.
+func otlpSeverity(level string) (int, string) {
+	switch level {
+	case "":
+		return 0, ""
+	case "trace":
+		return 1, level
+	case "debug":
+		return 5, level
+	case "info", "notice":
+		return 9, level
+	case "warn":
+		return 13, level
+	case "error":
+		return 17, level
+	case "fatal":
+		return 21, level
+	}
+	return 0, level
+}
+
+// Mensajes de OTLP, con los nombres de su codificación JSON.
+type otlpExportRequest struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpResourceLogs struct {
+	Resource  otlpResource    `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeLogs struct {
+	Scope      otlpScope       `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         uint64         `json:"timeUnixNano,string"`
+	ObservedTimeUnixNano uint64         `json:"observedTimeUnixNano,string"`
+	SeverityNumber       int            `json:"severityNumber,omitempty"`
+	SeverityText         string         `json:"severityText,omitempty"`
+	Body                 otlpAnyValue   `json:"body"`
+	Attributes           []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+// otlpAnyValue es un texto o, con IsInt, un entero.
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+	IntValue    int64  `json:"intValue,string"`
+	IsInt       bool   `json:"-"`
+}
+
+// MarshalJSON escribe sólo el campo que corresponde, también si está vacío:
+// una línea vacía es {"stringValue":""} y no un valor sin tipo.
+func (v otlpAnyValue) MarshalJSON() ([]byte, error) {
+	if v.IsInt {
+		return json.Marshal(struct {
+			IntValue int64 `json:"intValue,string"`
+		}{v.IntValue})
+	}
+	return json.Marshal(struct {
+		StringValue string `json:"stringValue"`
+	}{v.StringValue})
+}
+
+func stringAttribute(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: value}}
+}
+
+func intAttribute(key string, value int64) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{IntValue: value, IsInt: true}}
+}
+
+// protobuf codifica r como opentelemetry.proto.collector.logs.v1.
+// ExportLogsServiceRequest.
+func (r otlpExportRequest) protobuf() []byte {
+	var req []byte
+	for _, rl := range r.ResourceLogs {
+		var resource []byte
+		for _, attr := range rl.Resource.Attributes {
+			resource = appendProtoBytes(resource, 1, attr.protobuf())
+		}
+		msg := appendProtoBytes(nil, 1, resource)
+		for _, sl := range rl.ScopeLogs {
+			var scope []byte
+			scope = appendProtoBytes(scope, 1, []byte(sl.Scope.Name))
+			if sl.Scope.Version != "" {
+				scope = appendProtoBytes(scope, 2, []byte(sl.Scope.Version))
+			}
+			scopeLogs := appendProtoBytes(nil, 1, scope)
+			for _, lr := range sl.LogRecords {
+				scopeLogs = appendProtoBytes(scopeLogs, 2, lr.protobuf())
+			}
+			msg = appendProtoBytes(msg, 2, scopeLogs)
+		}
+		req = appendProtoBytes(req, 1, msg)
+	}
+	return req
+}
+
+func (lr otlpLogRecord) protobuf() []byte {
+	var b []byte
+	b = appendProtoFixed64(b, 1, lr.TimeUnixNano)
+	if lr.SeverityNumber != 0 {
+		b = appendProtoVarint(b, 2, uint64(lr.SeverityNumber))
+	}
+	if lr.SeverityText != "" {
+		b = appendProtoBytes(b, 3, []byte(lr.SeverityText))
+	}
+	b = appendProtoBytes(b, 5, lr.Body.protobuf())
+	for _, attr := range lr.Attributes {
+		b = appendProtoBytes(b, 6, attr.protobuf())
+	}
+	return appendProtoFixed64(b, 11, lr.ObservedTimeUnixNano)
+}
+
+func (kv otlpKeyValue) protobuf() []byte {
+	b := appendProtoBytes(nil, 1, []byte(kv.Key))
+	return appendProtoBytes(b, 2, kv.Value.protobuf())
+}
+
+func (v otlpAnyValue) protobuf() []byte {
+	if v.IsInt {
+		return appendProtoVarint(nil, 3, uint64(v.IntValue))
+	}
+	return appendProtoBytes(nil, 1, []byte(v.StringValue))
+}
+
+// otlpSink adapta OTLPClient a LogSink.
+type otlpSink struct {
+	client *OTLPClient
+	parser *LogParser
+}
+
+// openOTLPSink inicializa el exportador OTLP si se ha configurado
+// otlp.endpoint.
+func openOTLPSink(of *OutletFactory, pf *Procfile) (LogSink, error) {
+	if flagOTLPEndpoint == "" {
+		return nil, nil
+	}
+	endpoint, err := url.Parse(flagOTLPEndpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", flagOTLPEndpoint)
+	}
+	if endpoint.Path == "" || endpoint.Path == "/" {
+		endpoint.Path = "/v1/logs"
+	}
+	if flagOTLPProtocol != otlpProtobuf && flagOTLPProtocol != otlpJSON {
+		return nil, fmt.Errorf("invalid protocol %q (want %s or %s)", flagOTLPProtocol, otlpProtobuf, otlpJSON)
+	}
+	if flagOTLPBatchSize <= 0 || flagOTLPBatchWait <= 0 {
+		return nil, fmt.Errorf("otlp.batch_size and otlp.batch_wait must be positive")
+	}
+	headers, err := parseHeaders(flagOTLPHeaders)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := loadTLSConfig(flagOTLPCAFile, flagOTLPCertFile, flagOTLPKeyFile, flagOTLPInsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	parser, err := levelParser()
+	if err != nil {
+		return nil, err
+	}
+
+	// loki.job hace de nombre de la aplicación para todos los sinks que no
+	// tienen uno propio, así que también es el service.name por defecto.
+	serviceName := flagOTLPServiceName
+	if serviceName == "" {
+		serviceName = flagLokiJob
+	}
+	host, _ := os.Hostname()
+	opts := OTLPOptions{
+		URL:         endpoint.String(),
+		Protocol:    flagOTLPProtocol,
+		Headers:     headers,
+		Timeout:     10 * time.Second,
+		TLS:         tlsConfig,
+		ServiceName: serviceName,
+		Host:        host,
+	}
+	cfg := batchConfig{
+		Size:       flagOTLPBatchSize,
+		Interval:   flagOTLPBatchWait,
+		QueueSize:  flagOTLPQueueSize,
+		Drop:       dropOldest,
+		Backoff:    defaultSinkBackoff,
+		BackoffMax: defaultSinkBackoffMax,
+		RetryFor:   flagOTLPRetryFor,
+	}
+	of.SystemOutput(fmt.Sprintf("otlp: exporting logs to %s (service.name=%s)", opts.URL, serviceName))
+	return &otlpSink{client: NewOTLPClient(opts, cfg, of.SystemOutput), parser: parser}, nil
+}
+
+func (s *otlpSink) Send(rec LogRecord) {
+	if s.parser != nil {
+		s.parser.Process(&rec)
+	}
+	s.client.Send(rec)
+}
+
+func (s *otlpSink) Close() {
+	s.client.Close()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// otlpReceiver es un colector de prueba que guarda lo que recibe.
+type otlpReceiver struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *otlpReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+	w.Header().Set("Content-Type", req.Header.Get("Content-Type"))
+	w.Write([]byte("{}"))
+}
+
+func testOTLPBatch() []LogRecord {
+	at := time.Unix(1700000000, 5)
+	return []LogRecord{
+		{Time: at, Name: "web.1", Process: "web", Instance: 1, Stream: "stdout", Pid: 42, Line: "hola", Level: "info"},
+		{Time: at, Name: "web.1", Process: "web", Instance: 1, Stream: "stderr", Pid: 42, Line: "boom", Level: "error"},
+		{Time: at, Name: "worker.2", Process: "worker", Instance: 2, Stream: "stdout", Pid: 43, Line: "sin nivel"},
+	}
+}
+
+func TestOTLPClientJSON(t *testing.T) {
+	receiver := &otlpReceiver{}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	headers, err := parseHeaders("Authorization=Bearer%20abc, X-Team = pagos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewOTLPClient(OTLPOptions{
+		URL:         srv.URL + "/v1/logs",
+		Protocol:    otlpJSON,
+		Headers:     headers,
+		Timeout:     time.Second,
+		ServiceName: "app",
+		Host:        "box1",
+	}, testBatchConfig(), func(string) {})
+	for _, rec := range testOTLPBatch() {
+		c.Send(rec)
+	}
+	// Close envía lo pendiente.
+	c.Close()
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	var records []otlpLogRecord
+	var resources [][]otlpKeyValue
+	for i, req := range receiver.requests {
+		if req.Header.Get("Content-Type") != "application/json" || req.Header.Get("Authorization") != "Bearer abc" || req.Header.Get("X-Team") != "pagos" {
+			t.Errorf("cabeceras inesperadas: %v", req.Header)
+		}
+		var body otlpExportRequest
+		if err := json.Unmarshal(receiver.bodies[i], &body); err != nil {
+			t.Fatal(err)
+		}
+		for _, rl := range body.ResourceLogs {
+			resources = append(resources, rl.Resource.Attributes)
+			for _, sl := range rl.ScopeLogs {
+				records = append(records, sl.LogRecords...)
+			}
+		}
+	}
+
+	if len(records) != 3 {
+		t.Fatalf("%d registros, se esperaban 3", len(records))
+	}
+	wantSeverity := []int{9, 17, 0}
+	wantStream := []string{"stdout", "stderr", "stdout"}
+	for i, rec := range records {
+		if rec.SeverityNumber != wantSeverity[i] {
+			t.Errorf("registro %d: severidad %d, se esperaba %d", i, rec.SeverityNumber, wantSeverity[i])
+		}
+		if rec.TimeUnixNano != 1700000000000000005 {
+			t.Errorf("registro %d: hora %d", i, rec.TimeUnixNano)
+		}
+		if len(rec.Attributes) != 1 || rec.Attributes[0].Value.StringValue != wantStream[i] {
+			t.Errorf("registro %d: atributos %+v", i, rec.Attributes)
+		}
+	}
+
+	want := []otlpKeyValue{
+		stringAttribute("service.name", "app"),
+		stringAttribute("service.instance.id", "web.1"),
+		stringAttribute("mango.process", "web"),
+		{Key: "mango.instance", Value: otlpAnyValue{IntValue: 1}},
+		{Key: "process.pid", Value: otlpAnyValue{IntValue: 42}},
+		stringAttribute("host.name", "box1"),
+	}
+	if len(resources) == 0 || !reflect.DeepEqual(resources[0], want) {
+		t.Errorf("atributos del recurso %+v, se esperaba %+v", resources, want)
+	}
+}
+
+func TestOTLPClientProtobuf(t *testing.T) {
+	receiver := &otlpReceiver{}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	c := NewOTLPClient(OTLPOptions{URL: srv.URL, Protocol: otlpProtobuf, Timeout: time.Second, ServiceName: "app"}, testBatchConfig(), func(string) {})
+	defer c.Close()
+	if err := c.push(testOTLPBatch()); err != nil {
+		t.Fatal(err)
+	}
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if ct := receiver.requests[0].Header.Get("Content-Type"); ct != "application/x-protobuf" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	// ExportLogsServiceRequest > ResourceLogs > ScopeLogs > LogRecord.
+	var lines, severities []string
+	fields, values := protoFields(t, receiver.bodies[0])
+	for i := range fields {
+		rfields, rvalues := protoFields(t, values[i].([]byte))
+		for j := range rfields {
+			if rfields[j] != 2 {
+				continue
+			}
+			sfields, svalues := protoFields(t, rvalues[j].([]byte))
+			for k := range sfields {
+				if sfields[k] != 2 {
+					continue
+				}
+				lfields, lvalues := protoFields(t, svalues[k].([]byte))
+				for l := range lfields {
+					switch lfields[l] {
+					case 1:
+						if lvalues[l].(uint64) != 1700000000000000005 {
+							t.Errorf("time_unix_nano = %d", lvalues[l])
+						}
+					case 3:
+						severities = append(severities, string(lvalues[l].([]byte)))
+					case 5:
+						_, body := protoFields(t, lvalues[l].([]byte))
+						lines = append(lines, string(body[0].([]byte)))
+					}
+				}
+			}
+		}
+	}
+	if want := []string{"hola", "boom", "sin nivel"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("líneas %q, se esperaba %q", lines, want)
+	}
+	if want := []string{"info", "error"}; !reflect.DeepEqual(severities, want) {
+		t.Errorf("severidades %q, se esperaba %q", severities, want)
+	}
+}
+
+func TestOTLPRetryableStatus(t *testing.T) {
+	for status, want := range map[int]bool{
+		http.StatusInternalServerError: false,
+		http.StatusNotImplemented:      false,
+		http.StatusBadRequest:          false,
+		http.StatusTooManyRequests:     true,
+		http.StatusBadGateway:          true,
+		http.StatusServiceUnavailable:  true,
+		http.StatusGatewayTimeout:      true,
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		c := NewOTLPClient(OTLPOptions{URL: srv.URL, Protocol: otlpJSON, Timeout: time.Second}, testBatchConfig(), func(string) {})
+		err := c.push(testOTLPBatch())
+		c.Close()
+		srv.Close()
+		if err == nil {
+			t.Fatalf("%d: se esperaba un error", status)
+		}
+		if retry, _ := retryable(err); retry != want {
+			t.Errorf("%d: retryable = %t, se esperaba %t", status, retry, want)
+		}
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	if _, err := parseHeaders("sin-valor"); err == nil {
+		t.Error("se esperaba un error con una cabecera sin valor")
+	}
+	headers, err := parseHeaders("")
+	if err != nil || len(headers) != 0 {
+		t.Errorf("%v, %v; se esperaban cero cabeceras", headers, err)
+	}
+}
+
+func TestOTLPSeverity(t *testing.T) {
+	for level, want := range map[string]int{"": 0, "debug": 5, "info": 9, "warn": 13, "error": 17, "fatal": 21, "verbose": 0} {
+		if got, _ := otlpSeverity(level); got != want {
+			t.Errorf("otlpSeverity(%q) = %d, se esperaba %d", level, got, want)
+		}
+	}
+}
+
+func TestOTLPAnyValueJSON(t *testing.T) {
+	for _, test := range []struct {
+		value otlpAnyValue
+		want  string
+	}{
+		{otlpAnyValue{StringValue: "hola"}, `{"stringValue":"hola"}`},
+		{otlpAnyValue{}, `{"stringValue":""}`},
+		{otlpAnyValue{IntValue: 42, IsInt: true}, `{"intValue":"42"}`},
+		{otlpAnyValue{IsInt: true}, `{"intValue":"0"}`},
+	} {
+		got, err := json.Marshal(test.value)
+		if err != nil || string(got) != test.want {
+			t.Errorf("json.Marshal(%+v) = %s, %v; se esperaba %s", test.value, got, err, test.want)
+		}
+	}
+}
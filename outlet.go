@@ -1,22 +1,99 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
-	"io"
+	"hash/fnv"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"text/template"
+	"time"
 
 	ct "github.com/daviddengcn/go-colortext"
 )
 
+// Formatos de salida de la terminal.
+const (
+	outputText   = "text"
+	outputJSON   = "json"
+	outputLogfmt = "logfmt"
+)
+
+const defaultTimestampFormat = "15:04:05"
+
+// Modos de -color.
+const (
+	colorAuto   = "auto"
+	colorAlways = "always"
+	colorNever  = "never"
+)
+
+var flagOutput string
+var flagColor string
+var flagTimestamp bool
+var flagTimestampFormat string
+var flagTimestampUTC bool
+var flagTimestampElapsed bool
+var flagPrefix string
+
 type OutletFactory struct {
 	Padding int
 
+	// Format es outputText (por defecto), outputJSON u outputLogfmt; los
+	// dos últimos escriben un registro por línea, sin colores ni relleno.
+	Format string
+
+	// Color activa las secuencias de color en formato texto.
+	Color bool
+
+	// Timestamp antepone a cada línea de texto la hora con TimeFormat, en
+	// UTC si UTC, o el tiempo desde el arranque si Elapsed.
+	Timestamp  bool
+	TimeFormat string
+	UTC        bool
+	Elapsed    bool
+
+	// Prefix, si se ha definido, reemplaza el prefijo "nombre | ".
+	Prefix *template.Template
+
+	started time.Time
+
 	sync.Mutex
 }
 
+// outletPrefix es lo que recibe la plantilla del prefijo.
+type outletPrefix struct {
+	Time     string
+	Name     string
+	Process  string
+	Instance int
+	Pid      int
+	Stream   string
+}
+
+// outletSource identifica a la instancia que escribe una línea.
+type outletSource struct {
+	Name     string // nombre visible, como web.2
+	Process  string // nombre de la entrada del Procfile
+	Instance int    // número de instancia empezando en 1
+	Pid      int
+	Color    ct.Color
+}
+
+// outletRecord es una línea en los formatos estructurados.
+type outletRecord struct {
+	Time     string `json:"time"`
+	Source   string `json:"source"`
+	Process  string `json:"process,omitempty"`
+	Instance int    `json:"instance,omitempty"`
+	Stream   string `json:"stream,omitempty"`
+	Pid      int    `json:"pid,omitempty"`
+	Message  string `json:"message"`
+}
+
 var colors = []ct.Color{
 	ct.Yellow,
 	ct.Red,
@@ -26,45 +103,135 @@ var colors = []ct.Color{
 	ct.Blue,
 }
 
-func NewOutletFactory() (of *OutletFactory) {
-	return new(OutletFactory)
+var colorNames = map[string]ct.Color{
+	"red":     ct.Red,
+	"green":   ct.Green,
+	"yellow":  ct.Yellow,
+	"blue":    ct.Blue,
+	"magenta": ct.Magenta,
+	"cyan":    ct.Cyan,
+	"white":   ct.White,
 }
 
-func (of *OutletFactory) LineReader(wg *sync.WaitGroup, name string, index int, r io.Reader, isError bool) {
-	defer wg.Done()
+// parseColor devuelve el color de nombre name.
+func parseColor(name string) (ct.Color, error) {
+	if c, ok := colorNames[name]; ok {
+		return c, nil
+	}
+	return ct.None, fmt.Errorf("invalid color %q (want red, green, yellow, blue, magenta, cyan or white)", name)
+}
 
-	color := colors[index%len(colors)]
+// processColor devuelve el color de una entrada: el que declare o uno fijo
+// derivado de su nombre, para que no cambie al reordenar el Procfile.
+func processColor(proc ProcfileEntry) ct.Color {
+	if c, err := parseColor(proc.Color); err == nil {
+		return c
+	}
+	h := fnv.New32a()
+	h.Write([]byte(proc.Name))
+	return colors[h.Sum32()%uint32(len(colors))]
+}
 
-	reader := bufio.NewReader(r)
+// colorEnabled decide según el modo de -color si se usan colores: en auto,
+// sólo si la salida es una terminal y NO_COLOR no está definida.
+func colorEnabled(mode string) (bool, error) {
+	switch mode {
+	case colorAlways:
+		return true, nil
+	case colorNever:
+		return false, nil
+	case "", colorAuto:
+		if os.Getenv("NO_COLOR") != "" {
+			return false, nil
+		}
+		fi, err := os.Stdout.Stat()
+		return err == nil && fi.Mode()&os.ModeCharDevice != 0, nil
+	}
+	return false, fmt.Errorf("invalid color mode %q (want auto, always or never)", mode)
+}
 
-	var buffer bytes.Buffer
+func NewOutletFactory() (of *OutletFactory) {
+	return &OutletFactory{
+		Format:     outputText,
+		Color:      true,
+		TimeFormat: defaultTimestampFormat,
+		started:    time.Now(),
+	}
+}
 
-	for {
-		buf := make([]byte, 1024)
+func readOutletConfig(config Config) error {
+	var errs configErrors
+	if config["output"] != "" {
+		flagOutput = config["output"]
+	}
+	if config["color"] != "" {
+		flagColor = config["color"]
+	}
+	if config["timestamp.format"] != "" {
+		flagTimestampFormat = config["timestamp.format"]
+	}
+	if config["prefix"] != "" {
+		flagPrefix = config["prefix"]
+	}
+	for key, value := range map[string]*bool{
+		"timestamp":         &flagTimestamp,
+		"timestamp.utc":     &flagTimestampUTC,
+		"timestamp.elapsed": &flagTimestampElapsed,
+	} {
+		errs.parseBool(key, config[key], value)
+	}
+	return errs.err()
+}
 
-		if n, err := reader.Read(buf); err != nil {
-			return
-		} else {
-			buf = buf[:n]
-		}
+// parseOutputFormat valida el formato de -output.
+func parseOutputFormat(value string) (string, error) {
+	switch value {
+	case "", outputText:
+		return outputText, nil
+	case outputJSON, outputLogfmt:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid output format %q (want text, json or logfmt)", value)
+}
 
-		for {
-			i := bytes.IndexByte(buf, '\n')
-			if i < 0 {
-				break
-			}
-			buffer.Write(buf[0:i])
-			of.WriteLine(name, buffer.String(), color, ct.None, isError)
-			buffer.Reset()
-			buf = buf[i+1:]
-		}
+// SetPrefix compila la plantilla del prefijo, en la que la función pad
+// rellena un valor hasta el ancho de la columna de nombres.
+func (of *OutletFactory) SetPrefix(text string) error {
+	tmpl, err := template.New("prefix").Funcs(template.FuncMap{
+		"pad": func(v interface{}) string { return fmt.Sprintf("%-*v", of.Padding, v) },
+	}).Parse(text)
+	if err != nil {
+		return fmt.Errorf("invalid prefix template: %v", err)
+	}
+	of.Prefix = tmpl
+	return nil
+}
+
+func (of *OutletFactory) structured() bool {
+	return of.Format == outputJSON || of.Format == outputLogfmt
+}
 
-		buffer.Write(buf)
+// ProcessOutput escribe un registro de la instancia src, que puede tener
+// varias líneas.
+func (of *OutletFactory) ProcessOutput(src outletSource, text string, isError bool) {
+	if of.structured() {
+		of.writeProcessRecord(src, text, isError)
+	} else {
+		of.WriteLine(src, text, src.Color, ct.None, isError)
 	}
 }
 
 func (of *OutletFactory) SystemOutput(str string) {
-	of.WriteLine("mango", str, ct.White, ct.None, false)
+	if of.structured() {
+		of.writeRecord(outletRecord{Source: "mango", Message: str})
+		return
+	}
+	of.WriteLine(systemSource(), str, ct.White, ct.None, false)
+}
+
+// systemSource identifica los mensajes del propio mango.
+func systemSource() outletSource {
+	return outletSource{Name: "mango", Process: "mango", Pid: os.Getpid()}
 }
 
 func (of *OutletFactory) ErrorOutput(str string) {
@@ -73,21 +240,141 @@ func (of *OutletFactory) ErrorOutput(str string) {
 }
 
 // Write out a single coloured line
-func (of *OutletFactory) WriteLine(left, right string, leftC, rightC ct.Color, isError bool) {
+func (of *OutletFactory) WriteLine(src outletSource, right string, leftC, rightC ct.Color, isError bool) {
 	of.Lock()
 	defer of.Unlock()
 
-	ct.ChangeColor(leftC, true, ct.None, false)
-	formatter := fmt.Sprintf("%%-%ds | ", of.Padding)
-	fmt.Printf(formatter, left)
+	// Un registro de varias líneas se escribe junto, con el prefijo en cada
+	// una.
+	for _, line := range strings.Split(right, "\n") {
+		if !of.Color {
+			fmt.Print(of.prefix(src, isError))
+			fmt.Println(line)
+			continue
+		}
+
+		ct.ChangeColor(leftC, true, ct.None, false)
+		fmt.Print(of.prefix(src, isError))
 
+		if isError {
+			ct.ChangeColor(ct.Red, true, ct.None, true)
+		} else {
+			ct.ResetColor()
+		}
+		fmt.Println(line)
+		if isError {
+			ct.ResetColor()
+		}
+	}
+}
+
+// prefix devuelve lo que precede a una línea de src en formato texto. Debe
+// llamarse con of tomado.
+func (of *OutletFactory) prefix(src outletSource, isError bool) string {
+	if of.Prefix == nil {
+		prefix := fmt.Sprintf("%-*s | ", of.Padding, src.Name)
+		if of.Timestamp {
+			prefix = of.timestamp(time.Now()) + " " + prefix
+		}
+		return prefix
+	}
+
+	data := outletPrefix{
+		Time:     of.timestamp(time.Now()),
+		Name:     src.Name,
+		Process:  src.Process,
+		Instance: src.Instance,
+		Pid:      src.Pid,
+		Stream:   "stdout",
+	}
 	if isError {
-		ct.ChangeColor(ct.Red, true, ct.None, true)
-	} else {
-		ct.ResetColor()
+		data.Stream = "stderr"
+	}
+	var b strings.Builder
+	if err := of.Prefix.Execute(&b, data); err != nil {
+		return fmt.Sprintf("%-*s | ", of.Padding, src.Name)
+	}
+	return b.String() + " "
+}
+
+// timestamp formatea t según la configuración de of.
+func (of *OutletFactory) timestamp(t time.Time) string {
+	if of.Elapsed {
+		return fmt.Sprintf("%9.3fs", t.Sub(of.started).Seconds())
 	}
-	fmt.Println(right)
+	if of.UTC {
+		t = t.UTC()
+	}
+	return t.Format(of.TimeFormat)
+}
+
+func (of *OutletFactory) writeProcessRecord(src outletSource, line string, isError bool) {
+	stream := "stdout"
 	if isError {
-		ct.ResetColor()
+		stream = "stderr"
+	}
+	of.writeRecord(outletRecord{
+		Source:   "process",
+		Process:  src.Process,
+		Instance: src.Instance,
+		Stream:   stream,
+		Pid:      src.Pid,
+		Message:  line,
+	})
+}
+
+// writeRecord escribe rec como un objeto JSON o una línea logfmt.
+func (of *OutletFactory) writeRecord(rec outletRecord) {
+	now := time.Now()
+	if of.UTC {
+		now = now.UTC()
+	}
+	rec.Time = now.Format(time.RFC3339Nano)
+
+	var line []byte
+	if of.Format == outputJSON {
+		line, _ = json.Marshal(rec)
+	} else {
+		line = rec.logfmt()
+	}
+
+	of.Lock()
+	defer of.Unlock()
+	stdout.Write(append(line, '\n'))
+}
+
+func (rec outletRecord) logfmt() []byte {
+	var b bytes.Buffer
+	pair := func(key, value string) {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(logfmtValue(value))
+	}
+	pair("time", rec.Time)
+	pair("source", rec.Source)
+	if rec.Process != "" {
+		pair("process", rec.Process)
+		pair("instance", strconv.Itoa(rec.Instance))
+		pair("stream", rec.Stream)
+		pair("pid", strconv.Itoa(rec.Pid))
+	}
+	pair("msg", rec.Message)
+	return b.Bytes()
+}
+
+// logfmtValue entrecomilla value si lleva espacios, comillas, '=' o
+// caracteres de control.
+func logfmtValue(value string) string {
+	if value == "" {
+		return `""`
+	}
+	if strings.IndexFunc(value, func(r rune) bool {
+		return r <= ' ' || r == '"' || r == '=' || r == '\\' || r == 0x7f
+	}) < 0 {
+		return value
 	}
+	return strconv.Quote(value)
 }
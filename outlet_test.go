@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	ct "github.com/daviddengcn/go-colortext"
+)
+
+func TestOutletJSON(t *testing.T) {
+	var buf strings.Builder
+	stdout = &buf
+	defer func() { stdout = os.Stdout }()
+
+	of := NewOutletFactory()
+	of.Format = outputJSON
+	of.writeProcessRecord(outletSource{Name: "web.2", Process: "web", Instance: 2, Pid: 42}, "hola", true)
+	of.SystemOutput("starting web")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("esperaba 2 líneas, obtuve %q", buf.String())
+	}
+	var rec outletRecord
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatalf("la línea no es JSON: %s", err)
+	}
+	if rec.Source != "process" || rec.Process != "web" || rec.Instance != 2 || rec.Stream != "stderr" || rec.Pid != 42 || rec.Message != "hola" || rec.Time == "" {
+		t.Fatalf("registro inesperado: %+v", rec)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &rec); err != nil || rec.Source != "mango" || rec.Message != "starting web" {
+		t.Fatalf("registro de sistema inesperado: %q", lines[1])
+	}
+}
+
+func TestOutletLogfmt(t *testing.T) {
+	rec := outletRecord{Time: "t", Source: "process", Process: "web", Instance: 1, Stream: "stdout", Pid: 7, Message: `dijo "hola" a=b`}
+	want := `time=t source=process process=web instance=1 stream=stdout pid=7 msg="dijo \"hola\" a=b"`
+	if got := string(rec.logfmt()); got != want {
+		t.Fatalf("esperaba %s, obtuve %s", want, got)
+	}
+	rec = outletRecord{Time: "t", Source: "mango", Message: ""}
+	if got := string(rec.logfmt()); got != `time=t source=mango msg=""` {
+		t.Fatalf("registro de sistema inesperado: %s", got)
+	}
+}
+
+func TestParseOutputFormat(t *testing.T) {
+	for value, want := range map[string]string{"": outputText, "text": outputText, "json": outputJSON, "logfmt": outputLogfmt} {
+		if got, err := parseOutputFormat(value); err != nil || got != want {
+			t.Fatalf("parseOutputFormat(%q) = %q, %v", value, got, err)
+		}
+	}
+	if _, err := parseOutputFormat("xml"); err == nil {
+		t.Fatalf("esperaba error para xml")
+	}
+}
+
+func TestOutletPrefix(t *testing.T) {
+	of := NewOutletFactory()
+	of.Padding = 6
+	src := outletSource{Name: "web.2", Process: "web", Instance: 2, Pid: 42}
+	if got := of.prefix(src, false); got != "web.2  | " {
+		t.Fatalf("prefijo por defecto inesperado: %q", got)
+	}
+
+	of.Timestamp, of.UTC, of.TimeFormat = true, true, "2006"
+	if got, want := of.prefix(src, false), time.Now().UTC().Format("2006")+" web.2  | "; got != want {
+		t.Fatalf("esperaba %q, obtuve %q", want, got)
+	}
+
+	if err := of.SetPrefix("{{pad .Name}}[{{.Pid}}] {{.Process}}/{{.Instance}} {{.Stream}} |"); err != nil {
+		t.Fatalf("SetPrefix no debería fallar: %s", err)
+	}
+	if got := of.prefix(src, true); got != "web.2 [42] web/2 stderr | " {
+		t.Fatalf("prefijo de plantilla inesperado: %q", got)
+	}
+	if err := of.SetPrefix("{{.Name"); err == nil {
+		t.Fatalf("esperaba error con una plantilla inválida")
+	}
+}
+
+func TestProcessColor(t *testing.T) {
+	web := processColor(ProcfileEntry{Name: "web"})
+	if processColor(ProcfileEntry{Name: "web"}) != web {
+		t.Fatalf("el color de una entrada debería depender sólo de su nombre")
+	}
+	if c := processColor(ProcfileEntry{Name: "web", Color: "white"}); c != ct.White {
+		t.Fatalf("esperaba el color declarado, obtuve %v", c)
+	}
+}
+
+func TestColorEnabled(t *testing.T) {
+	os.Setenv("NO_COLOR", "1")
+	defer os.Unsetenv("NO_COLOR")
+	for mode, want := range map[string]bool{"auto": false, "always": true, "never": false} {
+		if got, err := colorEnabled(mode); err != nil || got != want {
+			t.Fatalf("colorEnabled(%q) = %v, %v", mode, got, err)
+		}
+	}
+	if _, err := colorEnabled("sometimes"); err == nil {
+		t.Fatalf("esperaba error para un modo inválido")
+	}
+}
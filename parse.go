@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formatos de línea que entiende LogParser.
+const (
+	parseNone   = ""
+	parseJSON   = "json"
+	parseLogfmt = "logfmt"
+	parseAuto   = "auto" // JSON si la línea empieza por "{", si no logfmt
+)
+
+// Dónde se guarda en Loki el nivel de cada línea.
+const (
+	levelAsLabel    = "label"
+	levelAsMetadata = "metadata"
+)
+
+const (
+	defaultLevelFields = "level,lvl,severity"
+	defaultTimeFields  = "time,ts,timestamp"
+)
+
+var flagLokiParse string
+var flagLokiLevelField string
+var flagLokiTimeField string
+var flagLokiTimeFormat string
+var flagLokiUseTimestamp bool
+var flagLokiLevelAs string
+
+// lokiRegexRules son las reglas de extracción de cada proceso, declaradas en
+// .mango como loki.regex.web='^(?P<time>\S+) (?P<level>\w+)'.
+var lokiRegexRules = make(map[string]*regexp.Regexp)
+
+const lokiRegexPrefix = "loki.regex."
+
+func readParseConfig(config Config) error {
+	var errs configErrors
+	for key, value := range map[string]*string{
+		"loki.parse":       &flagLokiParse,
+		"loki.level_field": &flagLokiLevelField,
+		"loki.time_field":  &flagLokiTimeField,
+		"loki.time_format": &flagLokiTimeFormat,
+		"loki.level_as":    &flagLokiLevelAs,
+	} {
+		if config[key] != "" {
+			*value = config[key]
+		}
+	}
+	errs.parseBool("loki.use_timestamp", config["loki.use_timestamp"], &flagLokiUseTimestamp)
+	for key, value := range config {
+		if !strings.HasPrefix(key, lokiRegexPrefix) {
+			continue
+		}
+		re, err := parseRegexRule(value)
+		if err != nil {
+			errs.add(key, err)
+			continue
+		}
+		lokiRegexRules[strings.TrimPrefix(key, lokiRegexPrefix)] = re
+	}
+	return errs.err()
+}
+
+// parseRegexRule compila una regla de extracción, que debe capturar level,
+// time o ambos con grupos con nombre.
+func parseRegexRule(value string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(value)
+	if err != nil {
+		return nil, err
+	}
+	if re.SubexpIndex("level") < 0 && re.SubexpIndex("time") < 0 {
+		return nil, fmt.Errorf("regexp %q has no (?P<level>...) or (?P<time>...) group", value)
+	}
+	return re, nil
+}
+
+// LogParser extrae de cada línea su nivel y, si UseTime, su hora, que
+// reemplaza a la hora en que mango la leyó.
+type LogParser struct {
+	Format      string // parseNone, parseJSON, parseLogfmt o parseAuto
+	LevelFields []string
+	TimeFields  []string
+	TimeFormat  string // layout de Go; vacío reconoce RFC 3339 y epoch
+	UseTime     bool
+
+	// Rules son las expresiones regulares de cada proceso, que tienen
+	// prioridad sobre Format.
+	Rules map[string]*regexp.Regexp
+}
+
+// NewLogParser construye el LogParser de los flags, o nil si no hay nada que
+// extraer.
+func NewLogParser(format, levelFields, timeFields, timeFormat string, useTime bool, rules map[string]*regexp.Regexp) (*LogParser, error) {
+	switch format {
+	case parseNone, parseJSON, parseLogfmt, parseAuto:
+	default:
+		return nil, fmt.Errorf("invalid parse format %q (want json, logfmt or auto)", format)
+	}
+	if format == parseNone && len(rules) == 0 {
+		return nil, nil
+	}
+	return &LogParser{
+		Format:      format,
+		LevelFields: splitList(levelFields),
+		TimeFields:  splitList(timeFields),
+		TimeFormat:  timeFormat,
+		UseTime:     useTime,
+		Rules:       rules,
+	}, nil
+}
+
+// levelParser es el LogParser de los sinks que guardan el nivel en cada
+// registro, como OTLP: detecta el nivel de las líneas JSON y logfmt aunque
+// no se haya configurado loki.parse.
+func levelParser() (*LogParser, error) {
+	format := flagLokiParse
+	if format == parseNone {
+		format = parseAuto
+	}
+	return NewLogParser(format, flagLokiLevelField, flagLokiTimeField, flagLokiTimeFormat, flagLokiUseTimestamp, lokiRegexRules)
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Process rellena rec.Level y, si procede, rec.Time a partir de rec.Line.
+func (p *LogParser) Process(rec *LogRecord) {
+	if rec.Stream == "system" {
+		return
+	}
+	level, stamp := p.extract(rec)
+	if level != "" {
+		rec.Level = normalizeLevel(level)
+	}
+	if p.UseTime && stamp != "" {
+		if t, ok := parseLogTime(stamp, p.TimeFormat); ok {
+			rec.Time = t
+		}
+	}
+}
+
+func (p *LogParser) extract(rec *LogRecord) (level, stamp string) {
+	if re := p.Rules[rec.Process]; re != nil {
+		match := re.FindStringSubmatch(rec.Line)
+		if match == nil {
+			return "", ""
+		}
+		if i := re.SubexpIndex("level"); i >= 0 {
+			level = match[i]
+		}
+		if i := re.SubexpIndex("time"); i >= 0 {
+			stamp = match[i]
+		}
+		return level, stamp
+	}
+
+	var fields map[string]string
+	line := strings.TrimSpace(rec.Line)
+	switch {
+	case p.Format == parseJSON, p.Format == parseAuto && strings.HasPrefix(line, "{"):
+		fields = parseJSONFields(line)
+	case p.Format == parseLogfmt, p.Format == parseAuto:
+		fields = parseLogfmtFields(line)
+	}
+	return firstField(fields, p.LevelFields), firstField(fields, p.TimeFields)
+}
+
+func firstField(fields map[string]string, names []string) string {
+	for _, name := range names {
+		if value := fields[name]; value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// parseJSONFields devuelve los campos de primer nivel de un objeto JSON como
+// texto, o nil si line no lo es.
+func parseJSONFields(line string) map[string]string {
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.UseNumber()
+	var object map[string]interface{}
+	if err := dec.Decode(&object); err != nil {
+		return nil
+	}
+	fields := make(map[string]string, len(object))
+	for key, value := range object {
+		switch v := value.(type) {
+		case string:
+			fields[key] = v
+		case json.Number:
+			fields[key] = v.String()
+		case bool:
+			fields[key] = strconv.FormatBool(v)
+		}
+	}
+	return fields
+}
+
+// parseLogfmtFields devuelve los pares key=value de una línea logfmt; los
+// valores pueden ir entre comillas dobles con escapes.
+func parseLogfmtFields(line string) map[string]string {
+	fields := make(map[string]string)
+	for line != "" {
+		line = strings.TrimLeft(line, " \t")
+		end := strings.IndexAny(line, "= \t")
+		if end < 0 {
+			end = len(line)
+		}
+		key := line[:end]
+		line = line[end:]
+		if !strings.HasPrefix(line, "=") {
+			if key != "" {
+				fields[key] = "true"
+			}
+			continue
+		}
+		line = line[1:]
+		value := ""
+		if strings.HasPrefix(line, `"`) {
+			var buf bytes.Buffer
+			i := 1
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				buf.WriteByte(line[i])
+			}
+			value = buf.String()
+			if i < len(line) {
+				i++
+			}
+			line = line[i:]
+		} else {
+			end := strings.IndexAny(line, " \t")
+			if end < 0 {
+				end = len(line)
+			}
+			value, line = line[:end], line[end:]
+		}
+		if key != "" {
+			fields[key] = value
+		}
+	}
+	return fields
+}
+
+// normalizeLevel pasa a minúsculas el nivel y unifica las variantes más
+// comunes, para que warn y WARNING sean el mismo valor en Loki.
+func normalizeLevel(level string) string {
+	level = strings.ToLower(strings.TrimSpace(level))
+	switch level {
+	case "warning":
+		return "warn"
+	case "err":
+		return "error"
+	case "crit", "critical", "panic":
+		return "fatal"
+	case "dbg":
+		return "debug"
+	case "information":
+		return "info"
+	}
+	return level
+}
+
+// parseLogTime interpreta la hora de una línea con layout o, sin él, como
+// RFC 3339 o como epoch en segundos, milisegundos, microsegundos o
+// nanosegundos según su magnitud.
+func parseLogTime(value, layout string) (time.Time, bool) {
+	if layout != "" {
+		t, err := time.Parse(layout, value)
+		return t, err == nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999Z07:00", "2006-01-02T15:04:05.999999999"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f <= 0 {
+		return time.Time{}, false
+	}
+	switch {
+	case f >= 1e17:
+		return time.Unix(0, int64(f)), true
+	case f >= 1e14:
+		return time.UnixMicro(int64(f)), true
+	case f >= 1e11:
+		return time.UnixMilli(int64(f)), true
+	}
+	secs := int64(f)
+	return time.Unix(secs, int64((f-float64(secs))*1e9)), true
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestParseLogfmtFields(t *testing.T) {
+	got := parseLogfmtFields(`level=info msg="hola \"mundo\"" ts=1700000000 debug  path=/ empty=`)
+	want := map[string]string{
+		"level": "info",
+		"msg":   `hola "mundo"`,
+		"ts":    "1700000000",
+		"debug": "true",
+		"path":  "/",
+		"empty": "",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%q, se esperaba %q", got, want)
+	}
+}
+
+func TestLogParser(t *testing.T) {
+	stamp := time.Date(2024, 5, 1, 10, 0, 0, 500000000, time.UTC)
+	read := time.Date(2024, 5, 1, 10, 0, 3, 0, time.UTC)
+	rules := map[string]*regexp.Regexp{
+		"rails": regexp.MustCompile(`^(?P<level>[A-Z]), \[(?P<time>\S+)`),
+	}
+	parser, err := NewLogParser(parseAuto, defaultLevelFields, defaultTimeFields, "", true, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		process, line string
+		level         string
+		time          time.Time
+	}{
+		{"web", `{"level":"WARNING","time":"2024-05-01T10:00:00.5Z","msg":"x"}`, "warn", stamp},
+		{"web", `lvl=error ts=1714557600500 msg="boom"`, "error", stamp},
+		{"web", `{"severity":"info","ts":1714557600.5}`, "info", stamp},
+		{"web", `plain text line`, "", read},
+		{"web", `{"level":"debug","time":"yesterday"}`, "debug", read},
+		{"rails", `E, [2024-05-01T10:00:00.5Z #123] ERROR -- : boom`, "e", stamp},
+		{"rails", `level=info but no rule match`, "", read},
+	}
+	for _, test := range tests {
+		rec := LogRecord{Time: read, Process: test.process, Stream: "stdout", Line: test.line}
+		parser.Process(&rec)
+		if rec.Level != test.level {
+			t.Errorf("%q: nivel %q, se esperaba %q", test.line, rec.Level, test.level)
+		}
+		if !rec.Time.Equal(test.time) {
+			t.Errorf("%q: hora %s, se esperaba %s", test.line, rec.Time, test.time)
+		}
+	}
+
+	if parser, err := NewLogParser(parseNone, defaultLevelFields, defaultTimeFields, "", false, nil); parser != nil || err != nil {
+		t.Errorf("sin formato ni reglas: %v, %v; se esperaba nil", parser, err)
+	}
+	if _, err := NewLogParser("xml", defaultLevelFields, defaultTimeFields, "", false, nil); err == nil {
+		t.Error("se esperaba un error con un formato desconocido")
+	}
+}
+
+func TestParseLogTime(t *testing.T) {
+	want := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	for _, value := range []string{"2024-05-01T10:00:00Z", "1714557600", "1714557600000", "1714557600000000", "1714557600000000000"} {
+		if got, ok := parseLogTime(value, ""); !ok || !got.Equal(want) {
+			t.Errorf("parseLogTime(%q) = %s, %v; se esperaba %s", value, got, ok, want)
+		}
+	}
+	if got, ok := parseLogTime("01/05/2024 10:00", "02/01/2006 15:04"); !ok || !got.Equal(want) {
+		t.Errorf("con layout: %s, %v; se esperaba %s", got, ok, want)
+	}
+	if _, ok := parseLogTime("ayer", ""); ok {
+		t.Error("se esperaba un error con una hora no reconocida")
+	}
+}
+
+func TestReadParseConfig(t *testing.T) {
+	defer func() { lokiRegexRules = make(map[string]*regexp.Regexp) }()
+	if err := readParseConfig(Config{"loki.regex.web": `^(?P<level>\w+)`}); err != nil {
+		t.Fatal(err)
+	}
+	if lokiRegexRules["web"] == nil {
+		t.Error("no se ha leído la regla de web")
+	}
+	for _, value := range []string{`^(\w+)`, `^(?P<level>\w+`} {
+		if err := readParseConfig(Config{"loki.regex.web": value}); err == nil {
+			t.Errorf("%q: se esperaba un error", value)
+		}
+	}
+}
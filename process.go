@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"os"
 	"os/exec"
 	"syscall"
@@ -21,6 +22,15 @@ func NewProcess(workdir, command string, env Env, interactive bool) (p *Process)
 	}
 }
 
+// NewProcessContext es como NewProcess, pero el proceso se mata si ctx
+// termina antes que él.
+func NewProcessContext(ctx context.Context, workdir, command string, env Env, interactive bool) (p *Process) {
+	argv := ShellInvocationCommand(interactive, workdir, command)
+	return &Process{
+		command, env, interactive, exec.CommandContext(ctx, argv[0], argv[1:]...),
+	}
+}
+
 func (p *Process) Start() error {
 	p.Cmd.Env = p.Env.asArray()
 	p.PlatformSpecificInit()
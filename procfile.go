@@ -7,17 +7,67 @@ import (
 	"math"
 	"os"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var procfileEntryRegexp = regexp.MustCompile(`^([A-Za-z0-9_-]+):\s*(.+)$`)
 
+// procfileOptionRegexp reconoce las líneas "# mango: key=value" que declaran
+// opciones para la entrada que las sigue.
+var procfileOptionRegexp = regexp.MustCompile(`^#\s*mango:\s*([A-Za-z0-9_.-]+)\s*=\s*(.*)$`)
+
 type ProcfileEntry struct {
 	Name    string
 	Command string
+	Line    int
+
+	// Restart es la política de reinicio declarada para la entrada; vacía
+	// significa que se usa la del flag -r.
+	Restart RestartPolicy
+
+	// DependsOn nombra las entradas que deben estar listas antes de arrancar
+	// ésta; Ready dice cómo saber que ésta lo está.
+	DependsOn    []string
+	Ready        *ReadyCheck
+	ReadyTimeout time.Duration
+
+	// Health es el chequeo periódico de las instancias en marcha.
+	Health HealthCheck
+
+	// Color reemplaza el color que se le asigna por su nombre.
+	Color string
+
+	// Labels son etiquetas de Loki propias de la entrada.
+	Labels map[string]string
+
+	// Multiline junta en un registro las líneas de una traza;
+	// MultilineTimeout es cuánto se espera a la siguiente y
+	// MultilineMaxLines cuántas caben como mucho en un registro.
+	Multiline         *MultilineRule
+	MultilineTimeout  time.Duration
+	MultilineMaxLines int
+}
+
+// procfileOption es una opción pendiente de aplicar a la siguiente entrada.
+type procfileOption struct {
+	line       int
+	key, value string
 }
 
 type Procfile struct {
 	Entries []ProcfileEntry
+
+	// Skipped son las líneas que no son entradas, opciones, comentarios ni
+	// líneas en blanco, y que por tanto se ignoran.
+	Skipped []ProcfileLine
+}
+
+// ProcfileLine es una línea del Procfile con su número.
+type ProcfileLine struct {
+	Number int
+	Text   string
 }
 
 func ReadProcfile(filename string) (*Procfile, error) {
@@ -61,14 +111,122 @@ func (pf *Procfile) LongestProcessName(concurrency map[string]int) (longest int)
 func parseProcfile(r io.Reader) (*Procfile, error) {
 	pf := new(Procfile)
 	scanner := bufio.NewScanner(r)
+	var pending []procfileOption
+	lineNum := 0
 	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if option := procfileOptionRegexp.FindStringSubmatch(line); len(option) > 0 {
+			pending = append(pending, procfileOption{lineNum, option[1], strings.TrimSpace(option[2])})
+			continue
+		}
 		parts := procfileEntryRegexp.FindStringSubmatch(scanner.Text())
+		if len(parts) == 0 && line != "" && !strings.HasPrefix(line, "#") {
+			pf.Skipped = append(pf.Skipped, ProcfileLine{lineNum, scanner.Text()})
+		}
 		if len(parts) > 0 {
-			pf.Entries = append(pf.Entries, ProcfileEntry{parts[1], parts[2]})
+			entry := ProcfileEntry{Name: parts[1], Command: parts[2], Line: lineNum}
+			for _, option := range pending {
+				if err := entry.setOption(option.key, option.value); err != nil {
+					return nil, fmt.Errorf("Procfile line %d: %v", option.line, err)
+				}
+			}
+			pending = nil
+			pf.Entries = append(pf.Entries, entry)
 		}
 	}
 	if err := scanner.Err(); err != nil {
 		return nil, fmt.Errorf("reading Procfile: %v", err)
 	}
+	if len(pending) > 0 {
+		return nil, fmt.Errorf("Procfile line %d: option %q is not followed by a process", pending[0].line, pending[0].key)
+	}
+	if err := pf.checkDependencies(); err != nil {
+		return nil, err
+	}
 	return pf, nil
 }
+
+// setOption aplica a la entrada una opción declarada con "# mango: key=value".
+func (e *ProcfileEntry) setOption(key, value string) error {
+	switch key {
+	case "restart":
+		policy, err := parseRestartPolicy(value)
+		if err != nil {
+			return err
+		}
+		e.Restart = policy
+	case "depends_on":
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				e.DependsOn = append(e.DependsOn, name)
+			}
+		}
+	case "ready":
+		check, err := parseReadyCheck(value)
+		if err != nil {
+			return err
+		}
+		e.Ready = check
+	case "ready_timeout":
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid ready_timeout: %v", err)
+		}
+		e.ReadyTimeout = timeout
+	case "health":
+		kind, target, err := parseHealthCheck(value)
+		if err != nil {
+			return err
+		}
+		e.Health.Kind, e.Health.Target = kind, target
+	case "health_interval", "health_timeout":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid %s %q", key, value)
+		}
+		if key == "health_interval" {
+			e.Health.Interval = d
+		} else {
+			e.Health.Timeout = d
+		}
+	case "health_threshold":
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid health_threshold %q", value)
+		}
+		e.Health.Threshold = n
+	case "color":
+		if _, err := parseColor(value); err != nil {
+			return err
+		}
+		e.Color = value
+	case "multiline":
+		rule, err := parseMultilineRule(value)
+		if err != nil {
+			return err
+		}
+		e.Multiline = rule
+	case "multiline_timeout":
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid multiline_timeout %q", value)
+		}
+		e.MultilineTimeout = timeout
+	case "multiline_max_lines":
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid multiline_max_lines %q", value)
+		}
+		e.MultilineMaxLines = n
+	case "labels":
+		labels, err := parseLokiLabels(value)
+		if err != nil {
+			return err
+		}
+		e.Labels = labels
+	default:
+		return fmt.Errorf("unknown option %q", key)
+	}
+	return nil
+}
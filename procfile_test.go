@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseProcfileOptions(t *testing.T) {
+	pf, err := parseProcfile(strings.NewReader(`
+# mango: restart=once
+migrate: bin/migrate
+# a regular comment
+web: bin/web
+#mango:restart = on-failure
+worker: bin/worker
+`))
+	if err != nil {
+		t.Fatalf("parseProcfile no debería fallar: %s", err)
+	}
+	if len(pf.Entries) != 3 {
+		t.Fatalf("esperaba 3 entradas, obtuve %d", len(pf.Entries))
+	}
+	want := []RestartPolicy{RestartOnce, "", RestartOnFailure}
+	for i, entry := range pf.Entries {
+		if entry.Restart != want[i] {
+			t.Fatalf("%s: esperaba restart=%q, obtuve %q", entry.Name, want[i], entry.Restart)
+		}
+	}
+}
+
+func TestParseProcfileInvalidOptions(t *testing.T) {
+	cases := []string{
+		"# mango: restart=sometimes\nweb: bin/web\n",
+		"# mango: nope=1\nweb: bin/web\n",
+		"# mango: color=pink\nweb: bin/web\n",
+		"# mango: labels=__name__=x\nweb: bin/web\n",
+		"# mango: labels=tier\nweb: bin/web\n",
+		"web: bin/web\n# mango: restart=always\n",
+	}
+	for _, input := range cases {
+		if _, err := parseProcfile(strings.NewReader(input)); err == nil {
+			t.Fatalf("esperaba error para %q, pero no lo hubo", input)
+		}
+	}
+}
+
+func TestParseProcfileDependencies(t *testing.T) {
+	pf, err := parseProcfile(strings.NewReader(`
+# mango: depends_on=db-proxy, migrate
+web: bin/web
+# mango: ready=port:5432
+# mango: ready_timeout=10s
+db-proxy: bin/proxy
+# mango: depends_on=db-proxy
+migrate: bin/migrate
+`))
+	if err != nil {
+		t.Fatalf("parseProcfile no debería fallar: %s", err)
+	}
+	if got := pf.Entries[0].DependsOn; len(got) != 2 || got[0] != "db-proxy" || got[1] != "migrate" {
+		t.Fatalf("depends_on inesperado: %q", got)
+	}
+	if ready := pf.Entries[1].Ready; ready == nil || ready.Kind != "port" || ready.Target != "5432" {
+		t.Fatalf("ready inesperado: %#v", ready)
+	}
+
+	var order []string
+	for _, idx := range pf.StartOrder() {
+		order = append(order, pf.Entries[idx].Name)
+	}
+	if strings.Join(order, ",") != "db-proxy,migrate,web" {
+		t.Fatalf("orden de arranque inesperado: %q", order)
+	}
+}
+
+func TestParseProcfileDependencyErrors(t *testing.T) {
+	cases := map[string]string{
+		"# mango: depends_on=b\na: x\n# mango: depends_on=c\nb: y\n# mango: depends_on=a\nc: z\n": "dependency cycle: a -> b -> c -> a",
+		"# mango: depends_on=nope\na: x\n": `a depends on unknown process "nope"`,
+		"# mango: ready=udp:53\na: x\n":    `Procfile line 1: invalid ready check "udp:53" (expected port, log:<pattern> or cmd:<command>)`,
+	}
+	for input, want := range cases {
+		_, err := parseProcfile(strings.NewReader(input))
+		if err == nil || err.Error() != want {
+			t.Fatalf("para %q esperaba error %q, obtuve %v", input, want, err)
+		}
+	}
+}
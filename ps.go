@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"text/tabwriter"
+	"time"
+)
+
+var cmdPs = &Command{
+	Run:   runPs,
+	Usage: "ps [-s socket]",
+	Short: "List running processes",
+	Long: `
+List the instances of a running 'mango start' with their instance number,
+pid, state, uptime, number of restarts and port. The instance number n is the
+one control commands take, as in 'mango stop web.n'.
+
+  -s socket    Control socket of the running mango. Defaults to the value of
+               control_socket in .mango, or '.mango.sock'.
+
+Examples:
+
+  mango ps
+`,
+}
+
+func init() {
+	cmdPs.Flag.StringVar(&flagControlSocket, "s", defaultControlSocket, "control socket")
+}
+
+func runPs(cmd *Command, args []string) {
+	resp, err := controlCall(controlRequest{Command: "ps"})
+	handleError(err)
+	if resp.Error != "" {
+		handleError(fmt.Errorf("%s", resp.Error))
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tINSTANCE\tPID\tSTATE\tUPTIME\tRESTARTS\tPORT")
+	for _, inst := range resp.Instances {
+		pid, uptime, port := "-", "-", "-"
+		if inst.Pid > 0 {
+			pid = fmt.Sprint(inst.Pid)
+			uptime = (time.Duration(inst.Uptime) * time.Second).String()
+		}
+		if inst.Port > 0 {
+			port = fmt.Sprint(inst.Port)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%d\t%s\n", inst.Name, inst.Instance, pid, inst.State, uptime, inst.Restarts, port)
+	}
+	w.Flush()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// RestartPolicy decide qué hacer cuando una instancia termina.
+type RestartPolicy string
+
+const (
+	// RestartAlways reinicia la instancia siempre que termina.
+	RestartAlways RestartPolicy = "always"
+	// RestartOnFailure reinicia sólo si termina con error; si sale con 0 se
+	// da por completada.
+	RestartOnFailure RestartPolicy = "on-failure"
+	// RestartNever baja todo el stack en cuanto la instancia termina.
+	RestartNever RestartPolicy = "never"
+	// RestartOnce ejecuta la instancia una sola vez: si sale con 0 se da por
+	// completada, y si falla baja todo el stack.
+	RestartOnce RestartPolicy = "once"
+)
+
+func parseRestartPolicy(value string) (RestartPolicy, error) {
+	switch policy := RestartPolicy(value); policy {
+	case RestartAlways, RestartOnFailure, RestartNever, RestartOnce:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid restart policy %q (expected always, on-failure, never or once)", value)
+}
+
+// restartPolicy devuelve la política efectiva de la entrada: la declarada en
+// el Procfile o, si no tiene, la que implica el flag -r.
+func restartPolicy(proc ProcfileEntry) RestartPolicy {
+	if proc.Restart != "" {
+		return proc.Restart
+	}
+	if flagRestart {
+		return RestartAlways
+	}
+	return RestartNever
+}
+
+const defaultRestartBackoff = 1 * time.Second
+const defaultRestartBackoffMax = 30 * time.Second
+const defaultRestartBackoffMultiplier = 2.0
+const defaultRestartMax = 5
+const defaultRestartWindow = 60 * time.Second
+
+var flagRestartBackoff time.Duration
+var flagRestartBackoffMax time.Duration
+var flagRestartBackoffMultiplier float64
+var flagRestartMax int
+var flagRestartWindow time.Duration
+
+// readRestartConfig aplica las claves restart.* de .mango sobre los valores
+// por defecto de los flags.
+func readRestartConfig(config Config) error {
+	var errs configErrors
+	errs.parseDuration("restart.backoff", config["restart.backoff"], &flagRestartBackoff)
+	errs.parseDuration("restart.backoff_max", config["restart.backoff_max"], &flagRestartBackoffMax)
+	errs.parseFloat("restart.backoff_multiplier", config["restart.backoff_multiplier"], &flagRestartBackoffMultiplier)
+	errs.parseInt("restart.max", config["restart.max"], &flagRestartMax)
+	errs.parseDuration("restart.window", config["restart.window"], &flagRestartWindow)
+	return errs.err()
+}
+
+// restartBudget lleva la cuenta de los reinicios de una instancia y calcula
+// cuánto esperar antes del siguiente.
+type restartBudget struct {
+	initial    time.Duration
+	max        time.Duration
+	multiplier float64
+
+	// limit reinicios como máximo dentro de window; 0 desactiva el límite.
+	limit  int
+	window time.Duration
+
+	delay    time.Duration
+	restarts []time.Time
+}
+
+func newRestartBudget() *restartBudget {
+	return &restartBudget{
+		initial:    flagRestartBackoff,
+		max:        flagRestartBackoffMax,
+		multiplier: flagRestartBackoffMultiplier,
+		limit:      flagRestartMax,
+		window:     flagRestartWindow,
+	}
+}
+
+// next registra un reinicio en now y devuelve la espera previa a lanzarlo.
+// Devuelve ok=false cuando ya se alcanzó el límite de reinicios dentro de la
+// ventana. Si no hubo reinicios dentro de la ventana, la espera vuelve al
+// valor inicial.
+func (b *restartBudget) next(now time.Time) (delay time.Duration, ok bool) {
+	if b.window > 0 {
+		cutoff := now.Add(-b.window)
+		kept := b.restarts[:0]
+		for _, t := range b.restarts {
+			if t.After(cutoff) {
+				kept = append(kept, t)
+			}
+		}
+		b.restarts = kept
+	}
+	if len(b.restarts) == 0 {
+		b.delay = 0
+	}
+	if b.limit > 0 && len(b.restarts) >= b.limit {
+		return 0, false
+	}
+
+	if b.delay == 0 {
+		b.delay = b.initial
+	} else {
+		b.delay = time.Duration(float64(b.delay) * b.multiplier)
+	}
+	if b.max > 0 && b.delay > b.max {
+		b.delay = b.max
+	}
+	b.restarts = append(b.restarts, now)
+	return b.delay, true
+}
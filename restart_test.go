@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestartBudgetBackoff(t *testing.T) {
+	b := &restartBudget{initial: time.Second, max: 5 * time.Second, multiplier: 2, window: time.Minute}
+	now := time.Now()
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		delay, ok := b.next(now.Add(time.Duration(i) * time.Second))
+		if !ok {
+			t.Fatalf("reinicio %d: no debería agotar el presupuesto sin límite", i)
+		}
+		if delay != w {
+			t.Fatalf("reinicio %d: esperaba espera %s, obtuve %s", i, w, delay)
+		}
+	}
+}
+
+func TestRestartBudgetLimit(t *testing.T) {
+	b := &restartBudget{initial: time.Second, max: time.Minute, multiplier: 2, limit: 2, window: time.Minute}
+	now := time.Now()
+	if _, ok := b.next(now); !ok {
+		t.Fatal("el primer reinicio debería permitirse")
+	}
+	if _, ok := b.next(now.Add(time.Second)); !ok {
+		t.Fatal("el segundo reinicio debería permitirse")
+	}
+	if _, ok := b.next(now.Add(2 * time.Second)); ok {
+		t.Fatal("el tercer reinicio dentro de la ventana debería rechazarse")
+	}
+}
+
+func TestRestartBudgetWindowResets(t *testing.T) {
+	b := &restartBudget{initial: time.Second, max: time.Minute, multiplier: 2, limit: 2, window: time.Minute}
+	now := time.Now()
+	b.next(now)
+	b.next(now.Add(time.Second))
+
+	delay, ok := b.next(now.Add(2 * time.Minute))
+	if !ok {
+		t.Fatal("fuera de la ventana el reinicio debería permitirse")
+	}
+	if delay != time.Second {
+		t.Fatalf("fuera de la ventana esperaba volver a %s, obtuve %s", time.Second, delay)
+	}
+}
+
+func TestReadRestartConfig(t *testing.T) {
+	defer func(b, m time.Duration, x float64, n int, w time.Duration) {
+		flagRestartBackoff, flagRestartBackoffMax, flagRestartBackoffMultiplier, flagRestartMax, flagRestartWindow = b, m, x, n, w
+	}(flagRestartBackoff, flagRestartBackoffMax, flagRestartBackoffMultiplier, flagRestartMax, flagRestartWindow)
+
+	config := Config{
+		"restart.backoff":            "500ms",
+		"restart.backoff_max":        "10s",
+		"restart.backoff_multiplier": "1.5",
+		"restart.max":                "3",
+		"restart.window":             "2m",
+	}
+	if err := readRestartConfig(config); err != nil {
+		t.Fatalf("readRestartConfig no debería fallar: %s", err)
+	}
+	if flagRestartBackoff != 500*time.Millisecond || flagRestartBackoffMax != 10*time.Second {
+		t.Fatalf("backoff inesperado: %s / %s", flagRestartBackoff, flagRestartBackoffMax)
+	}
+	if flagRestartBackoffMultiplier != 1.5 || flagRestartMax != 3 || flagRestartWindow != 2*time.Minute {
+		t.Fatalf("valores inesperados: %v / %d / %s", flagRestartBackoffMultiplier, flagRestartMax, flagRestartWindow)
+	}
+
+	if err := readRestartConfig(Config{"restart.window": "nope"}); err == nil {
+		t.Fatal("esperaba error para restart.window inválido")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+var cmdScale = &Command{
+	Run:   runScale,
+	Usage: "scale <name>=<count>... [-s socket]",
+	Short: "Change the number of instances of a process",
+	Long: `
+Change the number of instances of one or more processes of a running
+'mango start'. New instances get ports following the same scheme as -c, and
+surplus instances are stopped gracefully, newest first, honoring the shutdown
+grace time. A process scaled to 0 stays known and can be scaled up again,
+but once no instance of any process is left mango exits, as when they all
+finish. Instances added by scale do not count towards the ready check that
+dependents wait for.
+Instances that are still starting cannot be removed: scale stops at the
+first one, reports an error and leaves it and the older instances running.
+
+  -s socket    Control socket of the running mango. Defaults to the value of
+               control_socket in .mango, or '.mango.sock'.
+
+Examples:
+
+  mango scale web=3
+  mango scale web=1 worker=0
+`,
+}
+
+func init() {
+	cmdScale.Flag.StringVar(&flagControlSocket, "s", defaultControlSocket, "control socket")
+}
+
+func runScale(cmd *Command, args []string) {
+	if len(args) < 1 {
+		cmd.printUsage()
+		os.Exit(1)
+	}
+	target := strings.Join(args, ",")
+	_, err := parseConcurrency(target)
+	handleError(err)
+
+	resp, err := controlCall(controlRequest{Command: "scale", Target: target})
+	handleError(err)
+	if resp.Message != "" {
+		Println(resp.Message)
+	}
+	if resp.Error != "" {
+		handleError(fmt.Errorf("%s", resp.Error))
+	}
+}
+
+func (f *mango) handleScale(target string) controlResponse {
+	counts, err := parseConcurrency(target)
+	if err != nil {
+		return controlResponse{Error: err.Error()}
+	}
+
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		if _, ok := f.states[name]; !ok {
+			return controlResponse{Error: fmt.Sprintf("no such process: %s", name)}
+		}
+		if counts[name] < 0 {
+			return controlResponse{Error: fmt.Sprintf("invalid count for %s: %d", name, counts[name])}
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var done []string
+	for _, name := range names {
+		if err := f.scale(name, counts[name]); err != nil {
+			if len(done) > 0 {
+				f.outletFactory.SystemOutput(fmt.Sprintf("control: scale %s", strings.Join(done, ", ")))
+			}
+			return controlResponse{Error: fmt.Sprintf("cannot scale %s to %d: %v", name, counts[name], err)}
+		}
+		done = append(done, fmt.Sprintf("%s=%d", name, counts[name]))
+	}
+	f.outletFactory.SystemOutput(fmt.Sprintf("control: scale %s", strings.Join(done, ", ")))
+	return controlResponse{Message: fmt.Sprintf("scaled %s", strings.Join(done, ", "))}
+}
+
+// scale lleva la entrada name a count instancias: lanza las que faltan con
+// los siguientes números de instancia y quita las sobrantes, de la más nueva
+// a la más antigua. Una instancia sólo sale de la lista cuando se ha pedido
+// su parada; si alguna no se puede parar, por ejemplo porque aún está
+// arrancando, se deja de reducir y se devuelve el error.
+func (f *mango) scale(name string, count int) error {
+	f.scaleMu.Lock()
+	defer f.scaleMu.Unlock()
+
+	st := f.states[name]
+	list := st.snapshot()
+	current := len(list)
+	for i := current - 1; i >= count; i-- {
+		if err := f.stopInstance(list[i], requestRemove); err != nil {
+			return err
+		}
+		st.mu.Lock()
+		st.list = st.list[:i]
+		st.mu.Unlock()
+	}
+
+	if count > current {
+		f.growPadding(name, count)
+		for i := current; i < count; i++ {
+			f.startProcess(st.idx, i, st.proc, f.env, f.outletFactory)
+		}
+	}
+	return nil
+}
+
+// growPadding ensancha la columna de nombres para que quepa name.count.
+func (f *mango) growPadding(name string, count int) {
+	width := len(name) + 1 + int(math.Log10(float64(count))) + 1
+	of := f.outletFactory
+	of.Lock()
+	defer of.Unlock()
+	if width > of.Padding {
+		of.Padding = width
+	}
+}
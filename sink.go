@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sinkQueueSize es cuántos registros puede tener pendientes cada sink antes
+// de empezar a descartarlos.
+const sinkQueueSize = 4096
+
+// LogRecord es una línea de log de una instancia o, con Process "mango", un
+// mensaje del propio mango.
+type LogRecord struct {
+	Time     time.Time
+	Name     string // nombre visible, como web.2
+	Process  string // nombre de la entrada del Procfile
+	Instance int    // número de instancia empezando en 1
+	Stream   string // stdout, stderr o system
+	Pid      int
+	Line     string
+
+	// Level es el nivel extraído de la línea por un LogParser, si lo hay.
+	Level string
+}
+
+// LogSink es un destino de los logs. Send puede tardar lo que necesite: el
+// dispatcher lo llama desde una goroutine propia de cada sink. Close envía lo
+// pendiente y libera el sink.
+type LogSink interface {
+	Send(rec LogRecord)
+	Close()
+}
+
+// logSinkFactories abre los sinks configurados; cada una devuelve un sink
+// nil si el suyo no lo está. Añadir un sink es añadir una entrada aquí.
+var logSinkFactories = []struct {
+	name string
+	open func(of *OutletFactory, pf *Procfile) (LogSink, error)
+}{
+	{"loki", openLokiSink},
+	{"otlp", openOTLPSink},
+	{"syslog", openSyslogSink},
+	{"webhook", openWebhookSink},
+	{"elasticsearch", openElasticsearchSink},
+	{"forward", openForwardSink},
+	{"file", openFileSink},
+}
+
+// openLogSinks abre todos los sinks configurados para los procesos de pf.
+func openLogSinks(of *OutletFactory, pf *Procfile) (*LogDispatcher, error) {
+	d := NewLogDispatcher()
+	for _, factory := range logSinkFactories {
+		sink, err := factory.open(of, pf)
+		if err != nil {
+			d.Close(of)
+			return nil, fmt.Errorf("%s sink: %v", factory.name, err)
+		}
+		if sink != nil {
+			d.Add(factory.name, sink)
+		}
+	}
+	return d, nil
+}
+
+// LogDispatcher reparte cada registro a todos los sinks sin bloquear: cada
+// sink tiene su cola y, si está llena, el registro se descarta para él.
+type LogDispatcher struct {
+	mu     sync.RWMutex
+	queues []*sinkQueue
+	closed bool
+}
+
+type sinkQueue struct {
+	name    string
+	sink    LogSink
+	records chan LogRecord
+	dropped int64
+	done    chan struct{}
+}
+
+func NewLogDispatcher() *LogDispatcher {
+	return &LogDispatcher{}
+}
+
+// Add registra sink y arranca la goroutine que le entrega los registros.
+func (d *LogDispatcher) Add(name string, sink LogSink) {
+	q := &sinkQueue{
+		name:    name,
+		sink:    sink,
+		records: make(chan LogRecord, sinkQueueSize),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(q.done)
+		for rec := range q.records {
+			sink.Send(rec)
+		}
+	}()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.queues = append(d.queues, q)
+}
+
+// Enabled dice si hay algún sink al que repartir.
+func (d *LogDispatcher) Enabled() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return len(d.queues) > 0 && !d.closed
+}
+
+// Dispatch encola rec en todos los sinks sin esperar a ninguno.
+func (d *LogDispatcher) Dispatch(rec LogRecord) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return
+	}
+	for _, q := range d.queues {
+		select {
+		case q.records <- rec:
+		default:
+			atomic.AddInt64(&q.dropped, 1)
+		}
+	}
+}
+
+// Close entrega lo que quede en las colas, cierra los sinks e informa de los
+// registros descartados.
+func (d *LogDispatcher) Close(of *OutletFactory) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	queues := d.queues
+	d.mu.Unlock()
+
+	for _, q := range queues {
+		close(q.records)
+		<-q.done
+		q.sink.Close()
+		if dropped := atomic.LoadInt64(&q.dropped); dropped > 0 {
+			of.SystemOutput(fmt.Sprintf("%s sink dropped %d lines", q.name, dropped))
+		}
+	}
+}
+
+// processRecord es el registro de text, escrito por la instancia src a partir
+// de t.
+func processRecord(src outletSource, isError bool, t time.Time, text string) LogRecord {
+	stream := "stdout"
+	if isError {
+		stream = "stderr"
+	}
+	return LogRecord{
+		Time:     t,
+		Name:     src.Name,
+		Process:  src.Process,
+		Instance: src.Instance,
+		Stream:   stream,
+		Pid:      src.Pid,
+		Line:     text,
+	}
+}
+
+// systemRecord es el registro de un mensaje del propio mango.
+func systemRecord(msg string) LogRecord {
+	src := systemSource()
+	return LogRecord{
+		Time:    time.Now(),
+		Name:    src.Name,
+		Process: src.Process,
+		Stream:  "system",
+		Pid:     src.Pid,
+		Line:    msg,
+	}
+}
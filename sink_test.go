@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memorySink guarda los registros; si block no es nil, Send espera a que se
+// cierre.
+type memorySink struct {
+	block chan struct{}
+
+	mu      sync.Mutex
+	records []LogRecord
+	closed  bool
+}
+
+func (s *memorySink) Send(rec LogRecord) {
+	if s.block != nil {
+		<-s.block
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, rec)
+}
+
+func (s *memorySink) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+}
+
+func TestLogDispatcherFanOut(t *testing.T) {
+	a, b := &memorySink{}, &memorySink{}
+	d := NewLogDispatcher()
+	d.Add("a", a)
+	d.Add("b", b)
+
+	src := outletSource{Name: "web.2", Process: "web", Instance: 2, Pid: 42}
+	readLines(strings.NewReader("primera\r\nsegunda\n"), func(line string) {
+		d.Dispatch(processRecord(src, true, time.Now(), line))
+	})
+	d.Close(NewOutletFactory())
+
+	for _, sink := range []*memorySink{a, b} {
+		if !sink.closed {
+			t.Fatalf("el sink debería estar cerrado")
+		}
+		if len(sink.records) != 2 {
+			t.Fatalf("esperaba 2 registros, obtuve %d", len(sink.records))
+		}
+		rec := sink.records[1]
+		if rec.Line != "segunda" || rec.Name != "web.2" || rec.Process != "web" || rec.Instance != 2 || rec.Stream != "stderr" || rec.Pid != 42 {
+			t.Fatalf("registro inesperado: %+v", rec)
+		}
+		if sink.records[0].Line != "primera" {
+			t.Fatalf("esperaba la primera línea sin \\r, obtuve %q", sink.records[0].Line)
+		}
+	}
+
+	// Tras cerrar, los registros se ignoran.
+	d.Dispatch(systemRecord("tarde"))
+}
+
+func TestLogDispatcherDoesNotBlock(t *testing.T) {
+	slow := &memorySink{block: make(chan struct{})}
+	d := NewLogDispatcher()
+	d.Add("slow", slow)
+
+	// Dispatch no debe esperar al sink bloqueado.
+	total := sinkQueueSize * 2
+	for i := 0; i < total; i++ {
+		d.Dispatch(systemRecord("línea"))
+	}
+	close(slow.block)
+
+	var out strings.Builder
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	of := NewOutletFactory()
+	of.Format = outputLogfmt
+	d.Close(of)
+
+	if len(slow.records) >= total || len(slow.records) < sinkQueueSize {
+		t.Fatalf("el sink lento debería haber perdido registros, recibió %d de %d", len(slow.records), total)
+	}
+	if !strings.Contains(out.String(), "slow sink dropped") {
+		t.Fatalf("esperaba el aviso de descartes, obtuve %q", out.String())
+	}
+}
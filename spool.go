@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const defaultSpoolMaxSize = "100M"
+
+// spool guarda en disco los lotes que no se han podido enviar, como ficheros
+// de segmento numerados (000000000001.spool, ...) con un registro JSON por
+// línea, para reenviarlos en orden más tarde o tras reiniciar mango.
+type spool struct {
+	dir     string
+	maxSize int64
+
+	mu       sync.Mutex
+	segments []spoolSegment // del más antiguo al más nuevo
+	size     int64
+	seq      uint64
+}
+
+type spoolSegment struct {
+	path  string
+	size  int64
+	lines int
+}
+
+// openSpool abre el spool de dir, recuperando los segmentos que dejara una
+// ejecución anterior.
+func openSpool(dir string, maxSize int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &spool{dir: dir, maxSize: maxSize}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".spool") {
+			// Restos de una escritura interrumpida.
+			if strings.HasSuffix(name, ".tmp") {
+				os.Remove(filepath.Join(dir, name))
+			}
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, ".spool"), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		path := filepath.Join(dir, name)
+		s.segments = append(s.segments, spoolSegment{path: path, size: info.Size(), lines: countLines(path)})
+		s.size += info.Size()
+		if seq > s.seq {
+			s.seq = seq
+		}
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].path < s.segments[j].path })
+	return s, nil
+}
+
+// Pending dice cuántas líneas hay en el spool.
+func (s *spool) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, seg := range s.segments {
+		n += seg.lines
+	}
+	return n
+}
+
+// Write guarda batch como un segmento nuevo. Si el spool supera maxSize se
+// descartan segmentos, los más antiguos o, con dropNewest, el nuevo; dropped
+// es el número de líneas perdidas.
+func (s *spool) Write(batch []LogRecord, drop string) (dropped int, err error) {
+	var buf strings.Builder
+	enc := json.NewEncoder(&buf)
+	for _, rec := range batch {
+		if err := enc.Encode(rec); err != nil {
+			return 0, err
+		}
+	}
+	size := int64(buf.Len())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxSize > 0 {
+		if drop == dropNewest && s.size+size > s.maxSize {
+			return len(batch), nil
+		}
+		for len(s.segments) > 0 && s.size+size > s.maxSize {
+			dropped += s.segments[0].lines
+			s.removeFirst()
+		}
+	}
+
+	s.seq++
+	path := filepath.Join(s.dir, fmt.Sprintf("%012d.spool", s.seq))
+	if err := os.WriteFile(path+".tmp", []byte(buf.String()), 0644); err != nil {
+		return dropped, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return dropped, err
+	}
+	s.segments = append(s.segments, spoolSegment{path: path, size: size, lines: len(batch)})
+	s.size += size
+	return dropped, nil
+}
+
+// Oldest devuelve el segmento más antiguo, o ok=false si no hay ninguno.
+func (s *spool) Oldest() (batch []LogRecord, ok bool, err error) {
+	s.mu.Lock()
+	if len(s.segments) == 0 {
+		s.mu.Unlock()
+		return nil, false, nil
+	}
+	path := s.segments[0].path
+	s.mu.Unlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, true, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var rec LogRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, true, fmt.Errorf("%s: %v", path, err)
+		}
+		batch = append(batch, rec)
+	}
+	return batch, true, scanner.Err()
+}
+
+// RemoveOldest borra el segmento más antiguo, una vez enviado o si no se
+// puede leer, y devuelve cuántas líneas tenía.
+func (s *spool) RemoveOldest() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.segments) == 0 {
+		return 0
+	}
+	lines := s.segments[0].lines
+	s.removeFirst()
+	return lines
+}
+
+func (s *spool) removeFirst() {
+	seg := s.segments[0]
+	os.Remove(seg.path)
+	s.size -= seg.size
+	s.segments = s.segments[1:]
+}
+
+func countLines(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	n := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		n++
+	}
+	return n
+}
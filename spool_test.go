@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSpoolWriteAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool(dir, 0)
+	if err != nil {
+		t.Fatalf("openSpool no debería fallar: %s", err)
+	}
+	s.Write([]LogRecord{{Name: "web", Line: "a"}, {Name: "web", Line: "b"}}, dropOldest)
+	s.Write([]LogRecord{{Name: "web", Line: "c"}}, dropOldest)
+
+	// Otra ejecución encuentra los segmentos en el mismo orden.
+	s, err = openSpool(dir, 0)
+	if err != nil {
+		t.Fatalf("openSpool no debería fallar: %s", err)
+	}
+	if n := s.Pending(); n != 3 {
+		t.Fatalf("esperaba 3 líneas pendientes, obtuve %d", n)
+	}
+	var lines []string
+	for {
+		batch, ok, err := s.Oldest()
+		if !ok {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Oldest no debería fallar: %s", err)
+		}
+		for _, rec := range batch {
+			lines = append(lines, rec.Line)
+		}
+		s.RemoveOldest()
+	}
+	if strings.Join(lines, "") != "abc" {
+		t.Fatalf("esperaba abc, obtuve %v", lines)
+	}
+
+	s.Write([]LogRecord{{Line: "d"}}, dropOldest)
+	if s, _ = openSpool(dir, 0); s.Pending() != 1 {
+		t.Fatalf("la numeración debería continuar tras reabrir")
+	}
+}
+
+func TestSpoolMaxSize(t *testing.T) {
+	for policy, want := range map[string]string{dropOldest: "23", dropNewest: "01"} {
+		s, _ := openSpool(t.TempDir(), 0)
+		one := []LogRecord{{Line: "0"}}
+		s.Write(one, policy)
+		s.maxSize = 2 * s.size
+
+		s.Write([]LogRecord{{Line: "1"}}, policy)
+		dropped, _ := s.Write([]LogRecord{{Line: "2"}}, policy)
+		s.Write([]LogRecord{{Line: "3"}}, policy)
+		if dropped != 1 {
+			t.Fatalf("%s: esperaba descartar 1 línea, descarté %d", policy, dropped)
+		}
+
+		var lines []string
+		for {
+			batch, ok, _ := s.Oldest()
+			if !ok {
+				break
+			}
+			lines = append(lines, batch[0].Line)
+			s.RemoveOldest()
+		}
+		if strings.Join(lines, "") != want {
+			t.Fatalf("%s: esperaba %s, obtuve %v", policy, want, lines)
+		}
+	}
+}
+
+func TestBatcherSpoolsAndReplays(t *testing.T) {
+	s, _ := openSpool(t.TempDir(), 0)
+	cfg := testBatchConfig()
+	cfg.RetryFor = 0
+	cfg.Spool = s
+
+	var mu sync.Mutex
+	up := false
+	var sent []string
+	cfg.Ready = func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return up
+	}
+	send := func(batch []LogRecord) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !up {
+			return errors.New("connection refused")
+		}
+		for _, rec := range batch {
+			sent = append(sent, rec.Line)
+		}
+		return nil
+	}
+
+	b := newBatcher("test", cfg, send, func(string) {})
+	for i := 0; i < 4; i++ {
+		b.Add(LogRecord{Line: fmt.Sprint(i)})
+	}
+	deadline := time.Now().Add(time.Second)
+	for s.Pending() < 4 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if s.Pending() != 4 {
+		t.Fatalf("esperaba 4 líneas en el spool, hay %d", s.Pending())
+	}
+
+	mu.Lock()
+	up = true
+	mu.Unlock()
+	b.Add(LogRecord{Line: "4"})
+	b.Close()
+
+	if strings.Join(sent, ",") != "0,1,2,3,4" {
+		t.Fatalf("esperaba reenviar en orden 0..4, obtuve %v", sent)
+	}
+	if s.Pending() != 0 {
+		t.Fatalf("el spool debería haberse vaciado")
+	}
+}
+
+func TestBatcherSkipsCorruptSegment(t *testing.T) {
+	dir := t.TempDir()
+	// Un segmento truncado por una caída a mitad de escritura, y otro sano.
+	os.WriteFile(filepath.Join(dir, "000000000001.spool"), []byte("{\"Line\":\"a\"}\n{\"Li"), 0644)
+	os.WriteFile(filepath.Join(dir, "000000000002.spool"), []byte("{\"Line\":\"b\"}\n"), 0644)
+	s, err := openSpool(dir, 0)
+	if err != nil {
+		t.Fatalf("openSpool no debería fallar: %s", err)
+	}
+	cfg := testBatchConfig()
+	cfg.Spool = s
+
+	var mu sync.Mutex
+	var sent []string
+	send := func(batch []LogRecord) error {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rec := range batch {
+			sent = append(sent, rec.Line)
+		}
+		return nil
+	}
+	b := newBatcher("test", cfg, send, func(string) {})
+	b.Add(LogRecord{Line: "c"})
+	b.Close()
+
+	if strings.Join(sent, ",") != "b,c" {
+		t.Fatalf("esperaba reenviar b,c saltando el segmento dañado, obtuve %v", sent)
+	}
+	if n := atomic.LoadInt64(&b.droppedFailed); n != 2 {
+		t.Fatalf("esperaba 2 líneas perdidas, obtuve %d", n)
+	}
+	if s.Pending() != 0 {
+		t.Fatalf("el spool debería haberse vaciado")
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
 	"io"
@@ -11,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -24,12 +24,14 @@ var flagRestart bool
 var flagShutdownGraceTime int
 var envs envFiles
 
+// configErr son los valores de .mango que no se han podido leer. Todos los
+// comandos salvo check, que informa de ellos, fallan al arrancar si los hay.
+var configErr error
+
 // Nuevos flags para Loki
 var flagLokiURL string
 var flagLokiJob string
 
-var lokiClient *LokiClient
-
 var cmdStart = &Command{
 	Run:   runStart,
 	Usage: "start [process name] [-f procfile] [-e env] [-p port] [-c concurrency] [-r] [-t shutdown_grace_time]",
@@ -48,28 +50,205 @@ The following options are available:
                specified, a file called .env is used if it exists.
 
   -p port      Sets the base port number; each process will have a PORT variable
-               in its environment set to a unique value based on this. This may
-               also be set via a PORT variable in the environment, or in an
+               in its environment set to a unique value based on this: the
+               n-th instance of the i-th process gets port + i*100 + n. This
+               may also be set via a PORT variable in the environment, or in an
                environment file, and otherwise defaults to 5000.
 
   -c concurrency
                Start a specific number of instances of each process. The
                argument should be in the format 'foo=1,bar=2,baz=0'. Use the
                name 'all' to set the default number of instances. By default,
-               one instance of each process is started.
+               one instance of each process is started. The number of instances
+               can be changed later with 'mango scale'.
 
   -r           Restart a process which exits. Without this, if a process exits,
-               mango will kill all other processes and exit.
+               mango will kill all other processes and exit. This is the
+               default for processes without a restart policy in the Procfile
+               (see below).
+
+  -restart.backoff delay
+               Delay before the first restart of a process, e.g. '500ms' or
+               '2s'. Each consecutive restart multiplies the delay by
+               -restart.backoff_multiplier (default 2), up to
+               -restart.backoff_max (default 30s). Defaults to 1s.
+
+  -restart.max count
+               Give up on a process once it has been restarted this many times
+               within -restart.window (default 60s); mango then kills all other
+               processes and exits. Use 0 to restart forever. Defaults to 5.
 
   -t shutdown_grace_time
                Set the shutdown grace time that each process is given after
                being asked to stop. Once this grace time expires, the process is
                forcibly terminated. By default, it is 3 seconds.
 
+  -output format
+               Print output as 'text' (the default), 'json' or 'logfmt'. The
+               last two write one record per line with time, source ('process'
+               or 'mango'), process, instance, stream, pid and message, without
+               colors or padding.
+
+  -color mode  Whether to color text output: 'auto' (the default) colors it
+               only when stdout is a terminal and NO_COLOR is not set, 'always'
+               and 'never' force it on or off.
+
+  -timestamp   Prefix each line with the time, formatted with
+               -timestamp.format (a Go time layout, default '15:04:05'), in
+               UTC with -timestamp.utc. With -timestamp.elapsed the time is the
+               number of seconds since mango started instead.
+
+  -prefix template
+               Replace the 'name | ' prefix of each line with a Go template,
+               e.g. '{{.Time}} {{pad .Name}} [{{.Pid}}] |'. The template gets
+               .Time, .Name (e.g. web.2), .Process (e.g. web), .Instance, .Pid
+               and .Stream (stdout or stderr); pad fills a value up to the
+               width of the longest name.
+
+  -log.dir directory
+               Also write the output of each instance to directory/web.1.log,
+               or of every instance to directory/mango.log with
+               -log.combined. Files are rotated once they exceed
+               -log.max_size (default 10M; 0 disables it) or are older than
+               -log.max_age (e.g. 24h; disabled by default), keeping
+               -log.max_files rotated files (default 5), gzipped with
+               -log.compress.
+
+  -strict      Validate the Procfile, env files and .mango as 'mango check'
+               does, and refuse to start if there is any problem.
+
+  -s socket    Set the path of the control socket used by 'mango ps',
+               'mango restart', 'mango stop' and 'mango start-proc'. Defaults to
+               '.mango.sock'.
+
+  -loki.url url
+               Send every line to Loki, e.g.
+               'http://localhost:3100/loki/api/v1/push', labeled with job
+               -loki.job (default 'forego') and -loki.labels. -loki.format
+               picks 'json' (the default), 'json+gzip' or 'protobuf', and
+               -loki.spool_dir keeps on disk the batches that could not be sent.
+
+  -otlp.endpoint url
+               Export every line to an OpenTelemetry collector over OTLP/HTTP,
+               as 'http/protobuf' (the default) or 'http/json' with
+               -otlp.protocol, with service.name -otlp.service_name (defaults
+               to -loki.job) and the headers in -otlp.headers.
+
+  -syslog.address address
+               Send every line to syslog at 'udp://host:514', 'tcp://host:601',
+               'tls://host:6514' or a unix socket such as '/dev/log', formatted
+               as -syslog.format 'rfc5424' (the default) or 'rfc3164', with
+               facility -syslog.facility (default 'local0').
+
+  -webhook.url url
+               POST batches of records to any HTTP endpoint, as a JSON array
+               or as the Go template in -webhook.template.
+
+  -elasticsearch.url url
+               Index every line in Elasticsearch or OpenSearch with the bulk
+               API, into -elasticsearch.index (default 'mango-%Y.%m.%d').
+
+  -forward.address address
+               Send every line to Fluent Bit or Fluentd with the Forward
+               protocol, at 'tcp://host:24224' or a unix socket, tagged
+               -forward.tag.<process> (the tag defaults to -loki.job). With
+               -forward.require_ack each chunk waits for an acknowledgement.
+
+  -metrics.address address
+               Serve Prometheus metrics at /metrics on address, e.g. ':9100'
+               or '127.0.0.1:9100': whether each instance is up, its restarts,
+               start time and lines written, and failed pushes of each sink.
+
+Every remote sink sends records in batches of <sink>.batch_size or every
+<sink>.batch_wait, keeps up to <sink>.queue_size records while its server is
+unavailable and retries a batch with backoff for up to <sink>.retry_timeout.
+Loki gets the level of each line with -loki.parse 'json', 'logfmt' or 'auto';
+the OTLP, webhook, Elasticsearch and Forward sinks detect it on JSON and logfmt
+lines on their own. See the README for TLS, authentication and the remaining
+options of each sink.
+
+A process may declare its own restart policy with a "# mango: restart=policy"
+line right before its entry in the Procfile:
+
+  always       Restart the process whenever it exits.
+  on-failure   Restart the process if it exits with an error; a clean exit
+               marks it as completed.
+  never        Kill all other processes and exit when the process exits.
+  once         Run the process once; a clean exit marks it as completed, an
+               error kills all other processes.
+
+  # mango: restart=once
+  migrate: bin/migrate
+  # mango: restart=always
+  worker: bin/worker
+
+A process may also wait for other processes with "# mango: depends_on=a,b".
+Processes are started in dependency order, and a dependent is only started
+once every instance of its dependencies is ready. How a process signals that
+it is ready is declared with "# mango: ready=check":
+
+  port         The PORT of the instance accepts TCP connections.
+  port:5432    The given local port accepts TCP connections.
+  log:regexp   The instance printed a line matching regexp.
+  cmd:command  The command exits successfully; a run still going when
+               ready_timeout expires is killed.
+
+Without a ready check a process is ready as soon as it starts, or, with
+restart=once, once it completes. A process that is not ready within
+"# mango: ready_timeout=duration" (default 60s) stops everything. On shutdown,
+dependents are stopped before the processes they depend on.
+
+  # mango: ready=port:5432
+  db-proxy: bin/db-proxy
+  # mango: depends_on=db-proxy
+  web: bin/web
+
+Running instances can be health checked with "# mango: health=check":
+
+  http         GET the PORT of the instance; any status below 400 is healthy.
+  http:/path   GET the given path on the PORT of the instance.
+  http://url   GET the given URL.
+  tcp          Connect to the PORT of the instance.
+  tcp:addr     Connect to the given port or host:port.
+  cmd:command  Run the command; a successful exit is healthy.
+
+Checks start once the instance is ready and run every health_interval
+(default 10s), each with a health_timeout (default 2s). After
+health_threshold (default 3) consecutive failures the instance is stopped,
+and its restart policy decides whether it is restarted or everything stops;
+the stop counts as a failure even if the instance then exits with 0.
+
+  # mango: restart=always
+  # mango: health=http:/healthz
+  # mango: health_interval=5s
+  web: bin/web
+
+Each process gets a color derived from its name; "# mango: color=name" picks
+red, green, yellow, blue, magenta, cyan or white instead.
+
+Multi-line records such as stack traces can be kept together in the terminal
+and in every sink with "# mango: multiline=rule": 'indent' joins lines that
+start with a space or tab to the previous one, and 'start:regexp' starts a new
+record only on lines matching regexp. A record is complete once the next one
+starts, after "# mango: multiline_timeout=duration" (default 500ms) without
+new lines, or once it has "# mango: multiline_max_lines=n" lines (default
+500).
+
+  # mango: multiline=start:^[0-9]{4}-
+  worker: bin/worker
+
+When sending logs to Loki, "# mango: labels=team=payments,tier=web" adds
+labels to the streams of a process, overriding loki.labels.
+
 If there is a file named .mango in the current directory, it will be read in
 the same way as an environment file, and the values of variables procfile, port,
-concurrency, and shutdown_grace_time used to change the corresponding default
-values.
+concurrency, shutdown_grace_time, restart.backoff, restart.backoff_max,
+restart.backoff_multiplier, restart.max, restart.window, output, color,
+timestamp, timestamp.format, timestamp.utc, timestamp.elapsed, prefix, log.dir,
+log.combined, log.max_size, log.max_age, log.max_files, log.compress, strict,
+control_socket, metrics.address and the loki.*, otlp.*, syslog.*, webhook.*,
+elasticsearch.* and forward.* options used to change the corresponding
+default values.
 
 Examples:
 
@@ -84,6 +263,12 @@ Examples:
 
   # start every process, with a timeout of 30 seconds
   mango start -t 30
+
+  # print one JSON object per line
+  mango start -output json | jq .message
+
+  # restart crashed processes, giving up after 3 restarts in a minute
+  mango start -r -restart.max 3 -restart.window 1m
 `,
 }
 
@@ -94,12 +279,108 @@ func init() {
 	cmdStart.Flag.StringVar(&flagConcurrency, "c", "", "concurrency")
 	cmdStart.Flag.BoolVar(&flagRestart, "r", false, "restart")
 	cmdStart.Flag.IntVar(&flagShutdownGraceTime, "t", defaultShutdownGraceTime, "shutdown grace time")
+	cmdStart.Flag.BoolVar(&flagStrict, "strict", false, "strict")
+	cmdStart.Flag.StringVar(&flagOutput, "output", outputText, "output format")
+	cmdStart.Flag.StringVar(&flagColor, "color", colorAuto, "color mode")
+	cmdStart.Flag.BoolVar(&flagTimestamp, "timestamp", false, "timestamp")
+	cmdStart.Flag.StringVar(&flagTimestampFormat, "timestamp.format", defaultTimestampFormat, "timestamp layout")
+	cmdStart.Flag.BoolVar(&flagTimestampUTC, "timestamp.utc", false, "timestamps in UTC")
+	cmdStart.Flag.BoolVar(&flagTimestampElapsed, "timestamp.elapsed", false, "elapsed time since start")
+	cmdStart.Flag.StringVar(&flagPrefix, "prefix", "", "prefix template")
+	cmdStart.Flag.StringVar(&flagLogDir, "log.dir", "", "log directory")
+	cmdStart.Flag.BoolVar(&flagLogCombined, "log.combined", false, "single log file")
+	cmdStart.Flag.StringVar(&flagLogMaxSize, "log.max_size", defaultLogMaxSize, "log size before rotation")
+	cmdStart.Flag.DurationVar(&flagLogMaxAge, "log.max_age", 0, "log age before rotation")
+	cmdStart.Flag.IntVar(&flagLogMaxFiles, "log.max_files", defaultLogMaxFiles, "rotated log files to keep")
+	cmdStart.Flag.BoolVar(&flagLogCompress, "log.compress", false, "gzip rotated log files")
+	cmdStart.Flag.StringVar(&flagControlSocket, "s", defaultControlSocket, "control socket")
+	cmdStart.Flag.DurationVar(&flagRestartBackoff, "restart.backoff", defaultRestartBackoff, "initial restart delay")
+	cmdStart.Flag.DurationVar(&flagRestartBackoffMax, "restart.backoff_max", defaultRestartBackoffMax, "maximum restart delay")
+	cmdStart.Flag.Float64Var(&flagRestartBackoffMultiplier, "restart.backoff_multiplier", defaultRestartBackoffMultiplier, "restart delay multiplier")
+	cmdStart.Flag.IntVar(&flagRestartMax, "restart.max", defaultRestartMax, "maximum restarts within the window")
+	cmdStart.Flag.DurationVar(&flagRestartWindow, "restart.window", defaultRestartWindow, "restart window")
 
 	// Registrar flags de Loki
 	cmdStart.Flag.StringVar(&flagLokiURL, "loki.url", "", "URL de Loki (ej: http://localhost:3100)")
 	cmdStart.Flag.StringVar(&flagLokiJob, "loki.job", "forego", "Etiqueta job para Loki")
-
-	err := readConfigFile(
+	cmdStart.Flag.IntVar(&flagLokiBatchSize, "loki.batch_size", defaultSinkBatchSize, "lines per push")
+	cmdStart.Flag.DurationVar(&flagLokiBatchWait, "loki.batch_wait", defaultSinkBatchWait, "maximum wait before a push")
+	cmdStart.Flag.IntVar(&flagLokiQueueSize, "loki.queue_size", defaultSinkQueueSize, "lines buffered while Loki is unavailable")
+	cmdStart.Flag.StringVar(&flagLokiDrop, "loki.drop", dropOldest, "lines to drop when the queue is full")
+	cmdStart.Flag.DurationVar(&flagLokiBackoff, "loki.backoff", defaultSinkBackoff, "initial retry delay")
+	cmdStart.Flag.DurationVar(&flagLokiBackoffMax, "loki.backoff_max", defaultSinkBackoffMax, "maximum retry delay")
+	cmdStart.Flag.DurationVar(&flagLokiRetryFor, "loki.retry_timeout", defaultSinkRetryFor, "time before giving up on a push")
+	cmdStart.Flag.StringVar(&flagLokiSpoolDir, "loki.spool_dir", "", "directory for lines that could not be sent")
+	cmdStart.Flag.StringVar(&flagLokiSpoolMaxSize, "loki.spool_max_size", defaultSpoolMaxSize, "maximum size of the spool")
+	cmdStart.Flag.StringVar(&flagLokiTenant, "loki.tenant", "", "tenant sent as X-Scope-OrgID")
+	cmdStart.Flag.StringVar(&flagLokiUsername, "loki.username", "", "basic auth user")
+	cmdStart.Flag.StringVar(&flagLokiPassword, "loki.password", "", "basic auth password")
+	cmdStart.Flag.StringVar(&flagLokiBearerToken, "loki.bearer_token", "", "bearer token")
+	cmdStart.Flag.StringVar(&flagLokiBearerTokenFile, "loki.bearer_token_file", "", "file with the bearer token")
+	cmdStart.Flag.StringVar(&flagLokiCAFile, "loki.ca_file", "", "CA certificate")
+	cmdStart.Flag.StringVar(&flagLokiCertFile, "loki.cert_file", "", "client certificate")
+	cmdStart.Flag.StringVar(&flagLokiKeyFile, "loki.key_file", "", "client certificate key")
+	cmdStart.Flag.BoolVar(&flagLokiInsecureSkipVerify, "loki.insecure_skip_verify", false, "skip TLS verification")
+	cmdStart.Flag.StringVar(&flagLokiLabels, "loki.labels", "", "static labels, e.g. env=dev,host=$HOSTNAME")
+	cmdStart.Flag.StringVar(&flagLokiParse, "loki.parse", parseNone, "parse lines as json, logfmt or auto")
+	cmdStart.Flag.StringVar(&flagLokiLevelField, "loki.level_field", defaultLevelFields, "fields holding the level")
+	cmdStart.Flag.StringVar(&flagLokiTimeField, "loki.time_field", defaultTimeFields, "fields holding the timestamp")
+	cmdStart.Flag.StringVar(&flagLokiTimeFormat, "loki.time_format", "", "layout of the timestamp")
+	cmdStart.Flag.BoolVar(&flagLokiUseTimestamp, "loki.use_timestamp", false, "use the parsed timestamp")
+	cmdStart.Flag.StringVar(&flagLokiLevelAs, "loki.level_as", levelAsLabel, "send the level as a label or as structured metadata")
+	cmdStart.Flag.StringVar(&flagOTLPEndpoint, "otlp.endpoint", "", "OTLP/HTTP logs endpoint")
+	cmdStart.Flag.StringVar(&flagOTLPProtocol, "otlp.protocol", otlpProtobuf, "http/protobuf or http/json")
+	cmdStart.Flag.StringVar(&flagOTLPHeaders, "otlp.headers", "", "headers, e.g. Authorization=Bearer%20token")
+	cmdStart.Flag.StringVar(&flagOTLPServiceName, "otlp.service_name", "", "service.name (defaults to loki.job)")
+	cmdStart.Flag.IntVar(&flagOTLPBatchSize, "otlp.batch_size", defaultSinkBatchSize, "records per export")
+	cmdStart.Flag.DurationVar(&flagOTLPBatchWait, "otlp.batch_wait", defaultSinkBatchWait, "maximum wait before an export")
+	cmdStart.Flag.IntVar(&flagOTLPQueueSize, "otlp.queue_size", defaultSinkQueueSize, "records buffered while the collector is unavailable")
+	cmdStart.Flag.DurationVar(&flagOTLPRetryFor, "otlp.retry_timeout", defaultSinkRetryFor, "time before giving up on an export")
+	cmdStart.Flag.StringVar(&flagOTLPCAFile, "otlp.ca_file", "", "CA certificate")
+	cmdStart.Flag.StringVar(&flagOTLPCertFile, "otlp.cert_file", "", "client certificate")
+	cmdStart.Flag.StringVar(&flagOTLPKeyFile, "otlp.key_file", "", "client certificate key")
+	cmdStart.Flag.BoolVar(&flagOTLPInsecureSkipVerify, "otlp.insecure_skip_verify", false, "skip TLS verification")
+	cmdStart.Flag.StringVar(&flagSyslogAddress, "syslog.address", "", "syslog server, e.g. udp://host:514, tcp://host:601, tls://host:6514 or /dev/log")
+	cmdStart.Flag.StringVar(&flagSyslogFormat, "syslog.format", syslogRFC5424, "rfc5424 or rfc3164")
+	cmdStart.Flag.StringVar(&flagSyslogFacility, "syslog.facility", "local0", "syslog facility")
+	cmdStart.Flag.StringVar(&flagSyslogHostname, "syslog.hostname", "", "HOSTNAME field (defaults to the host name)")
+	cmdStart.Flag.StringVar(&flagSyslogCAFile, "syslog.ca_file", "", "CA certificate")
+	cmdStart.Flag.StringVar(&flagSyslogCertFile, "syslog.cert_file", "", "client certificate")
+	cmdStart.Flag.StringVar(&flagSyslogKeyFile, "syslog.key_file", "", "client certificate key")
+	cmdStart.Flag.BoolVar(&flagSyslogInsecureSkipVerify, "syslog.insecure_skip_verify", false, "skip TLS verification")
+	cmdStart.Flag.StringVar(&flagWebhookURL, "webhook.url", "", "URL to POST batches of log records to")
+	cmdStart.Flag.StringVar(&flagWebhookHeaders, "webhook.headers", "", "headers, e.g. Authorization=Bearer%20token")
+	cmdStart.Flag.StringVar(&flagWebhookTemplate, "webhook.template", "", "Go template for the request body (.Records, .Job from loki.job, .Host)")
+	cmdStart.Flag.StringVar(&flagWebhookTemplateFile, "webhook.template_file", "", "file holding the body template")
+	cmdStart.Flag.StringVar(&flagWebhookContentType, "webhook.content_type", "application/json", "Content-Type of the request body")
+	cmdStart.Flag.IntVar(&flagWebhookBatchSize, "webhook.batch_size", defaultSinkBatchSize, "records per request")
+	cmdStart.Flag.DurationVar(&flagWebhookBatchWait, "webhook.batch_wait", defaultSinkBatchWait, "maximum wait before a request")
+	cmdStart.Flag.IntVar(&flagWebhookQueueSize, "webhook.queue_size", defaultSinkQueueSize, "records buffered while the endpoint is unavailable")
+	cmdStart.Flag.DurationVar(&flagWebhookRetryFor, "webhook.retry_timeout", defaultSinkRetryFor, "time before giving up on a request")
+	cmdStart.Flag.StringVar(&flagElasticsearchURL, "elasticsearch.url", "", "Elasticsearch or OpenSearch URL")
+	cmdStart.Flag.StringVar(&flagElasticsearchIndex, "elasticsearch.index", defaultElasticsearchIndex, "index name pattern")
+	cmdStart.Flag.StringVar(&flagElasticsearchUsername, "elasticsearch.username", "", "basic auth username")
+	cmdStart.Flag.StringVar(&flagElasticsearchPassword, "elasticsearch.password", "", "basic auth password")
+	cmdStart.Flag.StringVar(&flagElasticsearchAPIKey, "elasticsearch.api_key", "", "API key")
+	cmdStart.Flag.StringVar(&flagElasticsearchCAFile, "elasticsearch.ca_file", "", "CA certificate")
+	cmdStart.Flag.BoolVar(&flagElasticsearchInsecureSkipVerify, "elasticsearch.insecure_skip_verify", false, "skip TLS verification")
+	cmdStart.Flag.IntVar(&flagElasticsearchBatchSize, "elasticsearch.batch_size", defaultSinkBatchSize, "documents per bulk request")
+	cmdStart.Flag.DurationVar(&flagElasticsearchBatchWait, "elasticsearch.batch_wait", defaultSinkBatchWait, "maximum wait before a bulk request")
+	cmdStart.Flag.IntVar(&flagElasticsearchQueueSize, "elasticsearch.queue_size", defaultSinkQueueSize, "documents buffered while the cluster is unavailable")
+	cmdStart.Flag.DurationVar(&flagElasticsearchRetryFor, "elasticsearch.retry_timeout", defaultSinkRetryFor, "time before giving up on a bulk request")
+	cmdStart.Flag.StringVar(&flagMetricsAddress, "metrics.address", "", "address to serve Prometheus metrics on, e.g. :9100")
+	cmdStart.Flag.StringVar(&flagForwardAddress, "forward.address", "", "Fluent Bit/Fluentd forward address, e.g. tcp://localhost:24224 or unix:///var/run/fluent.sock")
+	cmdStart.Flag.StringVar(&flagForwardTag, "forward.tag", "", "tag prefix (defaults to loki.job)")
+	cmdStart.Flag.BoolVar(&flagForwardRequireAck, "forward.require_ack", false, "wait for the server to acknowledge each chunk")
+	cmdStart.Flag.DurationVar(&flagForwardAckTimeout, "forward.ack_timeout", defaultForwardAckTimeout, "maximum wait for an ack")
+	cmdStart.Flag.IntVar(&flagForwardBatchSize, "forward.batch_size", defaultSinkBatchSize, "records per message")
+	cmdStart.Flag.DurationVar(&flagForwardBatchWait, "forward.batch_wait", defaultSinkBatchWait, "maximum wait before a message")
+	cmdStart.Flag.IntVar(&flagForwardQueueSize, "forward.queue_size", defaultSinkQueueSize, "records buffered while the server is unavailable")
+	cmdStart.Flag.DurationVar(&flagForwardRetryFor, "forward.retry_timeout", defaultSinkRetryFor, "time before giving up on a message")
+	cmdStart.Flag.StringVar(&flagLokiFormat, "loki.format", lokiFormatJSON, "push encoding: json, json+gzip or protobuf")
+	cmdStart.Flag.StringVar(&flagLokiDynamicLabels, "loki.dynamic_labels", "", "labels taken from each line: process, instance, stream, pid")
+
+	configErr = readConfigFile(
 		".mango",
 		&flagProcfile,
 		&flagPort,
@@ -108,7 +389,6 @@ func init() {
 		&flagLokiURL,
 		&flagLokiJob,
 	)
-	handleError(err)
 }
 
 func readConfigFile(
@@ -121,22 +401,18 @@ func readConfigFile(
 	flagLokiJob *string,
 ) error {
 	config, err := ReadConfig(config_path)
+	var errs configErrors
+	errs.merge(err)
 
 	if config["procfile"] != "" {
 		*flagProcfile = config["procfile"]
 	} else {
 		*flagProcfile = "Procfile"
 	}
-	if config["port"] != "" {
-		*flagPort, err = strconv.Atoi(config["port"])
-	} else {
-		*flagPort = defaultPort
-	}
-	if config["shutdown_grace_time"] != "" {
-		*flagShutdownGraceTime, err = strconv.Atoi(config["shutdown_grace_time"])
-	} else {
-		*flagShutdownGraceTime = defaultShutdownGraceTime
-	}
+	*flagPort = defaultPort
+	errs.parseInt("port", config["port"], flagPort)
+	*flagShutdownGraceTime = defaultShutdownGraceTime
+	errs.parseInt("shutdown_grace_time", config["shutdown_grace_time"], flagShutdownGraceTime)
 	*flagConcurrency = config["concurrency"]
 
 	if config["loki.url"] != "" {
@@ -145,7 +421,24 @@ func readConfigFile(
 	if config["loki.job"] != "" {
 		*flagLokiJob = config["loki.job"]
 	}
-	return err
+	for _, read := range []func(Config) error{
+		readRestartConfig,
+		readControlConfig,
+		readCheckConfig,
+		readOutletConfig,
+		readLogFileConfig,
+		readLokiConfig,
+		readParseConfig,
+		readOTLPConfig,
+		readSyslogConfig,
+		readWebhookConfig,
+		readElasticsearchConfig,
+		readForwardConfig,
+		readMetricsConfig,
+	} {
+		errs.merge(read(config))
+	}
+	return errs.err()
 }
 
 func parseConcurrency(value string) (map[string]int, error) {
@@ -178,10 +471,27 @@ func parseConcurrency(value string) (map[string]int, error) {
 
 type mango struct {
 	outletFactory *OutletFactory
+	sinks         *LogDispatcher
 
 	teardown, teardownNow Barrier // signal shutting down
 
 	wg sync.WaitGroup
+
+	// live cuenta las instancias que no han completado, más los lanzadores
+	// que aún esperan a sus dependencias.
+	liveMu sync.Mutex
+	live   int
+
+	// states sigue cada entrada del Procfile por nombre, y dependents las
+	// entradas que dependen de cada una.
+	procfile   *Procfile
+	env        Env
+	states     map[string]*procState
+	dependents map[string][]string
+
+	// scaleMu serializa los cambios de escala pedidos por el socket de
+	// control.
+	scaleMu sync.Mutex
 }
 
 func (f *mango) monitorInterrupt() {
@@ -217,7 +527,74 @@ func basePort(env Env) (int, error) {
 	return defaultPort, nil
 }
 
+// startProcess crea la instancia procNum de proc y la supervisa hasta el
+// teardown.
 func (f *mango) startProcess(idx, procNum int, proc ProcfileEntry, env Env, of *OutletFactory) {
+	inst := newInstance(idx, procNum, proc)
+	st := f.states[proc.Name]
+	inst.ready.FallHook = func() { st.instanceReady(procNum) }
+	st.add(inst)
+
+	f.wg.Add(1)
+	f.addLive(1)
+	st.running.Add(1)
+	go func() {
+		defer f.wg.Done()
+		defer st.running.Done()
+		f.supervise(inst, env, of)
+	}()
+}
+
+// readOutput lleva la salida r de una instancia a la terminal y a los sinks,
+// juntando las líneas según la regla multiline del proceso, y, con
+// ready=log, al matcher línea a línea.
+func (f *mango) readOutput(wg *sync.WaitGroup, src outletSource, proc ProcfileEntry, r io.Reader, isError bool, matcher *lineMatcher) {
+	defer wg.Done()
+	if matcher != nil {
+		r = io.TeeReader(r, matcher)
+	}
+	group := newLineGrouper(proc.Multiline, proc.MultilineTimeout, proc.MultilineMaxLines, func(first time.Time, text string) {
+		f.outletFactory.ProcessOutput(src, text, isError)
+		if f.sinks.Enabled() {
+			f.sinks.Dispatch(processRecord(src, isError, first, text))
+		}
+	})
+	stream := "stdout"
+	if isError {
+		stream = "stderr"
+	}
+	lines := lineCounter(src.Process, src.Instance, stream)
+	readLines(r, func(line string) {
+		atomic.AddInt64(lines, 1)
+		group.Add(line)
+	})
+	group.Close()
+}
+
+// addLive suma delta a las instancias pendientes; cuando ya no queda ninguna
+// (p. ej. todas eran restart=once) no hay nada más que hacer.
+func (f *mango) addLive(delta int) {
+	f.liveMu.Lock()
+	defer f.liveMu.Unlock()
+	f.live += delta
+	if f.live == 0 {
+		select {
+		case <-f.teardown.Barrier():
+		default:
+			f.outletFactory.SystemOutput("teardown cause: all processes finished")
+			f.teardown.Fall()
+		}
+	}
+}
+
+// runProcess ejecuta una vez la instancia y bloquea hasta que termina.
+// exited es true si el proceso terminó por su cuenta (o a petición de un
+// usuario), y false si no pudo arrancar o fue detenido por el teardown;
+// success indica si salió con 0 sin que lo parara su chequeo de salud.
+func (f *mango) runProcess(inst *instance, env Env, of *OutletFactory) (exited, success bool) {
+	idx, procName, proc, ready := inst.Idx, inst.Name, inst.Proc, inst.ready
+	inst.setState(stateStarting)
+
 	// ===== entorno por proceso =====
 	envCopy := env.Clone()
 
@@ -227,7 +604,7 @@ func (f *mango) startProcess(idx, procNum int, proc ProcfileEntry, env Env, of *
 		panic(err)
 	}
 	if port > 0 {
-		port += idx * 100
+		port += idx*100 + inst.Num
 		envCopy["PORT"] = strconv.Itoa(port)
 	}
 
@@ -236,14 +613,6 @@ func (f *mango) startProcess(idx, procNum int, proc ProcfileEntry, env Env, of *
 	workDir := filepath.Dir(flagProcfile)
 	ps := NewProcess(workDir, proc.Command, envCopy, interactive)
 
-	// Nombre visible
-	var procName string
-	if procNum > 1 {
-		procName = fmt.Sprintf("%s.%d", proc.Name, procNum+1)
-	} else {
-		procName = proc.Name
-	}
-
 	// Pipes
 	stdout, err := ps.StdoutPipe()
 	if err != nil {
@@ -254,45 +623,11 @@ func (f *mango) startProcess(idx, procNum int, proc ProcfileEntry, env Env, of *
 		panic(err)
 	}
 
-	pipeWait := new(sync.WaitGroup)
-
-	// --- Stdout ---
-	pipeWait.Add(1)
-	go func() {
-		var reader io.Reader = stdout
-		if lokiClient != nil {
-			pr, pw := io.Pipe()
-			reader = io.TeeReader(stdout, pw)
-			go func() {
-				scanner := bufio.NewScanner(pr)
-				for scanner.Scan() {
-					lokiClient.Send(flagLokiJob, procName, scanner.Text())
-				}
-				_ = pr.Close()
-			}()
-			defer pw.Close()
-		}
-		of.LineReader(pipeWait, procName, idx, reader, false)
-	}()
-
-	// --- Stderr ---
-	pipeWait.Add(1)
-	go func() {
-		var reader io.Reader = stderr
-		if lokiClient != nil {
-			pr, pw := io.Pipe()
-			reader = io.TeeReader(stderr, pw)
-			go func() {
-				scanner := bufio.NewScanner(pr)
-				for scanner.Scan() {
-					lokiClient.Send(flagLokiJob, procName, scanner.Text())
-				}
-				_ = pr.Close()
-			}()
-			defer pw.Close()
-		}
-		of.LineReader(pipeWait, procName, idx, reader, true)
-	}()
+	// Para ready=log se observa la salida de la instancia
+	var matcher *lineMatcher
+	if proc.Ready != nil && proc.Ready.Kind == "log" {
+		matcher = &lineMatcher{pattern: proc.Ready.pattern}
+	}
 
 	if port > 0 {
 		of.SystemOutput(fmt.Sprintf("starting %s on port %d", procName, port))
@@ -309,7 +644,58 @@ func (f *mango) startProcess(idx, procNum int, proc ProcfileEntry, env Env, of *
 		of.SystemOutput(fmt.Sprintf("Failed to start %s: %v", procName, err))
 		of.SystemOutput(fmt.Sprintf("teardown cause: start-error (%s)", procName))
 		f.teardown.Fall() // ← log explícito del origen
-		return
+		return false, false
+	}
+
+	// Los lectores arrancan tras Start para conocer el pid.
+	src := outletSource{
+		Name:     procName,
+		Process:  proc.Name,
+		Instance: inst.Num + 1,
+		Pid:      ps.Process.Pid,
+		Color:    processColor(proc),
+	}
+	pipeWait := new(sync.WaitGroup)
+
+	for _, pipe := range []struct {
+		r       io.Reader
+		isError bool
+	}{{stdout, false}, {stderr, true}} {
+		pipeWait.Add(1)
+		go f.readOutput(pipeWait, src, proc, pipe.r, pipe.isError, matcher)
+	}
+
+	inst.mu.Lock()
+	inst.ps, inst.finished, inst.port = ps, finished, port
+	inst.started = time.Now()
+	inst.state = stateRunning
+	inst.mu.Unlock()
+
+	// ===== Readiness =====
+	select {
+	case <-ready.Barrier():
+	default:
+		switch {
+		case proc.Ready != nil:
+			go func() {
+				if proc.Ready.Kind == "port" && proc.Ready.Target == "" && port == 0 {
+					of.SystemOutput(fmt.Sprintf("%s has ready=port but no PORT; treating it as ready", procName))
+				} else if !waitReady(proc.Ready, readyTimeout(proc), port, workDir, envCopy, matcher, finished) {
+					return
+				}
+				of.SystemOutput(fmt.Sprintf("%s is ready", procName))
+				ready.Fall()
+			}()
+		case restartPolicy(proc) != RestartOnce:
+			// Sin chequeo, una instancia está lista en cuanto arranca; las
+			// de restart=once lo están al completarse.
+			ready.Fall()
+		}
+	}
+
+	// ===== Health checks =====
+	if proc.Health.Kind != "" {
+		go f.monitorHealth(inst, proc.Health, port, workDir, envCopy, ps, ready, finished)
 	}
 
 	// ===== Espera de I/O + Wait() con logging detallado =====
@@ -344,45 +730,54 @@ func (f *mango) startProcess(idx, procNum int, proc ProcfileEntry, env Env, of *
 		}
 	}()
 
-	// ===== Política de restart/teardown =====
-	f.wg.Add(1)
-	go func() {
-		defer f.wg.Done()
-
+	select {
+	case <-finished:
+		inst.mu.Lock()
+		unhealthy := inst.unhealthy
+		inst.unhealthy = false
+		inst.mu.Unlock()
+		return true, !unhealthy && ps.ProcessState != nil && ps.ProcessState.Success()
+
+	case <-f.teardown.Barrier():
+		// Teardown global: primero se espera a que paren las entradas que
+		// dependen de ésta.
 		select {
+		case <-f.dependentsStopped(proc.Name):
+		case <-f.teardownNow.Barrier():
 		case <-finished:
-			if flagRestart {
-				of.SystemOutput(fmt.Sprintf("restart policy: restarting %s", procName))
-				// Reinicio del mismo proceso (mismo idx/procNum)
-				f.startProcess(idx, procNum, proc, env, of)
-			} else {
-				of.SystemOutput(fmt.Sprintf("teardown cause: %s finished (no -r)", procName))
-				f.teardown.Fall()
-			}
-
-		case <-f.teardown.Barrier():
-			// Teardown global
-			of.SystemOutput(fmt.Sprintf("teardown path: sending SIGTERM to %s", procName))
-			if !osHaveSigTerm {
-				of.SystemOutput(fmt.Sprintf("Killing %s", procName))
-				_ = ps.Process.Kill()
-				return
-			}
+		}
+		inst.setState(stateStopping)
+		of.SystemOutput(fmt.Sprintf("teardown path: sending SIGTERM to %s", procName))
+		if !osHaveSigTerm {
+			of.SystemOutput(fmt.Sprintf("Killing %s", procName))
+			_ = ps.Process.Kill()
+			return false, false
+		}
 
-			ps.SendSigTerm()
+		ps.SendSigTerm()
 
-			// Grace period o salida del proceso
-			select {
-			case <-f.teardownNow.Barrier():
-				of.SystemOutput(fmt.Sprintf("Killing %s", procName))
-				ps.SendSigKill()
-			case <-finished:
-			}
+		// Grace period o salida del proceso
+		select {
+		case <-f.teardownNow.Barrier():
+			of.SystemOutput(fmt.Sprintf("Killing %s", procName))
+			ps.SendSigKill()
+		case <-finished:
 		}
-	}()
+		return false, false
+	}
 }
 
 func runStart(cmd *Command, args []string) {
+	if flagStrict {
+		problems := checkSetup(flagProcfile, envs, flagConcurrency, ".mango", configErr)
+		for _, problem := range problems {
+			Println(problem)
+		}
+		if len(problems) > 0 {
+			handleError(errors.New("refusing to start in strict mode; see 'mango check'"))
+		}
+	}
+
 	pf, err := ReadProcfile(flagProcfile)
 	handleError(err)
 
@@ -392,20 +787,30 @@ func runStart(cmd *Command, args []string) {
 	env, err := loadEnvs(envs)
 	handleError(err)
 
+	output, err := parseOutputFormat(flagOutput)
+	handleError(err)
+	color, err := colorEnabled(flagColor)
+	handleError(err)
+
 	of := NewOutletFactory()
+	of.Format = output
+	of.Color = color
 	of.Padding = pf.LongestProcessName(concurrency)
+	of.Timestamp = flagTimestamp || flagTimestampElapsed
+	of.TimeFormat = flagTimestampFormat
+	of.UTC = flagTimestampUTC
+	of.Elapsed = flagTimestampElapsed
+	if flagPrefix != "" {
+		handleError(of.SetPrefix(flagPrefix))
+	}
+
+	sinks, err := openLogSinks(of, pf)
+	handleError(err)
+	defer sinks.Close(of)
 
 	f := &mango{
 		outletFactory: of,
-	}
-
-	// ==== Inicializar cliente de Loki sólo si se ha configurado URL ====
-	if flagLokiURL != "" {
-		// lokiClient = NewLokiClient(flagLokiURL, 10*time.Second)
-		// of.SystemOutput(fmt.Sprintf("Loki habilitado: %s (job=%s)", flagLokiURL, flagLokiJob))
-		initLoki(of)
-		handleError(err)
-		defer lokiClient.Close()
+		sinks:         sinks,
 	}
 
 	go f.monitorInterrupt()
@@ -435,6 +840,10 @@ func runStart(cmd *Command, args []string) {
 		}
 	}
 
+	f.procfile = pf
+	f.env = env
+	f.states = make(map[string]*procState, len(pf.Entries))
+	f.dependents = pf.Dependents()
 	for idx, proc := range pf.Entries {
 		numProcs := defaultConcurrency
 		if len(concurrency) > 0 {
@@ -442,31 +851,101 @@ func runStart(cmd *Command, args []string) {
 				numProcs = value
 			}
 		}
-		for i := 0; i < numProcs; i++ {
-			if (singleton == "") || (singleton == proc.Name) {
-				f.startProcess(idx, i, proc, env, of)
-			}
+		if singleton != "" && singleton != proc.Name {
+			numProcs = 0
+		}
+		st := newProcState(numProcs)
+		st.idx, st.proc = idx, proc
+		f.states[proc.Name] = st
+	}
+
+	listener, err := listenControl(flagControlSocket)
+	if err != nil {
+		of.SystemOutput(fmt.Sprintf("control socket disabled: %v", err))
+	} else {
+		defer listener.Close()
+		go f.serveControl(listener)
+	}
+
+	metrics, err := listenMetrics(flagMetricsAddress)
+	if err != nil {
+		of.SystemOutput(fmt.Sprintf("metrics disabled: %v", err))
+	} else if metrics != nil {
+		defer metrics.Close()
+		of.SystemOutput(fmt.Sprintf("serving metrics on http://%s/metrics", metrics.Addr()))
+		go f.serveMetrics(metrics)
+	}
+
+	// El propio arranque cuenta como pendiente hasta lanzar todas las entradas.
+	f.addLive(1)
+	for _, idx := range pf.StartOrder() {
+		proc := pf.Entries[idx]
+		st := f.states[proc.Name]
+		if st.instances == 0 {
+			continue
 		}
+		if len(proc.DependsOn) == 0 {
+			f.startInstances(idx, st.instances, proc, env, of)
+			continue
+		}
+
+		// Las entradas con dependencias esperan a que éstas estén listas.
+		f.addLive(1)
+		st.running.Add(1)
+		go func(idx, numProcs int, proc ProcfileEntry, st *procState) {
+			defer f.addLive(-1)
+			defer st.running.Done()
+
+			for _, dep := range proc.DependsOn {
+				select {
+				case <-f.states[dep].ready.Barrier():
+				case <-f.teardown.Barrier():
+					return
+				}
+			}
+			f.startInstances(idx, numProcs, proc, env, of)
+		}(idx, st.instances, proc, st)
 	}
 
+	f.addLive(-1)
+
 	<-f.teardown.Barrier()
 
 	f.wg.Wait()
 }
 
-// initLoki inicializa el cliente de Loki y espera a que esté listo antes de continuar.
-func initLoki(of *OutletFactory) {
-	if flagLokiURL == "" || lokiClient != nil {
+// startInstances lanza numProcs instancias de proc y, si declara un chequeo
+// de readiness, vigila que estén listas a tiempo.
+func (f *mango) startInstances(idx, numProcs int, proc ProcfileEntry, env Env, of *OutletFactory) {
+	for i := 0; i < numProcs; i++ {
+		f.startProcess(idx, i, proc, env, of)
+	}
+	if proc.Ready == nil {
 		return
 	}
-	lokiClient = NewLokiClient(flagLokiURL, 10*time.Second, 1*time.Second, 500)
-	of.SystemOutput(fmt.Sprintf("Loki habilitado: %s (job=%s)", flagLokiURL, flagLokiJob))
 
-	// Espera readiness
-	of.SystemOutput("Esperando a que Loki esté listo...")
-	if err := lokiClient.WaitReady(10, 1*time.Second); err != nil {
-		of.SystemOutput("Aviso: no se pudo verificar readiness de Loki: " + err.Error())
-	} else {
-		of.SystemOutput("Loki está listo")
-	}
+	timeout := readyTimeout(proc)
+	go func() {
+		select {
+		case <-f.states[proc.Name].ready.Barrier():
+		case <-f.teardown.Barrier():
+		case <-time.After(timeout):
+			of.SystemOutput(fmt.Sprintf("%s not ready after %s", proc.Name, timeout))
+			of.SystemOutput(fmt.Sprintf("teardown cause: %s not ready", proc.Name))
+			f.teardown.Fall()
+		}
+	}()
+}
+
+// dependentsStopped devuelve un canal que se cierra cuando han terminado
+// todas las instancias de las entradas que dependen de name.
+func (f *mango) dependentsStopped(name string) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, dependent := range f.dependents[name] {
+			f.states[dependent].running.Wait()
+		}
+	}()
+	return done
 }
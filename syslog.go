@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formatos de syslog.
+const (
+	syslogRFC5424 = "rfc5424"
+	syslogRFC3164 = "rfc3164"
+)
+
+// Severidades de syslog que usa mango.
+const (
+	syslogError  = 3
+	syslogNotice = 5
+	syslogInfo   = 6
+)
+
+const (
+	syslogDialTimeout = 5 * time.Second
+
+	// syslogRetryDelay es cuánto se descartan las líneas tras no poder
+	// conectar, antes de volver a intentarlo.
+	syslogRetryDelay = time.Second
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var flagSyslogAddress string
+var flagSyslogFormat string
+var flagSyslogFacility string
+var flagSyslogHostname string
+var flagSyslogCAFile string
+var flagSyslogCertFile string
+var flagSyslogKeyFile string
+var flagSyslogInsecureSkipVerify bool
+
+func readSyslogConfig(config Config) error {
+	var errs configErrors
+	for key, value := range map[string]*string{
+		"syslog.address":   &flagSyslogAddress,
+		"syslog.format":    &flagSyslogFormat,
+		"syslog.facility":  &flagSyslogFacility,
+		"syslog.hostname":  &flagSyslogHostname,
+		"syslog.ca_file":   &flagSyslogCAFile,
+		"syslog.cert_file": &flagSyslogCertFile,
+		"syslog.key_file":  &flagSyslogKeyFile,
+	} {
+		if config[key] != "" {
+			*value = config[key]
+		}
+	}
+	errs.parseBool("syslog.insecure_skip_verify", config["syslog.insecure_skip_verify"], &flagSyslogInsecureSkipVerify)
+	return errs.err()
+}
+
+// parseSyslogAddress interpreta la dirección del servidor: udp://host:514,
+// tcp://host:601, tls://host:6514, unix:///dev/log o simplemente una ruta a
+// un socket local.
+func parseSyslogAddress(value string) (network, address string, err error) {
+	if strings.HasPrefix(value, "/") {
+		return "unix", value, nil
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return "", "", err
+	}
+	switch u.Scheme {
+	case "unix":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("invalid syslog address %q", value)
+		}
+		return "unix", u.Path, nil
+	case "udp", "tcp", "tls":
+		if u.Host == "" {
+			return "", "", fmt.Errorf("invalid syslog address %q", value)
+		}
+		return u.Scheme, u.Host, nil
+	}
+	return "", "", fmt.Errorf("invalid syslog address %q (want udp://, tcp://, tls://, unix:// or a path)", value)
+}
+
+// SyslogOptions dice a qué servidor enviar y en qué formato.
+type SyslogOptions struct {
+	Network  string // unix, udp, tcp o tls
+	Address  string
+	Format   string // syslogRFC5424 o syslogRFC3164
+	Facility int
+	Hostname string
+	TLS      *tls.Config
+}
+
+// SyslogWriter envía cada registro como un mensaje de syslog. En TCP y TLS
+// los mensajes van con octet counting (RFC 6587), y en un socket local de
+// tipo stream terminados en un salto de línea, como en log/syslog; si la
+// conexión se pierde se vuelve a abrir, y lo que no se puede enviar se
+// descarta.
+type SyslogWriter struct {
+	opts SyslogOptions
+	logf func(msg string)
+
+	conn       net.Conn
+	unixStream bool // conn es un socket local de tipo stream
+	nextDial  time.Time
+	dialError string
+	dropped   int
+}
+
+func NewSyslogWriter(opts SyslogOptions, logf func(msg string)) *SyslogWriter {
+	return &SyslogWriter{opts: opts, logf: logf}
+}
+
+// Send envía rec, reconectando una vez si la conexión ha fallado. Cada
+// escritura o conexión fallida cuenta en las métricas.
+func (w *SyslogWriter) Send(rec LogRecord) {
+	msg := w.format(rec)
+	for attempt := 0; attempt < 2; attempt++ {
+		if err := w.connect(); err != nil {
+			break
+		}
+		err := w.write(msg)
+		if err == nil {
+			return
+		}
+		countPushError("syslog")
+		if attempt == 1 {
+			w.logf(fmt.Sprintf("syslog: %v", err))
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	w.dropped++
+}
+
+// connect abre la conexión si no lo está, salvo que el último intento haya
+// fallado hace menos de syslogRetryDelay.
+func (w *SyslogWriter) connect() error {
+	if w.conn != nil {
+		return nil
+	}
+	if time.Now().Before(w.nextDial) {
+		return fmt.Errorf("waiting to reconnect")
+	}
+	conn, err := w.dial()
+	if err != nil {
+		countPushError("syslog")
+		w.nextDial = time.Now().Add(syslogRetryDelay)
+		// El mismo error se informa una sola vez.
+		if err.Error() != w.dialError {
+			w.dialError = err.Error()
+			w.logf(fmt.Sprintf("syslog: %v", err))
+		}
+		return err
+	}
+	w.conn, w.dialError = conn, ""
+	return nil
+}
+
+func (w *SyslogWriter) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: syslogDialTimeout}
+	switch w.opts.Network {
+	case "unix":
+		// /dev/log suele ser un socket de datagramas.
+		conn, err := dialer.Dial("unixgram", w.opts.Address)
+		w.unixStream = false
+		if err != nil {
+			conn, err = dialer.Dial("unix", w.opts.Address)
+			w.unixStream = true
+		}
+		return conn, err
+	case "tls":
+		return tls.DialWithDialer(dialer, "tcp", w.opts.Address, w.opts.TLS)
+	}
+	return dialer.Dial(w.opts.Network, w.opts.Address)
+}
+
+func (w *SyslogWriter) write(msg string) error {
+	w.conn.SetWriteDeadline(time.Now().Add(syslogDialTimeout))
+	switch {
+	case w.opts.Network == "tcp" || w.opts.Network == "tls":
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	case w.unixStream:
+		msg += "\n"
+	}
+	_, err := w.conn.Write([]byte(msg))
+	return err
+}
+
+// format da formato RFC 5424 o RFC 3164 a rec: la severidad es info, error
+// para stderr o notice para los mensajes de mango.
+func (w *SyslogWriter) format(rec LogRecord) string {
+	severity := syslogInfo
+	switch rec.Stream {
+	case "stderr":
+		severity = syslogError
+	case "system":
+		severity = syslogNotice
+	}
+	pri := w.opts.Facility*8 + severity
+	app := syslogToken(rec.Process, 48)
+	procID := "-"
+	if rec.Pid > 0 {
+		procID = strconv.Itoa(rec.Pid)
+	}
+
+	host := syslogToken(w.opts.Hostname, 255)
+	if w.opts.Format == syslogRFC3164 {
+		tag := syslogToken(rec.Process, 32)
+		if rec.Pid > 0 {
+			tag += "[" + procID + "]"
+		}
+		return fmt.Sprintf("<%d>%s %s %s: %s", pri, rec.Time.Format(time.Stamp), host, tag, rec.Line)
+	}
+	stamp := rec.Time.Format("2006-01-02T15:04:05.000000Z07:00")
+	return fmt.Sprintf("<%d>1 %s %s %s %s %s - %s", pri, stamp, host, app, procID, syslogToken(rec.Stream, 32), rec.Line)
+}
+
+// syslogToken adapta value a un campo de la cabecera: ASCII imprimible sin
+// espacios, de max caracteres como mucho, o "-" si está vacío.
+func syslogToken(value string, max int) string {
+	if value == "" {
+		return "-"
+	}
+	b := []byte(value)
+	for i, c := range b {
+		if c <= ' ' || c > '~' {
+			b[i] = '_'
+		}
+	}
+	if len(b) > max {
+		b = b[:max]
+	}
+	return string(b)
+}
+
+// Close cierra la conexión e informa de las líneas descartadas.
+func (w *SyslogWriter) Close() {
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+	if w.dropped > 0 {
+		w.logf(fmt.Sprintf("syslog: dropped %d lines that could not be sent", w.dropped))
+	}
+}
+
+// openSyslogSink abre el sink de syslog si se ha configurado syslog.address.
+func openSyslogSink(of *OutletFactory, pf *Procfile) (LogSink, error) {
+	if flagSyslogAddress == "" {
+		return nil, nil
+	}
+	network, address, err := parseSyslogAddress(flagSyslogAddress)
+	if err != nil {
+		return nil, err
+	}
+	if flagSyslogFormat != syslogRFC5424 && flagSyslogFormat != syslogRFC3164 {
+		return nil, fmt.Errorf("invalid format %q (want %s or %s)", flagSyslogFormat, syslogRFC5424, syslogRFC3164)
+	}
+	facility, ok := syslogFacilities[flagSyslogFacility]
+	if !ok {
+		return nil, fmt.Errorf("unknown facility %q", flagSyslogFacility)
+	}
+	hostname := flagSyslogHostname
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+	opts := SyslogOptions{
+		Network:  network,
+		Address:  address,
+		Format:   flagSyslogFormat,
+		Facility: facility,
+		Hostname: hostname,
+	}
+	if network == "tls" {
+		if opts.TLS, err = loadTLSConfig(flagSyslogCAFile, flagSyslogCertFile, flagSyslogKeyFile, flagSyslogInsecureSkipVerify); err != nil {
+			return nil, err
+		}
+		if opts.TLS == nil {
+			opts.TLS = &tls.Config{}
+		}
+	}
+	of.SystemOutput(fmt.Sprintf("syslog: sending logs to %s", flagSyslogAddress))
+	return NewSyslogWriter(opts, of.SystemOutput), nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testSyslogRecord(stream string) LogRecord {
+	return LogRecord{
+		Time:     time.Date(2024, 3, 5, 14, 7, 9, 123456000, time.UTC),
+		Name:     "web.1",
+		Process:  "web",
+		Instance: 1,
+		Stream:   stream,
+		Pid:      42,
+		Line:     "hola mundo",
+	}
+}
+
+func TestSyslogFormat(t *testing.T) {
+	w := NewSyslogWriter(SyslogOptions{Format: syslogRFC5424, Facility: 16, Hostname: "host"}, nil)
+	tests := []struct {
+		rec  LogRecord
+		want string
+	}{
+		{testSyslogRecord("stdout"), "<134>1 2024-03-05T14:07:09.123456Z host web 42 stdout - hola mundo"},
+		{testSyslogRecord("stderr"), "<131>1 2024-03-05T14:07:09.123456Z host web 42 stderr - hola mundo"},
+		{LogRecord{Time: testSyslogRecord("").Time, Process: "mango", Stream: "system", Line: "starting"},
+			"<133>1 2024-03-05T14:07:09.123456Z host mango - system - starting"},
+		{LogRecord{Time: testSyslogRecord("").Time, Process: "mi proceso", Stream: "stdout", Line: "x"},
+			"<134>1 2024-03-05T14:07:09.123456Z host mi_proceso - stdout - x"},
+	}
+	for _, test := range tests {
+		if got := w.format(test.rec); got != test.want {
+			t.Errorf("format(%+v) = %q, se esperaba %q", test.rec, got, test.want)
+		}
+	}
+
+	w.opts.Format = syslogRFC3164
+	w.opts.Facility = 1
+	if got, want := w.format(testSyslogRecord("stderr")), "<11>Mar  5 14:07:09 host web[42]: hola mundo"; got != want {
+		t.Errorf("format RFC 3164 = %q, se esperaba %q", got, want)
+	}
+	w.opts.Hostname = "mi host"
+	if got, want := w.format(testSyslogRecord("stderr")), "<11>Mar  5 14:07:09 mi_host web[42]: hola mundo"; got != want {
+		t.Errorf("format RFC 3164 = %q, se esperaba %q", got, want)
+	}
+}
+
+func TestParseSyslogAddress(t *testing.T) {
+	tests := []struct {
+		value, network, address string
+	}{
+		{"/dev/log", "unix", "/dev/log"},
+		{"unix:///var/run/syslog", "unix", "/var/run/syslog"},
+		{"udp://localhost:514", "udp", "localhost:514"},
+		{"tcp://10.0.0.1:601", "tcp", "10.0.0.1:601"},
+		{"tls://logs.example.com:6514", "tls", "logs.example.com:6514"},
+	}
+	for _, test := range tests {
+		network, address, err := parseSyslogAddress(test.value)
+		if err != nil || network != test.network || address != test.address {
+			t.Errorf("parseSyslogAddress(%q) = %q, %q, %v", test.value, network, address, err)
+		}
+	}
+	for _, value := range []string{"localhost:514", "http://host", "udp://", "unix://"} {
+		if _, _, err := parseSyslogAddress(value); err == nil {
+			t.Errorf("parseSyslogAddress(%q) debería fallar", value)
+		}
+	}
+}
+
+func TestSyslogUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	w := NewSyslogWriter(SyslogOptions{Network: "udp", Address: conn.LocalAddr().String(), Format: syslogRFC5424, Facility: 16, Hostname: "host"}, func(msg string) { t.Log(msg) })
+	defer w.Close()
+	w.Send(testSyslogRecord("stdout"))
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf[:n]), w.format(testSyslogRecord("stdout")); got != want {
+		t.Errorf("datagrama = %q, se esperaba %q", got, want)
+	}
+}
+
+func TestSyslogUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	conn, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+
+	w := NewSyslogWriter(SyslogOptions{Network: "unix", Address: path, Format: syslogRFC3164, Facility: 1, Hostname: "host"}, func(msg string) { t.Log(msg) })
+	defer w.Close()
+	w.Send(testSyslogRecord("stdout"))
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf[:n]), "<14>Mar  5 14:07:09 host web[42]: hola mundo"; got != want {
+		t.Errorf("datagrama = %q, se esperaba %q", got, want)
+	}
+}
+
+// readOctetCounted lee un mensaje con octet counting de r.
+// TestSyslogUnixStream comprueba que en un socket local de tipo stream cada
+// mensaje termina en un salto de línea, para que no se junten.
+func TestSyslogUnixStream(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+
+	w := NewSyslogWriter(SyslogOptions{Network: "unix", Address: path, Format: syslogRFC5424, Facility: 16, Hostname: "host"}, func(msg string) { t.Log(msg) })
+	defer w.Close()
+	w.Send(testSyslogRecord("stdout"))
+	w.Send(testSyslogRecord("stderr"))
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	for _, stream := range []string{"stdout", "stderr"} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := w.format(testSyslogRecord(stream)) + "\n"; line != want {
+			t.Errorf("mensaje = %q, se esperaba %q", line, want)
+		}
+	}
+}
+
+func readOctetCounted(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	length, err := r.ReadString(' ')
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+func TestSyslogTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	w := NewSyslogWriter(SyslogOptions{Network: "tcp", Address: ln.Addr().String(), Format: syslogRFC5424, Facility: 16, Hostname: "host"}, func(msg string) { t.Log(msg) })
+	defer w.Close()
+
+	rec := testSyslogRecord("stderr")
+	rec.Line = "panic: boom\n  at main.go:12"
+	w.Send(rec)
+	w.Send(testSyslogRecord("stdout"))
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	if got, want := readOctetCounted(t, r), w.format(rec); got != want {
+		t.Errorf("primer mensaje = %q, se esperaba %q", got, want)
+	}
+	if got, want := readOctetCounted(t, r), w.format(testSyslogRecord("stdout")); got != want {
+		t.Errorf("segundo mensaje = %q, se esperaba %q", got, want)
+	}
+
+	// Si el servidor cierra la conexión, el siguiente envío reconecta.
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	for {
+		w.Send(testSyslogRecord("stdout"))
+		select {
+		case conn := <-accepted:
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if got, want := readOctetCounted(t, bufio.NewReader(conn)), w.format(testSyslogRecord("stdout")); got != want {
+				t.Errorf("mensaje tras reconectar = %q, se esperaba %q", got, want)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no se reconectó")
+		}
+	}
+}
+
+func TestSyslogTLS(t *testing.T) {
+	// httptest genera un certificado para 127.0.0.1 que sirve también aquí.
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	defer srv.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: srv.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	w := NewSyslogWriter(SyslogOptions{Network: "tls", Address: ln.Addr().String(), Format: syslogRFC5424, Facility: 16, Hostname: "host", TLS: &tls.Config{RootCAs: pool}}, func(msg string) { t.Log(msg) })
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		w.Send(testSyslogRecord("stdout"))
+	}()
+	defer func() {
+		<-sent
+		w.Close()
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if got, want := readOctetCounted(t, bufio.NewReader(conn)), w.format(testSyslogRecord("stdout")); got != want {
+		t.Errorf("mensaje = %q, se esperaba %q", got, want)
+	}
+}
+
+func TestSyslogCountsErrors(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+
+	countPushError("syslog")
+	counters.Lock()
+	n := counters.pushErrors["syslog"]
+	counters.Unlock()
+	before := atomic.LoadInt64(n)
+
+	w := NewSyslogWriter(SyslogOptions{Network: "tcp", Address: address, Format: syslogRFC5424}, func(msg string) { t.Log(msg) })
+	w.Send(testSyslogRecord("stdout"))
+	w.Close()
+	if got := atomic.LoadInt64(n); got != before+1 {
+		t.Errorf("errores de syslog = %d, se esperaba %d", got, before+1)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"text/template"
+	"time"
+)
+
+var flagWebhookURL string
+var flagWebhookHeaders string
+var flagWebhookTemplate string
+var flagWebhookTemplateFile string
+var flagWebhookContentType string
+var flagWebhookBatchSize int
+var flagWebhookBatchWait time.Duration
+var flagWebhookQueueSize int
+var flagWebhookRetryFor time.Duration
+
+func readWebhookConfig(config Config) error {
+	var errs configErrors
+	for key, value := range map[string]*string{
+		"webhook.url":           &flagWebhookURL,
+		"webhook.template":      &flagWebhookTemplate,
+		"webhook.template_file": &flagWebhookTemplateFile,
+		"webhook.content_type":  &flagWebhookContentType,
+	} {
+		if config[key] != "" {
+			*value = config[key]
+		}
+	}
+	// Como en OTLP, las cabeceras pueden ir en MANGO_WEBHOOK_HEADERS.
+	if env := os.Getenv(settingEnv("webhook.headers")); env != "" {
+		flagWebhookHeaders = env
+	} else if config["webhook.headers"] != "" {
+		flagWebhookHeaders = config["webhook.headers"]
+	}
+	for key, value := range map[string]*int{
+		"webhook.batch_size": &flagWebhookBatchSize,
+		"webhook.queue_size": &flagWebhookQueueSize,
+	} {
+		errs.parseInt(key, config[key], value)
+	}
+	for key, value := range map[string]*time.Duration{
+		"webhook.batch_wait":    &flagWebhookBatchWait,
+		"webhook.retry_timeout": &flagWebhookRetryFor,
+	} {
+		errs.parseDuration(key, config[key], value)
+	}
+	return errs.err()
+}
+
+// webhookRecord es un registro tal y como se envía al webhook.
+type webhookRecord struct {
+	Time     string `json:"time"`
+	Host     string `json:"host"`
+	Name     string `json:"name"`
+	Process  string `json:"process"`
+	Instance int    `json:"instance,omitempty"`
+	Stream   string `json:"stream"`
+	Pid      int    `json:"pid,omitempty"`
+	Level    string `json:"level,omitempty"`
+	Message  string `json:"message"`
+}
+
+// webhookBody es lo que recibe la plantilla del cuerpo. Job es loki.job,
+// el nombre de la aplicación que comparten todos los sinks.
+type webhookBody struct {
+	Records []webhookRecord
+	Job     string
+	Host    string
+}
+
+// webhookFuncs son las funciones de las plantillas: json codifica un valor,
+// como {{json .Records}} o {{json .Message}}.
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// parseWebhookTemplate compila la plantilla del cuerpo, dada en text o, si
+// text está vacío, en el fichero file. Sin ninguna de las dos devuelve nil, y
+// el cuerpo es el array JSON de los registros.
+func parseWebhookTemplate(text, file string) (*template.Template, error) {
+	if text == "" && file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	if text == "" {
+		return nil, nil
+	}
+	return template.New("webhook").Funcs(webhookFuncs).Parse(text)
+}
+
+// WebhookOptions dice a qué URL enviar los lotes y cómo construir el cuerpo.
+type WebhookOptions struct {
+	URL         string
+	Headers     http.Header
+	ContentType string
+	Template    *template.Template
+	Timeout     time.Duration
+	Job         string
+	Host        string
+}
+
+// WebhookClient envía los registros por POST a una URL cualquiera, en lotes
+// y con los mismos reintentos que LokiClient.
+type WebhookClient struct {
+	opts       WebhookOptions
+	httpClient *http.Client
+	batcher    *batcher
+}
+
+func NewWebhookClient(opts WebhookOptions, cfg batchConfig, logf func(msg string)) *WebhookClient {
+	c := &WebhookClient{
+		opts:       opts,
+		httpClient: newHTTPClient(opts.Timeout, nil),
+	}
+	c.batcher = newBatcher("webhook", cfg, c.push, logf)
+	return c
+}
+
+// Send añade rec a la cola de envío sin esperar al servidor.
+func (c *WebhookClient) Send(rec LogRecord) {
+	c.batcher.Add(rec)
+}
+
+// Close envía lo pendiente e informa de las líneas que se hayan perdido.
+func (c *WebhookClient) Close() {
+	c.batcher.Close()
+}
+
+func (c *WebhookClient) push(batch []LogRecord) error {
+	body, err := c.body(batch)
+	if err != nil {
+		return &pushError{err: err}
+	}
+	req, err := http.NewRequest("POST", c.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return &pushError{err: err}
+	}
+	for name, values := range c.opts.Headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", c.opts.ContentType)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return responseError(resp)
+}
+
+// body construye el cuerpo de batch con la plantilla o, sin ella, como un
+// array JSON.
+func (c *WebhookClient) body(batch []LogRecord) ([]byte, error) {
+	records := make([]webhookRecord, len(batch))
+	for i, rec := range batch {
+		records[i] = webhookRecord{
+			Time:     rec.Time.Format(time.RFC3339Nano),
+			Host:     c.opts.Host,
+			Name:     rec.Name,
+			Process:  rec.Process,
+			Instance: rec.Instance,
+			Stream:   rec.Stream,
+			Pid:      rec.Pid,
+			Level:    rec.Level,
+			Message:  rec.Line,
+		}
+	}
+	if c.opts.Template == nil {
+		return json.Marshal(records)
+	}
+	var buf bytes.Buffer
+	err := c.opts.Template.Execute(&buf, webhookBody{Records: records, Job: c.opts.Job, Host: c.opts.Host})
+	if err != nil {
+		return nil, fmt.Errorf("executing template: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+type webhookSink struct {
+	client *WebhookClient
+	parser *LogParser
+}
+
+// openWebhookSink inicializa el webhook si se ha configurado webhook.url.
+func openWebhookSink(of *OutletFactory, pf *Procfile) (LogSink, error) {
+	if flagWebhookURL == "" {
+		return nil, nil
+	}
+	if u, err := url.Parse(flagWebhookURL); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid url %q", flagWebhookURL)
+	}
+	if flagWebhookBatchSize <= 0 || flagWebhookBatchWait <= 0 {
+		return nil, fmt.Errorf("webhook.batch_size and webhook.batch_wait must be positive")
+	}
+	headers, err := parseHeaders(flagWebhookHeaders)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := parseWebhookTemplate(flagWebhookTemplate, flagWebhookTemplateFile)
+	if err != nil {
+		return nil, fmt.Errorf("template: %v", err)
+	}
+	parser, err := levelParser()
+	if err != nil {
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+	opts := WebhookOptions{
+		URL:         flagWebhookURL,
+		Headers:     headers,
+		ContentType: flagWebhookContentType,
+		Template:    tmpl,
+		Timeout:     10 * time.Second,
+		Job:         flagLokiJob,
+		Host:        host,
+	}
+	cfg := batchConfig{
+		Size:       flagWebhookBatchSize,
+		Interval:   flagWebhookBatchWait,
+		QueueSize:  flagWebhookQueueSize,
+		Drop:       dropOldest,
+		Backoff:    defaultSinkBackoff,
+		BackoffMax: defaultSinkBackoffMax,
+		RetryFor:   flagWebhookRetryFor,
+	}
+	of.SystemOutput(fmt.Sprintf("webhook: sending logs to %s", flagWebhookURL))
+	return &webhookSink{client: NewWebhookClient(opts, cfg, of.SystemOutput), parser: parser}, nil
+}
+
+func (s *webhookSink) Send(rec LogRecord) {
+	if s.parser != nil {
+		s.parser.Process(&rec)
+	}
+	s.client.Send(rec)
+}
+
+func (s *webhookSink) Close() {
+	s.client.Close()
+}
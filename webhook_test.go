@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookClientJSON(t *testing.T) {
+	receiver := &otlpReceiver{}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	headers, err := parseHeaders("X-Api-Key=secreto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewWebhookClient(WebhookOptions{
+		URL:         srv.URL + "/ingest",
+		Headers:     headers,
+		ContentType: "application/json",
+		Timeout:     time.Second,
+		Host:        "box1",
+	}, testBatchConfig(), func(string) {})
+	for _, rec := range testOTLPBatch() {
+		c.Send(rec)
+	}
+	c.Close()
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	var records []webhookRecord
+	for i, req := range receiver.requests {
+		if req.URL.Path != "/ingest" || req.Header.Get("X-Api-Key") != "secreto" || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("petición inesperada: %s %v", req.URL, req.Header)
+		}
+		var batch []webhookRecord
+		if err := json.Unmarshal(receiver.bodies[i], &batch); err != nil {
+			t.Fatalf("cuerpo %q: %v", receiver.bodies[i], err)
+		}
+		records = append(records, batch...)
+	}
+	if len(records) != 3 {
+		t.Fatalf("%d registros, se esperaban 3", len(records))
+	}
+	want := webhookRecord{
+		Time:     time.Unix(1700000000, 5).Format(time.RFC3339Nano),
+		Host:     "box1",
+		Name:     "web.1",
+		Process:  "web",
+		Instance: 1,
+		Stream:   "stderr",
+		Pid:      42,
+		Level:    "error",
+		Message:  "boom",
+	}
+	if records[1] != want {
+		t.Errorf("registro = %+v, se esperaba %+v", records[1], want)
+	}
+}
+
+func TestWebhookTemplate(t *testing.T) {
+	tmpl, err := parseWebhookTemplate(`{"job":{{json .Job}},"lines":[{{range $i, $r := .Records}}{{if $i}},{{end}}{{json $r.Message}}{{end}}]}`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &WebhookClient{opts: WebhookOptions{Template: tmpl, Job: "app"}}
+	body, err := c.body(testOTLPBatch())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(body), `{"job":"app","lines":["hola","boom","sin nivel"]}`; got != want {
+		t.Errorf("cuerpo = %s, se esperaba %s", got, want)
+	}
+
+	if tmpl, err := parseWebhookTemplate("", ""); tmpl != nil || err != nil {
+		t.Errorf("sin plantilla = %v, %v", tmpl, err)
+	}
+	if _, err := parseWebhookTemplate("{{.Records", ""); err == nil || !strings.Contains(err.Error(), "webhook") {
+		t.Errorf("plantilla inválida: %v", err)
+	}
+}